@@ -31,9 +31,9 @@ describe('messages spec', () => {
     cy.contains('h5', 'Message securely stored').should('be.visible')
     cy.get('.message-pin')
       .invoke('text')
-      .then(parseFloat)
+      .then((text) => text.trim())
       .as('pinval')
-    cy.get('@pinval').should('be.gte', 100)
+    cy.get('@pinval').should('have.length.gte', 6)
     cy.get('.message-link').should('have.attr', 'href')
       .as('messageHref')
       .then(($href) => {
@@ -70,9 +70,9 @@ describe('messages spec', () => {
     cy.contains('h5', 'Message securely stored').should('be.visible')
     cy.get('.message-pin')
       .invoke('text')
-      .then(parseFloat)
+      .then((text) => text.trim())
       .as('pinval')
-    cy.get('@pinval').should('be.gte', 100)
+    cy.get('@pinval').should('have.length.gte', 6)
     cy.get('.message-link').should('have.attr', 'href')
       .as('messageHref')
       .then(($href) => {
@@ -112,4 +112,62 @@ describe('messages spec', () => {
 
   })
 
-})
\ No newline at end of file
+  it('alice revokes her message and it cannot be opened anymore', function() {
+
+    cy.loginAlice()
+
+    // create a message
+    cy.get('.nav-link.messages-new').click()
+    cy.get('#payload').type('sent to the wrong person')
+    cy.get('.btn-primary').click()
+    cy.contains('h5', 'Message securely stored').should('be.visible')
+    cy.get('.message-link').should('have.attr', 'href').as('messageHref')
+
+    // revoke it from the list
+    cy.get('@messageHref').then(($href) => {
+      cy.visit('/messages')
+      cy.get(`form.message-revoke[action="${$href}/delete"] button`).click()
+      cy.contains('h1', 'Messages').should('be.visible')
+      cy.get(`a[href="${$href}"]`).should('not.exist')
+      cy.visit($href, {failOnStatusCode: false})
+      cy.contains('h1', '404: Page not found').should('be.visible')
+    })
+  })
+
+  it('alice sends a message to joe and only joe can open it', function() {
+
+    cy.loginAlice()
+
+    // create a message for joe
+    cy.get('.nav-link.messages-new').click()
+    cy.get('#payload').type('only for joe')
+    cy.get('#recipients').type('joe')
+    cy.get('.btn-primary').click()
+    cy.contains('h5', 'Message securely stored').should('be.visible')
+    cy.get('.message-pin')
+      .invoke('text')
+      .then((text) => text.trim())
+      .as('pinval')
+    cy.get('.message-link').should('have.attr', 'href').as('messageHref')
+
+    // anonymous visitor is refused even with the pin
+    cy.logout()
+    cy.get('@messageHref').then($href => {
+      cy.visit($href)
+      cy.get('.message-restricted').should('be.visible')
+    })
+
+    // joe finds it in the inbox and opens it
+    cy.loginJoe()
+    cy.get('.nav-link.inbox-link').click()
+    cy.contains('h1', 'Inbox').should('be.visible')
+    cy.get('@messageHref').then($href => {
+      cy.get(`.inbox-row a[href="${$href}"]`).should('be.visible')
+      cy.get('@pinval').then((pinval) => {
+        cy.enterPin($href, pinval)
+      })
+    })
+    cy.contains('.message-content-decrypted', 'only for joe').should('be.visible')
+  })
+
+})
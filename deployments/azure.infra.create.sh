@@ -62,4 +62,7 @@ az webapp config storage-account list --resource-group $RG --name $FN_NAME
 
 # Create tables to use in the app
 az storage table create --account-name $STORAGE_ACCOUNT --account-key $AZURE_STORAGE_KEY --name users --fail-on-exist
-az storage table create --account-name $STORAGE_ACCOUNT --account-key $AZURE_STORAGE_KEY --name messages --fail-on-exist
\ No newline at end of file
+az storage table create --account-name $STORAGE_ACCOUNT --account-key $AZURE_STORAGE_KEY --name messages --fail-on-exist
+az storage table create --account-name $STORAGE_ACCOUNT --account-key $AZURE_STORAGE_KEY --name webhooks --fail-on-exist
+az storage table create --account-name $STORAGE_ACCOUNT --account-key $AZURE_STORAGE_KEY --name requests --fail-on-exist
+az storage table create --account-name $STORAGE_ACCOUNT --account-key $AZURE_STORAGE_KEY --name groups --fail-on-exist
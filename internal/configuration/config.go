@@ -2,7 +2,15 @@ package configuration
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/mailer"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
 )
 
 const keyEnvironment = "SERVER_ENV"
@@ -12,10 +20,75 @@ const keyCookieEnc = "COOK_ENC_KEY"
 const tableStorageAccount = "AZURE_STORAGE_ACCOUNT"
 const tableUsers = "AZTABLE_USERS"
 const tableMessages = "AZTABLE_MESSAGES"
+const tableWebhooks = "AZTABLE_WEBHOOKS"
+const tableRequests = "AZTABLE_REQUESTS"
+const tableGroups = "AZTABLE_GROUPS"
+const pinCharset = "PIN_CHARSET"
+const pinLength = "PIN_LENGTH"
+const pinZeroPad = "PIN_ZERO_PAD"
+const idEncoding = "ID_ENCODING"
+const idLength = "ID_LENGTH"
+const smtpHost = "SMTP_HOST"
+const smtpPort = "SMTP_PORT"
+const smtpUsername = "SMTP_USERNAME"
+const smtpPassword = "SMTP_PASSWORD"
+const smtpFrom = "SMTP_FROM"
+const publicURL = "PUBLIC_URL"
+const anonymousMessages = "ANONYMOUS_MESSAGES"
+const anonymousExpiry = "ANONYMOUS_EXPIRY"
+const anonymousMaxSize = "ANONYMOUS_MAX_SIZE"
+const anonymousRateLimit = "ANONYMOUS_RATE_LIMIT"
+const trustedProxy = "TRUSTED_PROXY"
+const quotaActiveMessages = "QUOTA_ACTIVE_MESSAGES"
+const quotaStoredBytes = "QUOTA_STORED_BYTES"
+const quotaDailyMessages = "QUOTA_DAILY_MESSAGES"
+const defaultSmtpPort = 587
 const envTest = "test"
 const testKey = "12345678123456781234567812345678"
 const requiredKeyLen = 32
 
+// AnonymousPolicy tells if the messages can be created without an account
+// and how they are restricted
+type AnonymousPolicy struct {
+	Enabled bool
+	// Expiry is the lifetime of every anonymous message, it cannot be chosen
+	Expiry time.Duration
+	// MaxSize caps the bytes of the content and the files together
+	MaxSize int64
+	// RateLimit is the number of messages a client can create per hour
+	RateLimit int
+}
+
+var DefaultAnonymousPolicy = AnonymousPolicy{
+	Enabled:   false,
+	Expiry:    time.Hour,
+	MaxSize:   16 << 10,
+	RateLimit: 5,
+}
+
+const maxAnonymousExpiry = 24 * time.Hour
+const maxAnonymousSize = 1 << 20
+
+func (p AnonymousPolicy) Validate() error {
+	if p.Expiry < time.Minute || p.Expiry > maxAnonymousExpiry {
+		return fmt.Errorf("anonymous message expiry must be between 1m and %s", maxAnonymousExpiry)
+	}
+	if p.MaxSize <= 0 || p.MaxSize > maxAnonymousSize {
+		return fmt.Errorf("anonymous message size must be between 1 and %d bytes", maxAnonymousSize)
+	}
+	if p.RateLimit <= 0 {
+		return fmt.Errorf("anonymous rate limit must be positive")
+	}
+	return nil
+}
+
+// DefaultQuota applies to the users without a quota set by an admin
+var DefaultQuota = storage.Quota{
+	ActiveMessages: 100,
+	StoredBytes:    100 << 20,
+	DailyMessages:  200,
+}
+
 type ConfigReader struct {
 	isProd bool
 }
@@ -37,8 +110,52 @@ func (c *ConfigReader) IsValid() (bool, []string) {
 			invalidVars = append(invalidVars, k)
 		}
 	}
+	if err := c.GetPinPolicy().Validate(); err != nil {
+		invalidVars = append(invalidVars, pinCharset, pinLength)
+	}
+	if v, ok := os.LookupEnv(pinZeroPad); ok {
+		if _, err := strconv.ParseBool(v); err != nil {
+			invalidVars = append(invalidVars, pinZeroPad)
+		}
+	}
+	if err := c.GetIDPolicy().Validate(); err != nil {
+		invalidVars = append(invalidVars, idEncoding, idLength)
+	}
+	if v, ok := os.LookupEnv(smtpPort); ok {
+		if _, err := strconv.Atoi(v); err != nil {
+			invalidVars = append(invalidVars, smtpPort)
+		}
+	}
+	if err := c.GetSMTPConfig().Validate(); err != nil {
+		invalidVars = append(invalidVars, smtpHost, smtpPort, smtpFrom)
+	}
+	if v := os.Getenv(publicURL); v != "" {
+		if u, err := url.Parse(v); err != nil || u.Scheme == "" || u.Host == "" {
+			invalidVars = append(invalidVars, publicURL)
+		}
+	}
+	if v, ok := os.LookupEnv(anonymousMessages); ok {
+		if _, err := strconv.ParseBool(v); err != nil {
+			invalidVars = append(invalidVars, anonymousMessages)
+		}
+	}
+	if err := c.GetAnonymousPolicy().Validate(); err != nil {
+		invalidVars = append(invalidVars, anonymousExpiry, anonymousMaxSize, anonymousRateLimit)
+	}
+	if v, ok := os.LookupEnv(trustedProxy); ok {
+		if _, err := strconv.ParseBool(v); err != nil {
+			invalidVars = append(invalidVars, trustedProxy)
+		}
+	}
+	for _, k := range []string{quotaActiveMessages, quotaStoredBytes, quotaDailyMessages} {
+		if v, ok := os.LookupEnv(k); ok {
+			if n, err := strconv.ParseInt(v, 10, 64); err != nil || n < 0 {
+				invalidVars = append(invalidVars, k)
+			}
+		}
+	}
 	if c.IsProd() {
-		for _, k := range []string{tableUsers, tableMessages, tableStorageAccount} {
+		for _, k := range []string{tableUsers, tableMessages, tableWebhooks, tableRequests, tableGroups, tableStorageAccount} {
 			if os.Getenv(k) == "" {
 				invalidVars = append(invalidVars, k)
 			}
@@ -71,10 +188,114 @@ func (c *ConfigReader) GetMessagesTableName() string {
 	return os.Getenv(tableMessages)
 }
 
+func (c *ConfigReader) GetWebhooksTableName() string {
+	return os.Getenv(tableWebhooks)
+}
+
+func (c *ConfigReader) GetRequestsTableName() string {
+	return os.Getenv(tableRequests)
+}
+
+func (c *ConfigReader) GetGroupsTableName() string {
+	return os.Getenv(tableGroups)
+}
+
 func (c *ConfigReader) GetStorageAccountName() string {
 	return os.Getenv(tableStorageAccount)
 }
 
+// Pin policy falls back to the defaults for the values which are not set
+// the values are checked in IsValid()
+func (c *ConfigReader) GetPinPolicy() crypto.PinPolicy {
+	policy := crypto.DefaultPinPolicy
+	if v, ok := os.LookupEnv(pinCharset); ok {
+		policy.Charset = v
+	}
+	if v, ok := os.LookupEnv(pinLength); ok {
+		policy.Length, _ = strconv.Atoi(v)
+	}
+	if v, ok := os.LookupEnv(pinZeroPad); ok {
+		policy.ZeroPad, _ = strconv.ParseBool(v)
+	}
+	return policy
+}
+
+// Message id policy falls back to the defaults for the values which are not set
+// the values are checked in IsValid()
+func (c *ConfigReader) GetIDPolicy() crypto.IDPolicy {
+	policy := crypto.DefaultIDPolicy
+	if v, ok := os.LookupEnv(idEncoding); ok {
+		policy.Encoding = v
+	}
+	if v, ok := os.LookupEnv(idLength); ok {
+		policy.Length, _ = strconv.Atoi(v)
+	}
+	return policy
+}
+
+// Mailer is disabled unless the SMTP host is set
+func (c *ConfigReader) GetSMTPConfig() mailer.SMTPConfig {
+	config := mailer.SMTPConfig{
+		Host:     os.Getenv(smtpHost),
+		Port:     defaultSmtpPort,
+		Username: os.Getenv(smtpUsername),
+		Password: os.Getenv(smtpPassword),
+		From:     os.Getenv(smtpFrom),
+	}
+	if v, ok := os.LookupEnv(smtpPort); ok {
+		config.Port, _ = strconv.Atoi(v)
+	}
+	return config
+}
+
+// Anonymous messages are disabled unless turned on explicitly,
+// the values are checked in IsValid()
+func (c *ConfigReader) GetAnonymousPolicy() AnonymousPolicy {
+	policy := DefaultAnonymousPolicy
+	if v, ok := os.LookupEnv(anonymousMessages); ok {
+		policy.Enabled, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv(anonymousExpiry); ok {
+		policy.Expiry, _ = time.ParseDuration(v)
+	}
+	if v, ok := os.LookupEnv(anonymousMaxSize); ok {
+		policy.MaxSize, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := os.LookupEnv(anonymousRateLimit); ok {
+		policy.RateLimit, _ = strconv.Atoi(v)
+	}
+	return policy
+}
+
+// Trusted proxy tells that the server is only reachable through a proxy
+// which appends the client address to X-Forwarded-For, off by default
+func (c *ConfigReader) IsTrustedProxy() bool {
+	v, _ := strconv.ParseBool(os.Getenv(trustedProxy))
+	return v
+}
+
+// Quota of every user unless an admin sets another one,
+// zero turns the limit off, the values are checked in IsValid()
+func (c *ConfigReader) GetDefaultQuota() storage.Quota {
+	quota := DefaultQuota
+	if v, ok := os.LookupEnv(quotaActiveMessages); ok {
+		quota.ActiveMessages, _ = strconv.Atoi(v)
+	}
+	if v, ok := os.LookupEnv(quotaStoredBytes); ok {
+		quota.StoredBytes, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := os.LookupEnv(quotaDailyMessages); ok {
+		quota.DailyMessages, _ = strconv.Atoi(v)
+	}
+	return quota
+}
+
+// Public URL of the server is used in the links sent out of the application,
+// when empty the links are built from the request
+func (c *ConfigReader) GetPublicURL() string {
+	return strings.TrimSuffix(os.Getenv(publicURL), "/")
+}
+
 // Production environment expects the value to be set in the
 // environmental variable. If not set the application will fail to start.
 func (c *ConfigReader) getKey(name string, assert bool) string {
@@ -2,8 +2,10 @@ package configuration_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ivarprudnikov/secretshare/internal/configuration"
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
 )
 
 func TestConfigValidation(t *testing.T) {
@@ -100,3 +102,137 @@ func TestIncorrectEncKeyPanic(t *testing.T) {
 	}()
 	defaultConfig.GetCookieEnc()
 }
+
+func TestPinPolicy(t *testing.T) {
+	t.Setenv("SERVER_ENV", "test")
+	defaultPolicy := configuration.NewConfigReader().GetPinPolicy()
+	if defaultPolicy != crypto.DefaultPinPolicy {
+		t.Fatalf("Unexpected default pin policy %v", defaultPolicy)
+	}
+
+	t.Setenv("PIN_CHARSET", "words")
+	t.Setenv("PIN_LENGTH", "4")
+	t.Setenv("PIN_ZERO_PAD", "true")
+	testConfig := configuration.NewConfigReader()
+	policy := testConfig.GetPinPolicy()
+	if policy.Charset != crypto.PinWords || policy.Length != 4 || !policy.ZeroPad {
+		t.Fatalf("Unexpected pin policy %v", policy)
+	}
+	if ok, vars := testConfig.IsValid(); !ok {
+		t.Fatalf("Pin policy should be valid %v", vars)
+	}
+
+	t.Setenv("PIN_LENGTH", "1")
+	if ok, _ := configuration.NewConfigReader().IsValid(); ok {
+		t.Fatal("Too short pin should be invalid")
+	}
+
+	t.Setenv("PIN_LENGTH", "4")
+	t.Setenv("PIN_CHARSET", "emoji")
+	if ok, _ := configuration.NewConfigReader().IsValid(); ok {
+		t.Fatal("Unknown pin charset should be invalid")
+	}
+}
+
+func TestSMTPConfig(t *testing.T) {
+	t.Setenv("SERVER_ENV", "test")
+	if configuration.NewConfigReader().GetSMTPConfig().Enabled() {
+		t.Fatal("Mailer should be disabled by default")
+	}
+
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_FROM", "Secretzz <noreply@example.com>")
+	testConfig := configuration.NewConfigReader()
+	config := testConfig.GetSMTPConfig()
+	if !config.Enabled() || config.Port != 587 {
+		t.Fatalf("Unexpected smtp config %v", config)
+	}
+	if ok, vars := testConfig.IsValid(); !ok {
+		t.Fatalf("Smtp config should be valid %v", vars)
+	}
+
+	t.Setenv("SMTP_PORT", "smtp")
+	if ok, _ := configuration.NewConfigReader().IsValid(); ok {
+		t.Fatal("Port must be a number")
+	}
+
+	t.Setenv("SMTP_PORT", "25")
+	t.Setenv("SMTP_FROM", "")
+	if ok, _ := configuration.NewConfigReader().IsValid(); ok {
+		t.Fatal("From address is required")
+	}
+}
+
+func TestIDPolicy(t *testing.T) {
+	t.Setenv("SERVER_ENV", "test")
+	defaultPolicy := configuration.NewConfigReader().GetIDPolicy()
+	if defaultPolicy != crypto.DefaultIDPolicy {
+		t.Fatalf("Unexpected default id policy %v", defaultPolicy)
+	}
+
+	t.Setenv("ID_ENCODING", "base32")
+	t.Setenv("ID_LENGTH", "26")
+	testConfig := configuration.NewConfigReader()
+	policy := testConfig.GetIDPolicy()
+	if policy.Encoding != crypto.IDBase32 || policy.Length != 26 {
+		t.Fatalf("Unexpected id policy %v", policy)
+	}
+	if ok, vars := testConfig.IsValid(); !ok {
+		t.Fatalf("Id policy should be valid %v", vars)
+	}
+
+	t.Setenv("ID_LENGTH", "8")
+	if ok, _ := configuration.NewConfigReader().IsValid(); ok {
+		t.Fatal("Too short id should be invalid")
+	}
+}
+
+func TestAnonymousPolicy(t *testing.T) {
+	t.Setenv("SERVER_ENV", "test")
+	defaultPolicy := configuration.NewConfigReader().GetAnonymousPolicy()
+	if defaultPolicy != configuration.DefaultAnonymousPolicy || defaultPolicy.Enabled {
+		t.Fatalf("Unexpected default anonymous policy %v", defaultPolicy)
+	}
+
+	t.Setenv("ANONYMOUS_MESSAGES", "true")
+	t.Setenv("ANONYMOUS_EXPIRY", "30m")
+	t.Setenv("ANONYMOUS_MAX_SIZE", "4096")
+	t.Setenv("ANONYMOUS_RATE_LIMIT", "2")
+	testConfig := configuration.NewConfigReader()
+	policy := testConfig.GetAnonymousPolicy()
+	if !policy.Enabled || policy.Expiry != 30*time.Minute || policy.MaxSize != 4096 || policy.RateLimit != 2 {
+		t.Fatalf("Unexpected anonymous policy %v", policy)
+	}
+	if ok, vars := testConfig.IsValid(); !ok {
+		t.Fatalf("Anonymous policy should be valid %v", vars)
+	}
+
+	t.Setenv("ANONYMOUS_EXPIRY", "72h")
+	if ok, _ := configuration.NewConfigReader().IsValid(); ok {
+		t.Fatal("Long anonymous expiry should be invalid")
+	}
+}
+
+func TestDefaultQuota(t *testing.T) {
+	t.Setenv("SERVER_ENV", "test")
+	if quota := configuration.NewConfigReader().GetDefaultQuota(); quota != configuration.DefaultQuota {
+		t.Fatalf("Unexpected default quota %v", quota)
+	}
+
+	t.Setenv("QUOTA_ACTIVE_MESSAGES", "0")
+	t.Setenv("QUOTA_STORED_BYTES", "1024")
+	t.Setenv("QUOTA_DAILY_MESSAGES", "3")
+	testConfig := configuration.NewConfigReader()
+	quota := testConfig.GetDefaultQuota()
+	if quota.ActiveMessages != 0 || quota.StoredBytes != 1024 || quota.DailyMessages != 3 {
+		t.Fatalf("Unexpected quota %v", quota)
+	}
+	if ok, vars := testConfig.IsValid(); !ok {
+		t.Fatalf("Quota should be valid %v", vars)
+	}
+
+	t.Setenv("QUOTA_DAILY_MESSAGES", "-1")
+	if ok, _ := configuration.NewConfigReader().IsValid(); ok {
+		t.Fatal("Negative quota should be invalid")
+	}
+}
@@ -11,6 +11,14 @@ import (
 
 type EntityEncryptHelper struct{}
 
+// the nonce and the tag AES-GCM stores along with every ciphertext
+const gcmOverhead = 12 + 16
+
+// SealedSize is the length of the hex ciphertext EncryptAES makes of the plain text
+func SealedSize(plaintext int) int {
+	return hex.EncodedLen(gcmOverhead + plaintext)
+}
+
 func (e EntityEncryptHelper) Encrypt(text, pass, salt string) (string, error) {
 	// derive a key from the pass
 	key, err := StrongKey(pass, salt)
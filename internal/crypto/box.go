@@ -0,0 +1,100 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const boxInfo = "secretshare box v1"
+
+// GenerateBoxKey creates an X25519 key pair, the hex encoded public key
+// is used to seal the secrets which only the private key can open
+func GenerateBoxKey() (public string, private string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	return hex.EncodeToString(key.PublicKey().Bytes()), hex.EncodeToString(key.Bytes()), nil
+}
+
+// SealToPublicKey encrypts the text so that the sender does not need to know
+// any secret. An ephemeral key is agreed with the public key, the shared secret
+// is expanded with HKDF into the AES-GCM key and the ephemeral public key
+// is prepended to the ciphertext.
+func SealToPublicKey(public string, plaintext string) (string, error) {
+	recipient, err := parseBoxPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	key, err := boxKey(ephemeral, recipient, ephemeral.PublicKey())
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := EncryptAES(key, plaintext)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ephemeral.PublicKey().Bytes()) + ciphertext, nil
+}
+
+// OpenWithPrivateKey decrypts the text sealed by SealToPublicKey
+func OpenWithPrivateKey(private string, sealed string) (string, error) {
+	privateBytes, err := hex.DecodeString(private)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %w", err)
+	}
+	recipient, err := ecdh.X25519().NewPrivateKey(privateBytes)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %w", err)
+	}
+	// the public key is 32 bytes in hex
+	if len(sealed) < 64 {
+		return "", fmt.Errorf("sealed text is too short")
+	}
+	ephemeral, err := parseBoxPublicKey(sealed[:64])
+	if err != nil {
+		return "", err
+	}
+	key, err := boxKey(recipient, ephemeral, ephemeral)
+	if err != nil {
+		return "", err
+	}
+	return DecryptAES(key, sealed[64:])
+}
+
+func parseBoxPublicKey(public string) (*ecdh.PublicKey, error) {
+	publicBytes, err := hex.DecodeString(public)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPublicKey(publicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return key, nil
+}
+
+// boxKey derives the AES key from the shared secret,
+// the ephemeral public key binds the key to this very message
+func boxKey(private *ecdh.PrivateKey, public *ecdh.PublicKey, ephemeral *ecdh.PublicKey) ([]byte, error) {
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to agree on the key: %w", err)
+	}
+	kdf := hkdf.New(sha256.New, shared, ephemeral.Bytes(), []byte(boxInfo))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, fmt.Errorf("failed to fill hkdf bytes: %w", err)
+	}
+	return key, nil
+}
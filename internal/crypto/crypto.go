@@ -1,26 +1,122 @@
 package crypto
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	_ "embed"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/hkdf"
 )
 
-// simple pin number generator
-// returns 4-5 digits
-func MakePin() (string, error) {
-	b, err := generateRandomBytes(16)
-	if err != nil {
+const (
+	PinDigits       = "digits"
+	PinAlphanumeric = "alphanumeric"
+	PinWords        = "words"
+)
+
+// characters which are hard to confuse when read out loud or written down
+const pinAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+const maxPinLength = 32
+
+// minimal length for each kind of the pin
+var minPinLength = map[string]int{
+	PinDigits:       6,
+	PinAlphanumeric: 6,
+	PinWords:        3,
+}
+
+//go:embed pinwords.txt
+var pinWordsText string
+
+var pinWords = strings.Fields(pinWordsText)
+
+// PinPolicy describes the format of the generated pins
+type PinPolicy struct {
+	// Charset is one of PinDigits, PinAlphanumeric or PinWords
+	Charset string
+	// Length is the number of digits, characters or words in the pin
+	Length int
+	// ZeroPad allows digit pins to start with zeros, otherwise
+	// the first digit is never zero
+	ZeroPad bool
+}
+
+var DefaultPinPolicy = PinPolicy{Charset: PinDigits, Length: 6}
+
+func (p PinPolicy) Validate() error {
+	minLength, ok := minPinLength[p.Charset]
+	if !ok {
+		return fmt.Errorf("unsupported pin charset %s", p.Charset)
+	}
+	if p.Length < minLength || p.Length > maxPinLength {
+		return fmt.Errorf("%s pin length must be between %d and %d", p.Charset, minLength, maxPinLength)
+	}
+	return nil
+}
+
+// Describe returns a human readable format of the pin
+func (p PinPolicy) Describe() string {
+	switch p.Charset {
+	case PinAlphanumeric:
+		return fmt.Sprintf("%d letters and digits", p.Length)
+	case PinWords:
+		return fmt.Sprintf("%d words separated by dashes", p.Length)
+	default:
+		return fmt.Sprintf("%d digits", p.Length)
+	}
+}
+
+// pin generator which follows the given policy
+func MakePin(policy PinPolicy) (string, error) {
+	if err := policy.Validate(); err != nil {
 		return "", err
 	}
-	pin := binary.BigEndian.Uint16(b)
-	return fmt.Sprintf("%d", pin), nil
+	switch policy.Charset {
+	case PinAlphanumeric:
+		return makePinFromAlphabet(strings.Split(pinAlphabet, ""), policy.Length, "")
+	case PinWords:
+		return makePinFromAlphabet(pinWords, policy.Length, "-")
+	default:
+		return makeDigitPin(policy.Length, policy.ZeroPad)
+	}
+}
+
+func makeDigitPin(length int, zeroPad bool) (string, error) {
+	upper := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil)
+	lower := big.NewInt(0)
+	if !zeroPad {
+		lower.Exp(big.NewInt(10), big.NewInt(int64(length-1)), nil)
+	}
+	n, err := rand.Int(rand.Reader, new(big.Int).Sub(upper, lower))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random pin: %w", err)
+	}
+	digits := n.Add(n, lower).String()
+	return strings.Repeat("0", length-len(digits)) + digits, nil
+}
+
+func makePinFromAlphabet(alphabet []string, length int, separator string) (string, error) {
+	parts := make([]string, length)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range parts {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random pin: %w", err)
+		}
+		parts[i] = alphabet[n.Int64()]
+	}
+	return strings.Join(parts, separator), nil
 }
 
 // simple random token generator (url encoded)
@@ -32,6 +128,22 @@ func MakeToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
+// random hex string of the given number of bytes
+func RandomHex(size uint32) (string, error) {
+	b, err := generateRandomBytes(size)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HMAC-SHA256 of the text in hex, used to sign the payloads sent to third parties
+func HmacText(key string, text string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // simple text hashing
 func HashText(text string) string {
 	textHash := sha256.Sum256([]byte(text))
@@ -66,3 +178,36 @@ func generateRandomBytes(size uint32) ([]byte, error) {
 	}
 	return bucket, nil
 }
+
+const MinPassphraseLength = 12
+
+// minimal strength check for the passphrase chosen by the user
+// it needs to be long and use a mix of characters
+func CheckPassphrase(passphrase string) error {
+	if utf8.RuneCountInString(passphrase) < MinPassphraseLength {
+		return fmt.Errorf("passphrase must be at least %d characters long", MinPassphraseLength)
+	}
+	var lower, upper, digit, other bool
+	for _, r := range passphrase {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	if classes < 3 {
+		return errors.New("passphrase must mix at least three of: lowercase, uppercase, digits, symbols or spaces")
+	}
+	return nil
+}
@@ -10,19 +10,49 @@ import (
 )
 
 func TestHash_MakePin(t *testing.T) {
-	pin, err := crypto.MakePin()
+	pin, err := crypto.MakePin(crypto.DefaultPinPolicy)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
-	if len(pin) < 4 || len(pin) > 5 {
-		t.Fatalf("unexpected pin lenght %s", pin)
-	}
-	re := regexp.MustCompile(`\d+`)
+	re := regexp.MustCompile(`^[1-9]\d{5}$`)
 	if !re.Match([]byte(pin)) {
 		t.Fatalf("unexpected pin %s", pin)
 	}
 }
 
+func TestHash_MakePin_Policies(t *testing.T) {
+	policies := map[*regexp.Regexp]crypto.PinPolicy{
+		regexp.MustCompile(`^\d{8}$`):              {Charset: crypto.PinDigits, Length: 8, ZeroPad: true},
+		regexp.MustCompile(`^[1-9]\d{9}$`):         {Charset: crypto.PinDigits, Length: 10},
+		regexp.MustCompile(`^[A-Z2-9]{7}$`):        {Charset: crypto.PinAlphanumeric, Length: 7},
+		regexp.MustCompile(`^[a-z]+(-[a-z]+){3}$`): {Charset: crypto.PinWords, Length: 4},
+	}
+	for re, policy := range policies {
+		for range 20 {
+			pin, err := crypto.MakePin(policy)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !re.Match([]byte(pin)) {
+				t.Fatalf("unexpected pin %s for policy %v", pin, policy)
+			}
+		}
+	}
+}
+
+func TestHash_MakePin_InvalidPolicy(t *testing.T) {
+	for _, policy := range []crypto.PinPolicy{
+		{Charset: crypto.PinDigits, Length: 4},
+		{Charset: crypto.PinWords, Length: 2},
+		{Charset: crypto.PinAlphanumeric, Length: 100},
+		{Charset: "emoji", Length: 6},
+	} {
+		if _, err := crypto.MakePin(policy); err == nil {
+			t.Fatalf("Expected policy %v to be rejected", policy)
+		}
+	}
+}
+
 func TestHash_StrongKey(t *testing.T) {
 	salt := "12345678901234567890123456789012"
 	key1, err := crypto.StrongKey("1234", salt)
@@ -79,3 +109,127 @@ func TestHash_HashPass_ThenCompare(t *testing.T) {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 }
+
+func TestHash_CheckPassphrase(t *testing.T) {
+	for _, weak := range []string{"", "short1A!", "alllowercaseletters", "lowercase and spaces", "ALLUPPER12345"} {
+		if err := crypto.CheckPassphrase(weak); err == nil {
+			t.Fatalf("expected passphrase %q to be rejected", weak)
+		}
+	}
+	for _, strong := range []string{"correct Horse battery", "Tr0ub4dor&3xyz", "blue sky 42 and rain"} {
+		if err := crypto.CheckPassphrase(strong); err != nil {
+			t.Fatalf("expected passphrase %q to be accepted, got %v", strong, err)
+		}
+	}
+}
+
+func TestHash_HmacText(t *testing.T) {
+	// RFC 4231 test case 2
+	signature := crypto.HmacText("Jefe", "what do ya want for nothing?")
+	if signature != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+		t.Fatalf("unexpected signature %s", signature)
+	}
+}
+
+func TestMakeID_Policies(t *testing.T) {
+	policies := map[*regexp.Regexp]crypto.IDPolicy{
+		regexp.MustCompile(`^[0-9A-Za-z]{22}$`): crypto.DefaultIDPolicy,
+		regexp.MustCompile(`^[a-z2-7]{26}$`):    {Encoding: crypto.IDBase32, Length: 26},
+	}
+	for re, policy := range policies {
+		seen := map[string]bool{}
+		for range 100 {
+			id, err := crypto.MakeID(policy)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !re.MatchString(id) || seen[id] {
+				t.Fatalf("unexpected id %s for policy %v", id, policy)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestIDPolicy_Accepts(t *testing.T) {
+	base32 := crypto.IDPolicy{Encoding: crypto.IDBase32, Length: 26}
+	accepted := map[string]crypto.IDPolicy{
+		"0aZ9bY8cX7dW6eV5fU4gT3":      crypto.DefaultIDPolicy,
+		"abcdefghijklmnopqrstuvwxyz":  base32,
+		crypto.HashText("legacy"):     base32,
+		crypto.HashText("legacy")[1:]: crypto.DefaultIDPolicy,
+	}
+	for id, policy := range accepted {
+		if !policy.Accepts(id) {
+			t.Fatalf("Expected id %s to be accepted by %v", id, policy)
+		}
+	}
+	rejected := map[string]crypto.IDPolicy{
+		"":                            crypto.DefaultIDPolicy,
+		"abc' or PartitionKey ne '":   crypto.DefaultIDPolicy,
+		"abc-def":                     crypto.DefaultIDPolicy,
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ":  base32,
+		crypto.HashText("legacy")[1:]: base32,
+		strings.Repeat("a", 65):       crypto.DefaultIDPolicy,
+	}
+	for id, policy := range rejected {
+		if policy.Accepts(id) {
+			t.Fatalf("Expected id %s to be rejected by %v", id, policy)
+		}
+	}
+}
+
+func TestAES_SealedSize(t *testing.T) {
+	helper := crypto.EntityEncryptHelper{}
+	for _, text := range []string{"", "a", strings.Repeat("secret", 100)} {
+		ciphertext, err := helper.Encrypt(text, "123456", "12345678123456781234567812345678")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if crypto.SealedSize(len(text)) != len(ciphertext) {
+			t.Fatalf("Expected %d, got %d", len(ciphertext), crypto.SealedSize(len(text)))
+		}
+	}
+}
+
+func TestMakeID_InvalidPolicy(t *testing.T) {
+	for _, policy := range []crypto.IDPolicy{
+		{Encoding: crypto.IDBase32, Length: 10},
+		{Encoding: crypto.IDBase62, Length: 100},
+		{Encoding: "hex", Length: 32},
+	} {
+		if _, err := crypto.MakeID(policy); err == nil {
+			t.Fatalf("Expected policy %v to be rejected", policy)
+		}
+	}
+}
+
+func TestBox_SealOpen(t *testing.T) {
+	public, private, err := crypto.GenerateBoxKey()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	sealed, err := crypto.SealToPublicKey(public, "abc")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	again, _ := crypto.SealToPublicKey(public, "abc")
+	if sealed == again {
+		t.Fatal("sealing twice should use different ephemeral keys")
+	}
+	plaintext, err := crypto.OpenWithPrivateKey(private, sealed)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if plaintext != "abc" {
+		t.Fatal("failed to decrypt the content to the same state")
+	}
+
+	_, otherPrivate, _ := crypto.GenerateBoxKey()
+	if _, err := crypto.OpenWithPrivateKey(otherPrivate, sealed); err == nil {
+		t.Fatal("another private key must not open the text")
+	}
+	if _, err := crypto.SealToPublicKey("not a key", "abc"); err == nil {
+		t.Fatal("invalid public key must fail")
+	}
+}
@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	IDBase32 = "base32"
+	IDBase62 = "base62"
+)
+
+// lowercase base32 of RFC 4648 looks the same in any part of the link
+const idBase32Alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+const idBase62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const maxIDLength = 64
+
+// the messages created before the random IDs have the hex SHA-256 of the content
+const hexAlphabet = "0123456789abcdef"
+const hexDigestLength = 64
+
+// minimal length for each encoding to keep at least 100 bits of randomness
+var minIDLength = map[string]int{
+	IDBase32: 20,
+	IDBase62: 17,
+}
+
+// IDPolicy describes the format of the generated message identifiers
+type IDPolicy struct {
+	// Encoding is one of IDBase32 or IDBase62
+	Encoding string
+	// Length is the number of characters in the identifier
+	Length int
+}
+
+// 22 base62 characters carry about 131 bits
+var DefaultIDPolicy = IDPolicy{Encoding: IDBase62, Length: 22}
+
+func (p IDPolicy) Validate() error {
+	minLength, ok := minIDLength[p.Encoding]
+	if !ok {
+		return fmt.Errorf("unsupported id encoding %s", p.Encoding)
+	}
+	if p.Length < minLength || p.Length > maxIDLength {
+		return fmt.Errorf("%s id length must be between %d and %d", p.Encoding, minLength, maxIDLength)
+	}
+	return nil
+}
+
+func (p IDPolicy) alphabet() string {
+	if p.Encoding == IDBase32 {
+		return idBase32Alphabet
+	}
+	return idBase62Alphabet
+}
+
+// Accepts checks the identifier from the link before it is put into a query,
+// only the characters of the policy alphabet are allowed. The length is not
+// fixed so the links made before the length was changed keep working, the same
+// as the hex digests the messages were identified by before the random IDs.
+func (p IDPolicy) Accepts(id string) bool {
+	if id == "" || len(id) > maxIDLength {
+		return false
+	}
+	if len(id) == hexDigestLength && strings.Trim(id, hexAlphabet) == "" {
+		return true
+	}
+	return strings.Trim(id, p.alphabet()) == ""
+}
+
+// MakeID generates a random identifier which follows the policy,
+// it tells nothing about the content it identifies
+func MakeID(policy IDPolicy) (string, error) {
+	if err := policy.Validate(); err != nil {
+		return "", err
+	}
+	id, err := makePinFromAlphabet(strings.Split(policy.alphabet(), ""), policy.Length, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random id: %w", err)
+	}
+	return id, nil
+}
@@ -0,0 +1,159 @@
+// Package mailer sends the email notifications through an SMTP server.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"embed"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templates of the emails get embedded in the binary
+//
+//go:embed templates
+var templatesFs embed.FS
+
+var tmpl = template.Must(template.New("").ParseFS(templatesFs, "templates/*.tmpl"))
+
+const sendTimeout = 30 * time.Second
+
+// SMTPConfig holds the connection details, the mailer is disabled without the host
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (c SMTPConfig) Enabled() bool {
+	return c.Host != ""
+}
+
+func (c SMTPConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid smtp port %d", c.Port)
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return fmt.Errorf("invalid from address: %w", err)
+	}
+	return nil
+}
+
+// Mail is a plain text email
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+type smtpMailer struct {
+	config SMTPConfig
+}
+
+func NewSMTPMailer(config SMTPConfig) Mailer {
+	return &smtpMailer{config: config}
+}
+
+// Send delivers the mail the same way as smtp.SendMail does
+// but respects the context and does not wait forever on the server
+func (s *smtpMailer) Send(ctx context.Context, m Mail) error {
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %w", err)
+	}
+	msg, err := s.compose(to, m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	addr := net.JoinHostPort(s.config.Host, strconv.Itoa(s.config.Port))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to smtp server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, s.config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start smtp session: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: s.config.Host}); err != nil {
+			return fmt.Errorf("failed to start tls: %w", err)
+		}
+	}
+	if s.config.Username != "" {
+		// plain auth refuses to send the password over an unencrypted connection except to localhost
+		if err = c.Auth(smtp.PlainAuth("", s.config.Username, s.config.Password, s.config.Host)); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+	from, _ := mail.ParseAddress(s.config.From)
+	if err = c.Mail(from.Address); err != nil {
+		return fmt.Errorf("smtp server rejected the sender: %w", err)
+	}
+	if err = c.Rcpt(to.Address); err != nil {
+		return fmt.Errorf("smtp server rejected the recipient: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("failed to start the mail data: %w", err)
+	}
+	if _, err = w.Write(msg); err != nil {
+		return fmt.Errorf("failed to write the mail data: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("smtp server rejected the mail: %w", err)
+	}
+	return c.Quit()
+}
+
+func (s *smtpMailer) compose(to *mail.Address, m Mail) ([]byte, error) {
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return nil, errors.New("subject must be a single line")
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.config.From)
+	fmt.Fprintf(&b, "To: %s\r\n", to.String())
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	// the data writer of the smtp client takes care of the line endings
+	b.WriteString(m.Body)
+	return b.Bytes(), nil
+}
+
+// Render executes the named template from the templates directory
+func Render(name string, data any) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&b, name, data); err != nil {
+		return "", fmt.Errorf("failed to render %s: %w", name, err)
+	}
+	return b.String(), nil
+}
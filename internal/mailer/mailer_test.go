@@ -0,0 +1,233 @@
+package mailer_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/mailer"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+	"github.com/ivarprudnikov/secretshare/internal/storage/memstore"
+)
+
+type receivedMail struct {
+	auth string
+	from string
+	to   string
+	data string
+}
+
+// smtpStandIn is a minimal SMTP server which accepts every mail
+type smtpStandIn struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	mails []receivedMail
+}
+
+func startSMTP(t *testing.T) *smtpStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	s := &smtpStandIn{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	var mail receivedMail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			mail.auth = arg
+			tp.PrintfLine("235 2.7.0 Authentication successful")
+		case "MAIL":
+			mail.from = arg
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			mail.to = arg
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			mail.data = string(data)
+			s.mu.Lock()
+			s.mails = append(s.mails, mail)
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *smtpStandIn) config() mailer.SMTPConfig {
+	return mailer.SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     s.ln.Addr().(*net.TCPAddr).Port,
+		Username: "mailer",
+		Password: "secret",
+		From:     "Secretzz <noreply@example.com>",
+	}
+}
+
+// waitForMails polls the stand-in until the expected number of mails arrive
+func (s *smtpStandIn) waitForMails(t *testing.T, expected int) []receivedMail {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		mails := append([]receivedMail{}, s.mails...)
+		s.mu.Unlock()
+		if len(mails) >= expected {
+			return mails
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d mails in time", expected)
+	return nil
+}
+
+func TestSMTPConfig_Validate(t *testing.T) {
+	if err := (mailer.SMTPConfig{}).Validate(); err != nil {
+		t.Fatalf("Expected disabled config to be valid, got %v", err)
+	}
+	if err := (mailer.SMTPConfig{Host: "localhost", Port: 25, From: "not an address"}).Validate(); err == nil {
+		t.Fatalf("Expected invalid from address to fail")
+	}
+	if err := (mailer.SMTPConfig{Host: "localhost", Port: 0, From: "noreply@example.com"}).Validate(); err == nil {
+		t.Fatalf("Expected invalid port to fail")
+	}
+}
+
+func TestSMTPMailer_Send(t *testing.T) {
+	srv := startSMTP(t)
+	m := mailer.NewSMTPMailer(srv.config())
+
+	err := m.Send(context.Background(), mailer.Mail{To: "bob@example.com", Subject: "Hello", Body: "first line\nsecond line\n"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	mails := srv.waitForMails(t, 1)
+	if mails[0].auth == "" {
+		t.Fatalf("Expected the mailer to authenticate")
+	}
+	if mails[0].from != "FROM:<noreply@example.com>" || mails[0].to != "TO:<bob@example.com>" {
+		t.Fatalf("Unexpected envelope %v", mails[0])
+	}
+	headers, err := textproto.NewReader(bufio.NewReader(strings.NewReader(mails[0].data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if headers.Get("Subject") != "Hello" || headers.Get("To") != "<bob@example.com>" {
+		t.Fatalf("Unexpected headers %v", headers)
+	}
+	if !strings.Contains(mails[0].data, "first line\nsecond line") {
+		t.Fatalf("Unexpected body %q", mails[0].data)
+	}
+}
+
+func TestSMTPMailer_RejectsInvalidMail(t *testing.T) {
+	srv := startSMTP(t)
+	m := mailer.NewSMTPMailer(srv.config())
+
+	if err := m.Send(context.Background(), mailer.Mail{To: "not an address", Subject: "Hello"}); err == nil {
+		t.Fatalf("Expected invalid recipient to fail")
+	}
+	if err := m.Send(context.Background(), mailer.Mail{To: "bob@example.com", Subject: "Hello\r\nBcc: eve@example.com"}); err == nil {
+		t.Fatalf("Expected header injection to fail")
+	}
+}
+
+func TestOwnerNotifier(t *testing.T) {
+	srv := startSMTP(t)
+	users := memstore.NewMemUserStore("12345678123456781234567812345678")
+	users.AddUser(context.Background(), "alice", "alice", []string{})
+	users.SetUserEmail(context.Background(), "alice", "alice@example.com")
+	users.AddUser(context.Background(), "joe", "joe", []string{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notifier := mailer.NewOwnerNotifier(mailer.NewSMTPMailer(srv.config()), users)
+	go notifier.Run(ctx)
+
+	messages := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+	messages.Subscribe(notifier)
+
+	// joe has no email and does not get notified
+	msg, _ := messages.AddMessage(context.Background(), "foobar", "joe", storage.MessageOptions{ExpiresIn: time.Hour})
+	messages.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+
+	// read message
+	msg, _ = messages.AddMessage(context.Background(), "foobar", "alice", storage.MessageOptions{ExpiresIn: time.Hour})
+	messages.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+	mails := srv.waitForMails(t, 1)
+	if mails[0].to != "TO:<alice@example.com>" || !strings.Contains(mails[0].data, "was opened") || !strings.Contains(mails[0].data, msg.PartitionKey) {
+		t.Fatalf("Unexpected mail %v", mails[0])
+	}
+	if strings.Contains(mails[0].data, "foobar") {
+		t.Fatalf("Expected the content not to be mailed")
+	}
+
+	// destroyed message
+	msg, _ = messages.AddMessage(context.Background(), "foobar", "alice", storage.MessageOptions{ExpiresIn: time.Hour})
+	for range storage.MAX_PIN_ATTEMPTS {
+		messages.GetFullMessage(context.Background(), msg.PartitionKey, "invalidpin", "")
+	}
+	mails = srv.waitForMails(t, 2)
+	if !strings.Contains(mails[1].data, "failed PIN attempts") {
+		t.Fatalf("Unexpected mail %v", mails[1])
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(srv.waitForMails(t, 2)) != 2 {
+		t.Fatalf("Expected exactly two mails")
+	}
+}
+
+func TestShareLink(t *testing.T) {
+	srv := startSMTP(t)
+	err := mailer.ShareLink(context.Background(), mailer.NewSMTPMailer(srv.config()), "bob@example.com", mailer.SharedMessage{
+		Sender:    "alice",
+		Link:      "https://example.com/messages/abc",
+		ExpiresAt: "01 Jan 30 00:00 UTC",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	mails := srv.waitForMails(t, 1)
+	if !strings.Contains(mails[0].data, "https://example.com/messages/abc") || !strings.Contains(mails[0].data, "send you the PIN") {
+		t.Fatalf("Unexpected mail %q", mails[0].data)
+	}
+}
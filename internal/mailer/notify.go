@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+const notifyQueueSize = 100
+
+// OwnerNotifier listens to the message store and emails the owners
+// who have set their address when their message was read or destroyed
+type OwnerNotifier struct {
+	mailer Mailer
+	users  storage.UserStore
+	queue  chan storage.LifecycleEvent
+}
+
+func NewOwnerNotifier(mailer Mailer, users storage.UserStore) *OwnerNotifier {
+	return &OwnerNotifier{
+		mailer: mailer,
+		users:  users,
+		queue:  make(chan storage.LifecycleEvent, notifyQueueSize),
+	}
+}
+
+// MessageChanged queues the event, the owner is told once about the read
+// message even though it is followed by the destroyed event after the last view
+func (n *OwnerNotifier) MessageChanged(ctx context.Context, event storage.LifecycleEvent) {
+	notify := event.Type == storage.EventRead ||
+		(event.Type == storage.EventDestroyed && event.Status != storage.StatusRead)
+	if !notify {
+		return
+	}
+	select {
+	case n.queue <- event:
+	default:
+		slog.LogAttrs(ctx, slog.LevelError, "mail queue is full, dropping notification", slog.String("id", event.MessageID), slog.String("event", event.Type))
+	}
+}
+
+// Run sends the queued notifications until the context gets cancelled
+func (n *OwnerNotifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-n.queue:
+			if err := n.notify(ctx, event); err != nil {
+				slog.LogAttrs(ctx, slog.LevelError, "failed to notify the owner", slog.String("id", event.MessageID), slog.String("username", event.Owner), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (n *OwnerNotifier) notify(ctx context.Context, event storage.LifecycleEvent) error {
+	user, err := n.users.GetUser(ctx, event.Owner)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Email == "" {
+		return nil
+	}
+	name, subject := "message.read.tmpl", "Your secret message was opened"
+	if event.Type == storage.EventDestroyed {
+		name, subject = "message.destroyed.tmpl", "Your secret message was destroyed"
+	}
+	body, err := Render(name, event)
+	if err != nil {
+		return err
+	}
+	return n.mailer.Send(ctx, Mail{To: user.Email, Subject: subject, Body: body})
+}
+
+// SharedMessage is the data of the email with the link to the message
+type SharedMessage struct {
+	Sender     string
+	Link       string
+	Passphrase bool
+	ExpiresAt  string
+}
+
+// ShareLink emails the link to the message, the PIN is never included
+func ShareLink(ctx context.Context, mailer Mailer, to string, msg SharedMessage) error {
+	body, err := Render("message.shared.tmpl", msg)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(ctx, Mail{To: to, Subject: msg.Sender + " shared a secret message with you", Body: body})
+}
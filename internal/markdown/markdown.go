@@ -0,0 +1,157 @@
+// Package markdown renders the common subset of Markdown into HTML which is
+// safe to embed in the page: every piece of the text is escaped, raw HTML is
+// shown as text and the links are limited to http, https and mailto.
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+var (
+	headingPattern   = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	bulletPattern    = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	numberedPattern  = regexp.MustCompile(`^\s*\d{1,9}[.)]\s+(.*)$`)
+	rulePattern      = regexp.MustCompile(`^\s*([-*_])(\s*([-*_])){2,}\s*$`)
+	fencePattern     = regexp.MustCompile("^\\s*(```|~~~)\\s*([A-Za-z0-9_+#.-]*)")
+	quotePattern     = regexp.MustCompile(`^\s*>\s?(.*)$`)
+	codeSpanPattern  = regexp.MustCompile("`([^`]+)`")
+	linkPattern      = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	strongPattern    = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	emphasisPattern  = regexp.MustCompile(`\*([^*\s][^*]*)\*|\b_([^_]+)_\b`)
+	placeholderRegex = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// Render converts the Markdown text into HTML
+func Render(text string) template.HTML {
+	// the placeholders of the inline code and the links use the NUL character
+	text = strings.ReplaceAll(text, "\x00", "")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	var out strings.Builder
+	renderBlocks(&out, strings.Split(text, "\n"))
+	return template.HTML(out.String())
+}
+
+func renderBlocks(out *strings.Builder, lines []string) {
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + renderInline(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if m := fencePattern.FindStringSubmatch(line); m != nil {
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), m[1]); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code")
+			if m[2] != "" {
+				out.WriteString(` class="language-` + html.EscapeString(m[2]) + `"`)
+			}
+			out.WriteString(">" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+			continue
+		}
+		if m := headingPattern.FindStringSubmatch(line); m != nil {
+			flush()
+			level := len(m[1])
+			out.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, renderInline(m[2]), level))
+			continue
+		}
+		if rulePattern.MatchString(line) {
+			flush()
+			out.WriteString("<hr>\n")
+			continue
+		}
+		if quotePattern.MatchString(line) {
+			flush()
+			var quoted []string
+			for ; i < len(lines); i++ {
+				m := quotePattern.FindStringSubmatch(lines[i])
+				if m == nil {
+					break
+				}
+				quoted = append(quoted, m[1])
+			}
+			i--
+			out.WriteString("<blockquote>\n")
+			renderBlocks(out, quoted)
+			out.WriteString("</blockquote>\n")
+			continue
+		}
+		if list, tag := listPattern(line); list != nil {
+			flush()
+			out.WriteString("<" + tag + ">\n")
+			for ; i < len(lines); i++ {
+				m := list.FindStringSubmatch(lines[i])
+				if m == nil {
+					break
+				}
+				out.WriteString("<li>" + renderInline(m[1]) + "</li>\n")
+			}
+			i--
+			out.WriteString("</" + tag + ">\n")
+			continue
+		}
+		paragraph = append(paragraph, line)
+	}
+	flush()
+}
+
+func listPattern(line string) (*regexp.Regexp, string) {
+	if bulletPattern.MatchString(line) {
+		return bulletPattern, "ul"
+	}
+	if numberedPattern.MatchString(line) {
+		return numberedPattern, "ol"
+	}
+	return nil, ""
+}
+
+// renderInline escapes the text, the code spans and the links are replaced
+// by placeholders first so that the emphasis cannot break into them
+func renderInline(text string) string {
+	var parts []string
+	keep := func(part string) string {
+		parts = append(parts, part)
+		return fmt.Sprintf("\x00%d\x00", len(parts)-1)
+	}
+	text = codeSpanPattern.ReplaceAllStringFunc(text, func(s string) string {
+		return keep("<code>" + html.EscapeString(codeSpanPattern.FindStringSubmatch(s)[1]) + "</code>")
+	})
+	text = html.EscapeString(text)
+	text = linkPattern.ReplaceAllStringFunc(text, func(s string) string {
+		m := linkPattern.FindStringSubmatch(s)
+		if !isSafeURL(html.UnescapeString(m[2])) {
+			return s
+		}
+		return keep(`<a href="`+m[2]+`" rel="nofollow noopener noreferrer">`) + m[1] + keep("</a>")
+	})
+	text = strongPattern.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = emphasisPattern.ReplaceAllString(text, "<em>$1$2</em>")
+	return placeholderRegex.ReplaceAllStringFunc(text, func(s string) string {
+		var i int
+		fmt.Sscanf(placeholderRegex.FindStringSubmatch(s)[1], "%d", &i)
+		return parts[i]
+	})
+}
+
+func isSafeURL(url string) bool {
+	lower := strings.ToLower(url)
+	for _, scheme := range []string{"http://", "https://", "mailto:"} {
+		if strings.HasPrefix(lower, scheme) {
+			return true
+		}
+	}
+	return false
+}
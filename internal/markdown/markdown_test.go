@@ -0,0 +1,43 @@
+package markdown_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ivarprudnikov/secretshare/internal/markdown"
+)
+
+func TestRender(t *testing.T) {
+	text := "# Access\n\nUse **this** key, _not_ the `old_one`:\n\n- staging\n- prod\n\n```yaml\nkey: <value>\n```\n\n> see [docs](https://example.com/a_b_c)"
+	rendered := string(markdown.Render(text))
+	for _, expected := range []string{
+		"<h1>Access</h1>",
+		"<strong>this</strong>",
+		"<em>not</em>",
+		"<code>old_one</code>",
+		"<ul>\n<li>staging</li>\n<li>prod</li>\n</ul>",
+		"<pre><code class=\"language-yaml\">key: &lt;value&gt;</code></pre>",
+		"<blockquote>\n<p>see <a href=\"https://example.com/a_b_c\" rel=\"nofollow noopener noreferrer\">docs</a></p>\n</blockquote>",
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Fatalf("Expected %q in the rendered text:\n%s", expected, rendered)
+		}
+	}
+}
+
+func TestRender_Escapes(t *testing.T) {
+	for _, text := range []string{
+		"<script>alert(1)</script>",
+		"[click](javascript:alert(1))",
+		"[click](https://example.com\"onmouseover=\"alert(1))",
+		"<img src=x onerror=alert(1)>",
+		"`<b>` **<i>**",
+	} {
+		rendered := string(markdown.Render(text))
+		if strings.Contains(rendered, "<script") || strings.Contains(rendered, "<img") ||
+			strings.Contains(rendered, "<b>") || strings.Contains(rendered, "<i>") ||
+			strings.Contains(rendered, "href=\"javascript") || strings.Contains(rendered, "\"onmouseover") {
+			t.Fatalf("Expected %q to be escaped, got %s", text, rendered)
+		}
+	}
+}
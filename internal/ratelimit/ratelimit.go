@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter allows every client a number of actions per window, the clients
+// get their allowance back gradually like with a token bucket.
+// The state is kept in memory therefore every server instance counts separately.
+type Limiter struct {
+	mu        sync.Mutex
+	limit     float64
+	window    time.Duration
+	clients   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewLimiter(limit int, window time.Duration) *Limiter {
+	return &Limiter{
+		limit:     float64(limit),
+		window:    window,
+		clients:   map[string]*bucket{},
+		lastPrune: time.Now(),
+	}
+}
+
+// Allow uses up one action of the client, it returns false
+// if the client has used up the allowance of the window
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+	b, ok := l.clients[key]
+	if !ok {
+		b = &bucket{tokens: l.limit, updated: now}
+		l.clients[key] = b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * l.limit / l.window.Seconds()
+	if b.tokens > l.limit {
+		b.tokens = l.limit
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// prune forgets the clients which have not been seen for the whole window,
+// their allowance is full again anyway
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.window {
+		return
+	}
+	for key, b := range l.clients {
+		if now.Sub(b.updated) >= l.window {
+			delete(l.clients, key)
+		}
+	}
+	l.lastPrune = now
+}
@@ -0,0 +1,33 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/ratelimit"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	limiter := ratelimit.NewLimiter(3, 200*time.Millisecond)
+	for i := range 3 {
+		if !limiter.Allow("client-a") {
+			t.Fatalf("Expected action %d to be allowed", i+1)
+		}
+	}
+	if limiter.Allow("client-a") {
+		t.Fatal("Expected the action over the limit to be denied")
+	}
+	if !limiter.Allow("client-b") {
+		t.Fatal("Expected another client to have its own allowance")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !limiter.Allow("client-a") {
+		t.Fatal("Expected the allowance to be restored gradually")
+	}
+	time.Sleep(250 * time.Millisecond)
+	for i := range 3 {
+		if !limiter.Allow("client-a") {
+			t.Fatalf("Expected action %d to be allowed after the window", i+1)
+		}
+	}
+}
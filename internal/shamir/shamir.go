@@ -0,0 +1,121 @@
+// Package shamir splits a secret into shares with Shamir's Secret Sharing,
+// any threshold number of the shares recovers the secret while fewer shares
+// tell nothing about it. Every byte of the secret is shared separately
+// with a random polynomial over GF(2^8).
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+const MIN_SHARES = 2
+const MAX_SHARES = 255
+
+var ErrInvalidShares = errors.New("shares are not valid")
+
+// Split returns the given number of shares, the last byte of every
+// share is its x coordinate and the rest are the y coordinates
+func Split(secret []byte, shares int, threshold int) ([][]byte, error) {
+	if shares < MIN_SHARES || shares > MAX_SHARES {
+		return nil, fmt.Errorf("number of shares must be between %d and %d", MIN_SHARES, MAX_SHARES)
+	}
+	if threshold < MIN_SHARES || threshold > shares {
+		return nil, fmt.Errorf("threshold must be between %d and the number of shares", MIN_SHARES)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("secret is empty")
+	}
+	result := make([][]byte, shares)
+	for i := range result {
+		result[i] = make([]byte, len(secret)+1)
+		// x = 0 would reveal the secret
+		result[i][len(secret)] = byte(i + 1)
+	}
+	coefficients := make([]byte, threshold)
+	for b, value := range secret {
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, fmt.Errorf("failed to generate coefficients: %w", err)
+		}
+		coefficients[0] = value
+		for i := range result {
+			result[i][b] = evaluate(coefficients, byte(i+1))
+		}
+	}
+	return result, nil
+}
+
+// Combine recovers the secret from the shares with Lagrange interpolation at x = 0.
+// With fewer shares than the threshold the result is random.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < MIN_SHARES {
+		return nil, ErrInvalidShares
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, ErrInvalidShares
+	}
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, ErrInvalidShares
+		}
+		xs[i] = share[size-1]
+		if xs[i] == 0 {
+			return nil, ErrInvalidShares
+		}
+		for j := range i {
+			if xs[j] == xs[i] {
+				return nil, ErrInvalidShares
+			}
+		}
+	}
+	secret := make([]byte, size-1)
+	for b := range secret {
+		var value byte
+		for i, share := range shares {
+			// basis polynomial of the share evaluated at 0
+			basis := byte(1)
+			for j := range shares {
+				if i != j {
+					basis = mul(basis, div(xs[j], xs[i]^xs[j]))
+				}
+			}
+			value ^= mul(share[b], basis)
+		}
+		secret[b] = value
+	}
+	return secret, nil
+}
+
+// evaluate uses the Horner's method, the first coefficient is the constant
+func evaluate(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = mul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// mul multiplies in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1,
+// it runs in constant time not to leak the secret bytes
+func mul(a, b byte) byte {
+	var result byte
+	for range 8 {
+		result ^= a & -(b & 1)
+		carry := -(a >> 7)
+		a = (a << 1) ^ (0x1b & carry)
+		b >>= 1
+	}
+	return result
+}
+
+// div multiplies by the inverse which is a^254 in GF(2^8), b must not be 0
+func div(a, b byte) byte {
+	inverse := b
+	for range 6 {
+		inverse = mul(mul(inverse, inverse), b)
+	}
+	return mul(a, mul(inverse, inverse))
+}
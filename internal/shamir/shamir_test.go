@@ -0,0 +1,63 @@
+package shamir_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ivarprudnikov/secretshare/internal/shamir"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("break glass: hunter2")
+	shares, err := shamir.Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("Expected 5 shares, got %d", len(shares))
+	}
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var picked [][]byte
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		combined, err := shamir.Combine(picked)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !bytes.Equal(combined, secret) {
+			t.Fatalf("Shares %v combined into %q", subset, combined)
+		}
+	}
+	combined, err := shamir.Combine(shares[:2])
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if bytes.Equal(combined, secret) {
+		t.Fatal("Expected fewer shares than the threshold not to recover the secret")
+	}
+}
+
+func TestSplit_InvalidArguments(t *testing.T) {
+	for _, tc := range []struct{ shares, threshold int }{{1, 1}, {3, 4}, {5, 1}, {256, 2}} {
+		if _, err := shamir.Split([]byte("secret"), tc.shares, tc.threshold); err == nil {
+			t.Fatalf("Expected an error for %d shares and threshold %d", tc.shares, tc.threshold)
+		}
+	}
+	if _, err := shamir.Split(nil, 3, 2); err == nil {
+		t.Fatal("Expected an error for the empty secret")
+	}
+}
+
+func TestCombine_InvalidShares(t *testing.T) {
+	shares, err := shamir.Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := shamir.Combine([][]byte{shares[0], shares[0]}); err != shamir.ErrInvalidShares {
+		t.Fatalf("Expected duplicate shares to be refused, got %v", err)
+	}
+	if _, err := shamir.Combine([][]byte{shares[0], shares[1][1:]}); err != shamir.ErrInvalidShares {
+		t.Fatalf("Expected shares of different length to be refused, got %v", err)
+	}
+}
@@ -2,14 +2,26 @@ package aztablestore
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
 )
 
+// CONNECTION_STRING_ENV points the clients to a local table emulator
+// such as Azurite instead of the storage account
+const CONNECTION_STRING_ENV = "AZTABLE_CONNECTION_STRING"
+
 // Use default function credentials and use it for the table client
 // the expectation is that the function identity has access to the table
 func getTableClient(accountName, tableName string) (*aztables.Client, error) {
+	if connectionString := os.Getenv(CONNECTION_STRING_ENV); connectionString != "" {
+		service, err := aztables.NewServiceClientFromConnectionString(connectionString, nil)
+		if err != nil {
+			return nil, err
+		}
+		return service.NewClient(tableName), nil
+	}
 	cred, err := azidentity.NewManagedIdentityCredential(nil)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,203 @@
+package aztablestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+// A string property is limited to 64 KiB of UTF-16 and an entity to 1 MiB,
+// the ciphertext is ASCII so a character takes 2 bytes.
+const MAX_PROPERTY_LENGTH = 32 << 10
+const CHUNK_PROPERTIES = 15
+
+// The chunks are kept next to the message in its partition, usernames
+// cannot contain the separator so the row keys never clash.
+const chunkSeparator = "~chunk~"
+
+// chunkedFields are the message properties which may outgrow a single property,
+// the message keeps "<field>Chunks" with the hash of the value and the number of chunks
+var chunkedFields = []string{"Content", "Attachments"}
+
+type entityProperties map[string]json.RawMessage
+
+func isChunkKey(rowKey string) bool {
+	return strings.Contains(rowKey, chunkSeparator)
+}
+
+func chunkKey(owner, field, hash string, index int) string {
+	return fmt.Sprintf("%s%s%s~%s~%03d", owner, chunkSeparator, field, hash, index)
+}
+
+func chunkPart(index int) string {
+	return fmt.Sprintf("Part%02d", index)
+}
+
+// splitMessage marshals the message and moves the long properties into chunk
+// entities. The chunk row keys contain the hash of the value, so the chunks
+// of a value which did not change are written over with the same data.
+func splitMessage(msg *storage.Message) ([]byte, map[string][]byte, error) {
+	marshalled, err := json.Marshal(msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+	var props entityProperties
+	if err := json.Unmarshal(marshalled, &props); err != nil {
+		return nil, nil, fmt.Errorf("failed to read message properties: %w", err)
+	}
+	chunks := map[string][]byte{}
+	for _, field := range chunkedFields {
+		var value string
+		if err := json.Unmarshal(props[field], &value); err != nil || len(value) <= MAX_PROPERTY_LENGTH {
+			continue
+		}
+		sum := sha256.Sum256([]byte(value))
+		hash := hex.EncodeToString(sum[:8])
+		count := 0
+		for start := 0; start < len(value); count++ {
+			chunk := map[string]string{
+				"PartitionKey": msg.PartitionKey,
+				"RowKey":       chunkKey(msg.RowKey, field, hash, count),
+			}
+			for part := 0; part < CHUNK_PROPERTIES && start < len(value); part++ {
+				end := min(start+MAX_PROPERTY_LENGTH, len(value))
+				chunk[chunkPart(part)] = value[start:end]
+				start = end
+			}
+			data, err := json.Marshal(chunk)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to marshal message chunk: %w", err)
+			}
+			chunks[chunk["RowKey"]] = data
+		}
+		props[field] = json.RawMessage(`""`)
+		props[field+"Chunks"], _ = json.Marshal(hash + ":" + strconv.Itoa(count))
+	}
+	if len(chunks) == 0 {
+		return marshalled, nil, nil
+	}
+	marshalled, err = json.Marshal(props)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return marshalled, chunks, nil
+}
+
+// joinMessage puts the chunked properties back into the message
+func joinMessage(entity []byte, chunks map[string]entityProperties) (*storage.Message, error) {
+	var props entityProperties
+	if err := json.Unmarshal(entity, &props); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	var owner string
+	json.Unmarshal(props["RowKey"], &owner)
+	for _, field := range chunkedFields {
+		var ref string
+		if err := json.Unmarshal(props[field+"Chunks"], &ref); err != nil || ref == "" {
+			continue
+		}
+		hash, countValue, _ := strings.Cut(ref, ":")
+		count, err := strconv.Atoi(countValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunks of %s: %s", field, ref)
+		}
+		var value strings.Builder
+		for i := 0; i < count; i++ {
+			chunk, ok := chunks[chunkKey(owner, field, hash, i)]
+			if !ok {
+				return nil, fmt.Errorf("chunk %d of %s is missing", i, field)
+			}
+			for part := 0; part < CHUNK_PROPERTIES; part++ {
+				var s string
+				if err := json.Unmarshal(chunk[chunkPart(part)], &s); err != nil {
+					break
+				}
+				value.WriteString(s)
+			}
+		}
+		props[field], _ = json.Marshal(value.String())
+		delete(props, field+"Chunks")
+	}
+	marshalled, err := json.Marshal(props)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+	var msg *storage.Message
+	if err := json.Unmarshal(marshalled, &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	return msg, nil
+}
+
+// listChunkKeys returns the row keys of the chunks the owner has in the partition
+func listChunkKeys(ctx context.Context, client *aztables.Client, id string, owner string) (map[string]bool, error) {
+	keys := map[string]bool{}
+	idFilter := fmt.Sprintf("PartitionKey eq '%s'", id)
+	keySelector := "RowKey"
+	metadataFormat := aztables.MetadataFormatNone
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &idFilter,
+		Select: &keySelector,
+		Format: &metadataFormat,
+	})
+	for listPager.More() {
+		response, err := listPager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var entity aztables.Entity
+			if err := json.Unmarshal(v, &entity); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal chunk key: %w", err)
+			}
+			if strings.HasPrefix(entity.RowKey, owner+chunkSeparator) {
+				keys[entity.RowKey] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+// writeChunks adds the chunks which are not stored yet
+func writeChunks(ctx context.Context, client *aztables.Client, chunks map[string][]byte, existing map[string]bool) error {
+	for key, data := range chunks {
+		if existing[key] {
+			continue
+		}
+		_, err := client.UpsertEntity(ctx, data, &aztables.UpsertEntityOptions{
+			UpdateMode: aztables.UpdateModeReplace,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upsert message chunk: %w", err)
+		}
+	}
+	return nil
+}
+
+// deleteChunks removes the existing chunks the message does not point to anymore
+func deleteChunks(ctx context.Context, client *aztables.Client, id string, existing map[string]bool, keep map[string][]byte) error {
+	for key := range existing {
+		if _, ok := keep[key]; ok {
+			continue
+		}
+		_, err := client.DeleteEntity(ctx, id, key, nil)
+		if err != nil {
+			var respErr *azcore.ResponseError
+			if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+				continue
+			}
+			return fmt.Errorf("failed to delete message chunk: %w", err)
+		}
+	}
+	return nil
+}
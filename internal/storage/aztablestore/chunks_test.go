@@ -0,0 +1,68 @@
+package aztablestore
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+func TestSplitAndJoinMessage(t *testing.T) {
+	msg, err := storage.NewMessage("testuser", "", "1234", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	msg.PartitionKey = "abc"
+	// more than a single chunk entity takes
+	msg.Content = strings.Repeat("0123456789abcdef", MAX_PROPERTY_LENGTH*CHUNK_PROPERTIES/16+100)
+	msg.Attachments = "small"
+
+	entity, chunks, err := splitMessage(&msg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("Expected 2 chunks, got %d", len(chunks))
+	}
+	var props entityProperties
+	if err := json.Unmarshal(entity, &props); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(props["Content"]) != `""` || props["AttachmentsChunks"] != nil {
+		t.Fatalf("Expected only the long property to be chunked")
+	}
+
+	stored := map[string]entityProperties{}
+	for key, data := range chunks {
+		var chunk entityProperties
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		for part, value := range chunk {
+			var s string
+			json.Unmarshal(value, &s)
+			if len(s) > MAX_PROPERTY_LENGTH {
+				t.Fatalf("Expected %s to fit the property, got %d", part, len(s))
+			}
+		}
+		stored[key] = chunk
+	}
+	joined, err := joinMessage(entity, stored)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if joined.Content != msg.Content || joined.Attachments != msg.Attachments {
+		t.Fatalf("Expected the content to be reassembled")
+	}
+
+	// a missing chunk is an error, not a truncated message
+	for key := range stored {
+		delete(stored, key)
+		break
+	}
+	if _, err := joinMessage(entity, stored); err == nil {
+		t.Fatalf("Expected the missing chunk to fail")
+	}
+}
@@ -0,0 +1,287 @@
+package aztablestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+// MAX_UPDATE_ATTEMPTS is how many times an entity is saved again if it was
+// changed at the same time, e.g. another holder has redeemed their share
+const MAX_UPDATE_ATTEMPTS = 3
+
+type azGroupStore struct {
+	crypto.EntityEncryptHelper
+	accountName string
+	tableName   string
+	salt        string
+	pinPolicy   crypto.PinPolicy
+	idPolicy    crypto.IDPolicy
+}
+
+func NewAzGroupStore(accountName, tableName, salt string, pinPolicy crypto.PinPolicy, idPolicy crypto.IDPolicy) storage.GroupStore {
+	return &azGroupStore{accountName: accountName, tableName: tableName, salt: salt, pinPolicy: pinPolicy, idPolicy: idPolicy}
+}
+
+func (s *azGroupStore) getClient() (*aztables.Client, error) {
+	return getTableClient(s.accountName, s.tableName)
+}
+
+func (s *azGroupStore) AddGroup(ctx context.Context, username string, total int, threshold int, expiresIn time.Duration) (*storage.ShareGroup, error) {
+	pin, err := crypto.MakePin(s.pinPolicy)
+	if err != nil {
+		return nil, err
+	}
+	id, err := crypto.MakeID(s.idPolicy)
+	if err != nil {
+		return nil, err
+	}
+	group, err := storage.NewShareGroup(id, username, total, threshold, expiresIn, pin, s, s.salt)
+	if err != nil {
+		return nil, err
+	}
+	marshalled, err := json.Marshal(group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal group: %w", err)
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.AddEntity(ctx, marshalled, nil)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusConflict {
+			return nil, storage.ErrIDCollision
+		}
+		return nil, fmt.Errorf("failed to save group: %w", err)
+	}
+	// temporarily show the pin to the owner
+	group.Pin = pin
+	return &group, nil
+}
+
+func (s *azGroupStore) GetGroup(ctx context.Context, id string) (*storage.ShareGroup, error) {
+	group, err := s.findGroup(ctx, id)
+	if errors.Is(err, storage.ErrGroupNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if group.IsExpired() {
+		return nil, nil
+	}
+	return group, nil
+}
+
+// The holders redeem their shares concurrently, the group is
+// updated on the condition nobody has changed it in between
+func (s *azGroupStore) RedeemShare(ctx context.Context, id string, share string) (*storage.ShareGroup, error) {
+	found, err := s.findGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for range MAX_UPDATE_ATTEMPTS {
+		group, etag, err := s.getGroup(ctx, id, found.RowKey)
+		if err != nil {
+			return nil, err
+		}
+		if group.IsExpired() {
+			return nil, storage.ErrGroupNotFound
+		}
+		if err := group.Redeem(share); err != nil {
+			return nil, err
+		}
+		err = s.updateGroup(ctx, group, etag)
+		if errors.Is(err, errChanged) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return group, nil
+	}
+	return nil, fmt.Errorf("failed to redeem the share in %d attempts: %w", MAX_UPDATE_ATTEMPTS, errChanged)
+}
+
+func (s *azGroupStore) CombineShares(ctx context.Context, id string, pin string) (string, error) {
+	found, err := s.findGroup(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	group, etag, err := s.getGroup(ctx, id, found.RowKey)
+	if err != nil {
+		return "", err
+	}
+	if group.IsExpired() {
+		return "", storage.ErrGroupNotFound
+	}
+	secret, err := group.Combine(s, s.salt, pin)
+	if errors.Is(err, storage.ErrInvalidPin) {
+		group.AttemptsRemaining -= 1
+		var saveErr error
+		if group.AttemptsRemaining <= 0 {
+			saveErr = s.deleteGroup(ctx, group)
+		} else {
+			saveErr = s.updateGroup(ctx, group, etag)
+		}
+		if saveErr != nil {
+			return "", saveErr
+		}
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	// the secret is recovered once
+	if err := s.deleteGroup(ctx, group); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// The expiry is stored as a fixed width UTC string
+// therefore it is possible to compare it as text in the query
+// The row key is the username of the owner, the entity
+// will not be found if it belongs to someone else
+func (s *azGroupStore) DeleteGroup(ctx context.Context, id string, username string) error {
+	return s.deleteGroup(ctx, &storage.ShareGroup{Entity: aztables.Entity{PartitionKey: id, RowKey: username}})
+}
+
+func (s *azGroupStore) DeleteExpiredGroups(ctx context.Context) (int64, error) {
+	var count int64 = 0
+	client, err := s.getClient()
+	if err != nil {
+		return count, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	now, err := aztables.EDMDateTime(time.Now().UTC().Truncate(time.Second)).MarshalText()
+	if err != nil {
+		return count, fmt.Errorf("failed to format current time: %w", err)
+	}
+	expiredFilter := fmt.Sprintf("ExpiresAt le '%s'", now)
+	keySelector := "PartitionKey,RowKey"
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &expiredFilter,
+		Select: &keySelector,
+	})
+	for listPager.More() {
+		response, err := listPager.NextPage(ctx)
+		if err != nil {
+			return count, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var group *storage.ShareGroup
+			err = json.Unmarshal(v, &group)
+			if err != nil {
+				return count, fmt.Errorf("failed to unmarshal expired group: %w", err)
+			}
+			err = s.deleteGroup(ctx, group)
+			if err != nil && !errors.Is(err, storage.ErrGroupNotFound) {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// findGroup looks the group up by the id only, the owner is not known to the holders
+func (s *azGroupStore) findGroup(ctx context.Context, id string) (*storage.ShareGroup, error) {
+	// the id from the link goes into the filter
+	if !s.idPolicy.Accepts(id) {
+		return nil, storage.ErrGroupNotFound
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	idFilter := fmt.Sprintf("PartitionKey eq '%s'", id)
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &idFilter,
+	})
+	for listPager.More() {
+		response, err := listPager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var group *storage.ShareGroup
+			err = json.Unmarshal(v, &group)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal group: %w", err)
+			}
+			return group, nil
+		}
+	}
+	return nil, storage.ErrGroupNotFound
+}
+
+// getGroup reads the group along with its version
+func (s *azGroupStore) getGroup(ctx context.Context, id string, username string) (*storage.ShareGroup, azcore.ETag, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	resp, err := client.GetEntity(ctx, id, username, nil)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return nil, "", storage.ErrGroupNotFound
+		}
+		return nil, "", fmt.Errorf("failed to get group entity: %w", err)
+	}
+	var group *storage.ShareGroup
+	if err = json.Unmarshal(resp.Value, &group); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal group: %w", err)
+	}
+	return group, resp.ETag, nil
+}
+
+// updateGroup replaces the group if nobody has changed it since it was read
+func (s *azGroupStore) updateGroup(ctx context.Context, group *storage.ShareGroup, etag azcore.ETag) error {
+	marshalled, err := json.Marshal(group)
+	if err != nil {
+		return fmt.Errorf("failed to marshal group: %w", err)
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.UpdateEntity(ctx, marshalled, &aztables.UpdateEntityOptions{
+		IfMatch:    &etag,
+		UpdateMode: aztables.UpdateModeReplace,
+	})
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusPreconditionFailed {
+			return errChanged
+		}
+		return fmt.Errorf("failed to update group entity: %w", err)
+	}
+	return nil
+}
+
+func (s *azGroupStore) deleteGroup(ctx context.Context, group *storage.ShareGroup) error {
+	client, err := s.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.DeleteEntity(ctx, group.PartitionKey, group.RowKey, nil)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return storage.ErrGroupNotFound
+		}
+		return fmt.Errorf("failed to delete group entity: %w", err)
+	}
+	return nil
+}
@@ -3,9 +3,14 @@ package aztablestore
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"strings"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
 	"github.com/ivarprudnikov/secretshare/internal/crypto"
 	"github.com/ivarprudnikov/secretshare/internal/storage"
@@ -13,13 +18,16 @@ import (
 
 type azMessageStore struct {
 	crypto.EntityEncryptHelper
+	storage.Notifier
 	accountName string
 	tableName   string
 	salt        string
+	pinPolicy   crypto.PinPolicy
+	idPolicy    crypto.IDPolicy
 }
 
-func NewAzMessageStore(accountName, tableName, salt string) storage.MessageStore {
-	return &azMessageStore{accountName: accountName, tableName: tableName, salt: salt}
+func NewAzMessageStore(accountName, tableName, salt string, pinPolicy crypto.PinPolicy, idPolicy crypto.IDPolicy) storage.MessageStore {
+	return &azMessageStore{accountName: accountName, tableName: tableName, salt: salt, pinPolicy: pinPolicy, idPolicy: idPolicy}
 }
 
 func (s *azMessageStore) getClient() (*aztables.Client, error) {
@@ -32,7 +40,9 @@ func (s *azMessageStore) CountMessages(ctx context.Context) (int64, error) {
 	if err != nil {
 		return count, fmt.Errorf("failed to get aztable client: %w", err)
 	}
-	keySelector := "PartitionKey"
+	// tombstones and chunks are not counted, older entities do not have
+	// the status property and the table query cannot match a missing one
+	keySelector := "PartitionKey,RowKey,Status"
 	metadataFormat := aztables.MetadataFormatNone
 	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
 		Select: &keySelector,
@@ -43,21 +53,135 @@ func (s *azMessageStore) CountMessages(ctx context.Context) (int64, error) {
 		if err != nil {
 			return count, fmt.Errorf("failed to get page of results: %w", err)
 		}
-		count += int64(len(response.Entities))
+		for _, v := range response.Entities {
+			var msg *storage.Message
+			err = json.Unmarshal(v, &msg)
+			if err != nil {
+				return count, fmt.Errorf("failed to unmarshal message in list of results: %w", err)
+			}
+			if !msg.IsTombstone() && !isChunkKey(msg.RowKey) {
+				count++
+			}
+		}
 	}
 	return count, nil
 }
 
-func (s *azMessageStore) ListMessages(ctx context.Context, username string) ([]*storage.Message, error) {
-	var msgs []*storage.Message
+// The entities come ordered by the ID, that page is read with the table
+// continuation tokens. The table cannot sort by other properties, then the messages
+// of the owner are read in full and sorted in memory. The labels are not
+// searchable in the query either and get filtered one by one.
+func (s *azMessageStore) ListMessages(ctx context.Context, username string, opts storage.ListOptions) (*storage.MessagePage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
 	client, err := s.getClient()
 	if err != nil {
-		return msgs, fmt.Errorf("failed to get aztable client: %w", err)
+		return nil, fmt.Errorf("failed to get aztable client: %w", err)
 	}
 	userFilter := fmt.Sprintf("RowKey eq '%s'", username)
+	// older entities do not have the status property, the active ones are checked one by one
+	if opts.Status != "" && opts.Status != storage.ListStatusActive {
+		userFilter += fmt.Sprintf(" and Status eq '%s'", opts.Status)
+	}
+	if len(opts.BatchIDs) > 0 {
+		var batchFilters []string
+		for _, batchID := range opts.BatchIDs {
+			batchFilters = append(batchFilters, fmt.Sprintf("BatchID eq '%s'", batchID))
+		}
+		userFilter += " and (" + strings.Join(batchFilters, " or ") + ")"
+	}
+	if opts.SortBy == storage.SortByID {
+		return s.listMessagesPage(ctx, client, userFilter, opts)
+	}
+	var msgs []*storage.Message
 	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
 		Filter: &userFilter,
 	})
+	for listPager.More() {
+		response, err := listPager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var msg *storage.Message
+			err = json.Unmarshal(v, &msg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal message in list of results: %w", err)
+			}
+			if msg.IsExpired() || !opts.Matches(msg) {
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	return storage.PageMessages(msgs, opts)
+}
+
+// listMessagesPage asks the table only for the number of entities still missing
+// on the page, so the continuation token points right after the last message shown
+func (s *azMessageStore) listMessagesPage(ctx context.Context, client *aztables.Client, filter string, opts storage.ListOptions) (*storage.MessagePage, error) {
+	var nextPartitionKey, nextRowKey *string
+	if opts.Cursor != "" {
+		parts, err := storage.DecodeCursor(opts.Cursor, opts.SortBy, 3)
+		if err != nil {
+			return nil, err
+		}
+		nextPartitionKey, nextRowKey = &parts[1], &parts[2]
+	}
+	page := &storage.MessagePage{}
+	for {
+		top := int32(opts.PageSize() - len(page.Messages))
+		response, err := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+			Filter:           &filter,
+			Top:              &top,
+			NextPartitionKey: nextPartitionKey,
+			NextRowKey:       nextRowKey,
+		}).NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var msg *storage.Message
+			err = json.Unmarshal(v, &msg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal message in list of results: %w", err)
+			}
+			if msg.IsExpired() || !opts.Matches(msg) {
+				continue
+			}
+			page.Messages = append(page.Messages, msg)
+		}
+		nextPartitionKey, nextRowKey = response.NextPartitionKey, response.NextRowKey
+		if nextPartitionKey == nil && nextRowKey == nil {
+			return page, nil
+		}
+		if len(page.Messages) >= opts.PageSize() {
+			page.NextCursor = storage.EncodeCursor(opts.SortBy, valueOf(nextPartitionKey), valueOf(nextRowKey))
+			return page, nil
+		}
+	}
+}
+
+func valueOf(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// aztables cannot look into the list of recipients in the query
+// only the restricted messages are fetched and checked one by one
+func (s *azMessageStore) ListInbox(ctx context.Context, username string) ([]*storage.Message, error) {
+	var msgs []*storage.Message
+	client, err := s.getClient()
+	if err != nil {
+		return msgs, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	restrictedFilter := "Recipients ne ''"
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &restrictedFilter,
+	})
 	for listPager.More() {
 		response, err := listPager.NextPage(ctx)
 		if err != nil {
@@ -69,37 +193,69 @@ func (s *azMessageStore) ListMessages(ctx context.Context, username string) ([]*
 			if err != nil {
 				return msgs, fmt.Errorf("failed to unmarshal message in list of results: %w", err)
 			}
-			msgs = append(msgs, msg)
+			if msg.HasRecipient(username) && !msg.IsTombstone() && !msg.IsExpired() {
+				msgs = append(msgs, msg)
+			}
 		}
 	}
 	return msgs, nil
 }
 
-// TODO: allow to reset the pin for the owner
-func (s *azMessageStore) AddMessage(ctx context.Context, text string, username string) (*storage.Message, error) {
-	// an easy to enter pin
-	pin, err := crypto.MakePin()
+func (s *azMessageStore) AddMessage(ctx context.Context, text string, username string, opts storage.MessageOptions) (*storage.Message, error) {
+	pin, generated, err := storage.ChoosePin(opts, s.pinPolicy)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate pin: %w", err)
+		return nil, fmt.Errorf("failed to choose pin: %w", err)
 	}
 	ciphertext, err := s.Encrypt(text, pin, s.salt)
 	if err != nil {
 		return nil, fmt.Errorf("failed to encrypt text: %w", err)
 	}
-	msg, err := storage.NewMessage(username, ciphertext, pin)
+	msg, err := storage.NewMessage(username, ciphertext, pin, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a new message: %w", err)
+	}
+	err = msg.SealAttachments(s, s.salt, pin, opts.Attachments)
+	if err != nil {
+		return nil, err
+	}
+	err = msg.SealFormat(s, s.salt, pin, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	msg.Measure()
+	err = storage.InsertWithID(ctx, &msg, s.idPolicy, func(m *storage.Message) error {
+		return s.insertMessage(ctx, m)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save message: %w", err)
+	}
+	s.Notify(ctx, storage.EventCreated, &msg)
+	// temporarily show the generated pin to the creator
+	msg.Pin = ""
+	if generated {
+		msg.Pin = pin
+	}
+	return &msg, nil
+}
+
+func (s *azMessageStore) AddEncryptedMessage(ctx context.Context, ciphertext string, verifier string, username string, opts storage.MessageOptions) (*storage.Message, error) {
+	msg, err := storage.NewClientEncryptedMessage(username, ciphertext, verifier, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create a new message: %w", err)
 	}
-	err = s.saveMessage(ctx, &msg)
+	err = storage.InsertWithID(ctx, &msg, s.idPolicy, func(m *storage.Message) error {
+		return s.insertMessage(ctx, m)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to save message: %w", err)
 	}
-	msg.Pin = pin
+	s.Notify(ctx, storage.EventCreated, &msg)
+	msg.Pin = ""
 	return &msg, nil
 }
 
 func (s *azMessageStore) GetMessage(ctx context.Context, id string) (*storage.Message, error) {
-	msg, err := s.getMessage(ctx, id)
+	msg, err := s.getLiveMessage(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -108,54 +264,341 @@ func (s *azMessageStore) GetMessage(ctx context.Context, id string) (*storage.Me
 	}
 	// clear the pin to let the view know it needs decryption
 	msg.Pin = ""
+	msg.HideOwnerDetails()
 	return msg, nil
 }
 
-func (s *azMessageStore) GetFullMessage(ctx context.Context, id string, pin string) (*storage.Message, error) {
-	msg, err := s.getMessage(ctx, id)
+func (s *azMessageStore) GetFullMessage(ctx context.Context, id string, pin string, username string) (*storage.Message, error) {
+	// parallel reads and attempts are saved over each other, the loser reads the message again
+	for range MAX_UPDATE_ATTEMPTS {
+		msg, err := s.getFullMessage(ctx, id, pin, username)
+		if !errors.Is(err, errChanged) {
+			return msg, err
+		}
+	}
+	return nil, storage.ErrMessageChanged
+}
+
+func (s *azMessageStore) getFullMessage(ctx context.Context, id string, pin string, username string) (*storage.Message, error) {
+	msg, etag, err := s.getLiveVersion(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 	if msg == nil {
 		return nil, nil
 	}
+	if !msg.CanBeReadBy(username) {
+		return nil, storage.ErrNotRecipient
+	}
+	// the pin is not checked, so the attempts are not used up while locked
+	if msg.IsLocked() {
+		return nil, storage.ErrMessageLocked
+	}
 
 	if err := crypto.CompareHashToPass(msg.Pin, pin); err == nil {
-		text, err := s.Decrypt(msg.Content, pin, s.salt)
+		text, err := msg.OpenContent(s, s.salt, pin)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decrypt message content: %w", err)
 		}
-		msg.Content = text
-		err = s.deleteMessage(ctx, msg)
+		// the view is taken before the content is given out,
+		// the message becomes a tombstone after the last successful retrieval
+		original := *msg
+		stored := msg.RecordRead(ctx)
+		readEtag, err := s.replaceMessage(ctx, &stored, &etag)
+		if errors.Is(err, errChanged) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update remaining views: %w", err)
+		}
+		if err := storage.BeforeRead(ctx, msg, text); err != nil {
+			// give the view back unless the message was saved again
+			if _, rerr := s.replaceMessage(ctx, &original, &readEtag); rerr != nil {
+				slog.LogAttrs(ctx, slog.LevelError, "failed to restore the view of message", slog.String("id", msg.PartitionKey), slog.String("username", msg.RowKey), slog.Any("error", rerr))
+			}
+			return nil, err
+		}
+		s.Notify(ctx, storage.EventRead, &stored)
+		err = msg.OpenAttachments(s, s.salt, pin)
 		if err != nil {
-			slog.LogAttrs(ctx, slog.LevelError, "failed to delete message", slog.String("id", msg.PartitionKey), slog.String("username", msg.RowKey), slog.Any("error", err))
+			return nil, err
 		}
+		err = msg.OpenFormat(s, s.salt, pin)
+		if err != nil {
+			return nil, err
+		}
+		msg.Content = text
+		msg.HideOwnerDetails()
 		return msg, nil
 	}
 
-	msg.AttemptsRemaining -= 1
 	// If the pin was wrong then track attempts
-	if msg.AttemptsRemaining <= 0 {
-		err = s.deleteMessage(ctx, msg)
+	if err := s.recordFailedAttempt(ctx, msg, etag); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// recordFailedAttempt uses up an attempt for the wrong pin,
+// the message is destroyed after the last one.
+// It returns errChanged if the message was saved since the etag was read.
+func (s *azMessageStore) recordFailedAttempt(ctx context.Context, msg *storage.Message, etag azcore.ETag) error {
+	stored := msg.RecordFailedAttempt(ctx)
+	_, err := s.replaceMessage(ctx, &stored, &etag)
+	if errors.Is(err, errChanged) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update remaining attempts: %w", err)
+	}
+	s.Notify(ctx, storage.EventFailed, &stored)
+	return nil
+}
+
+func (s *azMessageStore) SetMessageLabels(ctx context.Context, id string, username string, title string, labels []string) (*storage.Message, error) {
+	msg, err := s.getLiveMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || msg.RowKey != username {
+		return nil, storage.ErrMessageNotFound
+	}
+	if err := msg.SetLabels(title, labels); err != nil {
+		return nil, err
+	}
+	err = s.saveMessage(ctx, msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save message: %w", err)
+	}
+	msg.Pin = ""
+	return msg, nil
+}
+
+// The row key is the username of the owner, the entity
+// will not be found if it belongs to someone else
+func (s *azMessageStore) DeleteMessage(ctx context.Context, id string, username string) error {
+	if !s.idPolicy.Accepts(id) {
+		return storage.ErrMessageNotFound
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.DeleteEntity(ctx, id, username, nil)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return storage.ErrMessageNotFound
+		}
+		return fmt.Errorf("failed to delete message entity: %w", err)
+	}
+	existing, err := listChunkKeys(ctx, client, id, username)
+	if err != nil {
+		return err
+	}
+	return deleteChunks(ctx, client, id, existing, nil)
+}
+
+func (s *azMessageStore) ResetMessagePin(ctx context.Context, id string, username string, oldPin string, content string) (*storage.Message, error) {
+	msg, etag, err := s.getLiveVersion(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || msg.RowKey != username {
+		return nil, storage.ErrMessageNotFound
+	}
+	pin, err := msg.Rekey(s, s.salt, oldPin, content, s.pinPolicy)
+	if errors.Is(err, storage.ErrInvalidPin) {
+		if changed := s.recordFailedAttempt(ctx, msg, etag); errors.Is(changed, errChanged) {
+			return nil, storage.ErrMessageChanged
+		} else if changed != nil {
+			return nil, changed
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the message read or destroyed in the meantime is not brought back
+	_, err = s.replaceMessage(ctx, msg, &etag)
+	if errors.Is(err, errChanged) {
+		return nil, storage.ErrMessageChanged
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save message: %w", err)
+	}
+	// temporarily show the new pin to the owner
+	msg.Pin = pin
+	return msg, nil
+}
+
+func (s *azMessageStore) UpdateMessage(ctx context.Context, id string, username string, content string, format storage.ContentFormat, pin string, room int64) (*storage.Message, error) {
+	msg, etag, err := s.getLiveVersion(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || msg.RowKey != username {
+		return nil, storage.ErrMessageNotFound
+	}
+	// older messages were not measured when they were stored
+	msg.Measure()
+	before := msg.Size
+	newPin, err := msg.Edit(s, s.salt, content, format, pin, s.pinPolicy)
+	if errors.Is(err, storage.ErrInvalidPin) {
+		if changed := s.recordFailedAttempt(ctx, msg, etag); errors.Is(changed, errChanged) {
+			return nil, storage.ErrMessageChanged
+		} else if changed != nil {
+			return nil, changed
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.CheckGrowth(before, msg.Size, room); err != nil {
+		return nil, err
+	}
+	// the message read or destroyed in the meantime is not brought back
+	_, err = s.replaceMessage(ctx, msg, &etag)
+	if errors.Is(err, errChanged) {
+		return nil, storage.ErrMessageChanged
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save message: %w", err)
+	}
+	// temporarily show the new pin to the owner
+	msg.Pin = newPin
+	return msg, nil
+}
+
+// GetUsage reads only the properties the usage is measured by,
+// the size is kept with the message as its content may be chunked
+func (s *azMessageStore) GetUsage(ctx context.Context, username string) (*storage.Usage, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	usage := &storage.Usage{}
+	userFilter := fmt.Sprintf("RowKey eq '%s'", username)
+	keySelector := "PartitionKey,RowKey,Timestamp,Status,ExpiresAt,Size"
+	metadataFormat := aztables.MetadataFormatNone
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &userFilter,
+		Select: &keySelector,
+		Format: &metadataFormat,
+	})
+	for listPager.More() {
+		response, err := listPager.NextPage(ctx)
 		if err != nil {
-			slog.LogAttrs(ctx, slog.LevelError, "failed to delete message", slog.String("id", msg.PartitionKey), slog.String("username", msg.RowKey), slog.Any("error", err))
+			return nil, fmt.Errorf("failed to get page of results: %w", err)
 		}
-	} else {
+		for _, v := range response.Entities {
+			var msg *storage.Message
+			err = json.Unmarshal(v, &msg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal message in list of results: %w", err)
+			}
+			usage.Count(msg)
+		}
+	}
+	return usage, nil
+}
+
+// Hides the tombstones and turns the expired message into one,
+// the sweeper might not have picked it up yet
+func (s *azMessageStore) getLiveMessage(ctx context.Context, id string) (*storage.Message, error) {
+	msg, _, err := s.getLiveVersion(ctx, id)
+	return msg, err
+}
+
+// getLiveVersion is getLiveMessage that also returns the ETag of the message,
+// saving with it fails if the message was saved in the meantime
+func (s *azMessageStore) getLiveVersion(ctx context.Context, id string) (*storage.Message, azcore.ETag, error) {
+	msg, etag, err := s.getVersionedMessage(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if msg == nil || msg.IsTombstone() {
+		return nil, "", nil
+	}
+	if msg.IsExpired() {
+		msg.Expire(ctx)
 		err = s.saveMessage(ctx, msg)
 		if err != nil {
-			slog.LogAttrs(ctx, slog.LevelError, "failed to update message", slog.String("id", msg.PartitionKey), slog.String("username", msg.RowKey), slog.Any("error", err))
+			slog.LogAttrs(ctx, slog.LevelError, "failed to expire message", slog.String("id", msg.PartitionKey), slog.String("username", msg.RowKey), slog.Any("error", err))
+		} else {
+			s.Notify(ctx, storage.EventDestroyed, msg)
 		}
+		return nil, "", nil
 	}
+	return msg, etag, nil
+}
 
-	return nil, nil
+// The expiry is stored as a fixed width UTC string
+// therefore it is possible to compare it as text in the query
+func (s *azMessageStore) DeleteExpiredMessages(ctx context.Context) (int64, error) {
+	var count int64 = 0
+	client, err := s.getClient()
+	if err != nil {
+		return count, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	now, err := aztables.EDMDateTime(time.Now().UTC().Truncate(time.Second)).MarshalText()
+	if err != nil {
+		return count, fmt.Errorf("failed to format current time: %w", err)
+	}
+	expiredFilter := fmt.Sprintf("ExpiresAt le '%s'", now)
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &expiredFilter,
+	})
+	for listPager.More() {
+		response, err := listPager.NextPage(ctx)
+		if err != nil {
+			return count, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var msg *storage.Message
+			err = json.Unmarshal(v, &msg)
+			if err != nil {
+				return count, fmt.Errorf("failed to unmarshal expired message: %w", err)
+			}
+			if msg.IsTombstone() {
+				err = s.deleteMessage(ctx, msg)
+			} else {
+				msg.Expire(ctx)
+				err = s.saveMessage(ctx, msg)
+				if err == nil {
+					s.Notify(ctx, storage.EventDestroyed, msg)
+				}
+			}
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
 }
 
+// getMessage reads the message together with its chunks, they share the partition
 func (s *azMessageStore) getMessage(ctx context.Context, id string) (*storage.Message, error) {
+	msg, _, err := s.getVersionedMessage(ctx, id)
+	return msg, err
+}
+
+// getVersionedMessage is getMessage that also returns the ETag
+// the listed message entity comes with
+func (s *azMessageStore) getVersionedMessage(ctx context.Context, id string) (*storage.Message, azcore.ETag, error) {
+	// the id from the link goes into the filter
+	if !s.idPolicy.Accepts(id) {
+		return nil, "", nil
+	}
 	client, err := s.getClient()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get aztable client: %w", err)
+		return nil, "", fmt.Errorf("failed to get aztable client: %w", err)
 	}
-	var msgs []*storage.Message
+	var entities [][]byte
+	var etags []azcore.ETag
+	chunks := map[string]entityProperties{}
 	idFilter := fmt.Sprintf("PartitionKey eq '%s'", id)
 	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
 		Filter: &idFilter,
@@ -163,44 +606,145 @@ func (s *azMessageStore) getMessage(ctx context.Context, id string) (*storage.Me
 	for listPager.More() {
 		response, err := listPager.NextPage(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get page of results: %w", err)
+			return nil, "", fmt.Errorf("failed to get page of results: %w", err)
 		}
 		for _, v := range response.Entities {
-			var msg *storage.Message
-			err = json.Unmarshal(v, &msg)
+			var props entityProperties
+			err = json.Unmarshal(v, &props)
 			if err != nil {
-				return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+				return nil, "", fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			var rowKey string
+			json.Unmarshal(props["RowKey"], &rowKey)
+			if isChunkKey(rowKey) {
+				chunks[rowKey] = props
+			} else {
+				entities = append(entities, v)
+				var etag string
+				json.Unmarshal(props["odata.etag"], &etag)
+				etags = append(etags, azcore.ETag(etag))
 			}
-			msgs = append(msgs, msg)
 		}
 	}
+	var msgs []*storage.Message
+	for _, v := range entities {
+		msg, err := joinMessage(v, chunks)
+		if err != nil {
+			return nil, "", err
+		}
+		msgs = append(msgs, msg)
+	}
 	if len(msgs) > 1 {
 		slog.LogAttrs(ctx, slog.LevelError, "more than one message with the same id", slog.String("id", id), slog.Int("total", len(msgs)))
-		return msgs[0], nil
+		return msgs[0], etags[0], nil
 	} else if len(msgs) == 1 {
-		return msgs[0], nil
+		return msgs[0], etags[0], nil
 	}
-	return nil, nil
+	return nil, "", nil
 }
 
-func (s *azMessageStore) saveMessage(ctx context.Context, msg *storage.Message) error {
-	marshalled, err := json.Marshal(msg)
+// insertMessage fails with ErrIDCollision when the id is taken. The table
+// only rejects the same partition and row key, so the message of another
+// owner with the same id is looked up first.
+func (s *azMessageStore) insertMessage(ctx context.Context, msg *storage.Message) error {
+	existing, err := s.getMessage(ctx, msg.PartitionKey)
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
+		return err
+	}
+	if existing != nil {
+		return storage.ErrIDCollision
+	}
+	marshalled, chunks, err := splitMessage(msg)
+	if err != nil {
+		return err
 	}
 	client, err := s.getClient()
 	if err != nil {
 		return fmt.Errorf("failed to get aztable client: %w", err)
 	}
-	_, err = client.UpsertEntity(ctx, marshalled, &aztables.UpsertEntityOptions{
-		UpdateMode: aztables.UpdateModeReplace,
-	})
+	// the chunks are written first, the message is not visible without them
+	if err := writeChunks(ctx, client, chunks, nil); err != nil {
+		return err
+	}
+	_, err = client.AddEntity(ctx, marshalled, nil)
 	if err != nil {
-		return fmt.Errorf("failed to upsert message entity: %w", err)
+		written := map[string]bool{}
+		for key := range chunks {
+			written[key] = true
+		}
+		if err := deleteChunks(ctx, client, msg.PartitionKey, written, nil); err != nil {
+			slog.LogAttrs(ctx, slog.LevelError, "failed to delete chunks of the message not added", slog.String("id", msg.PartitionKey), slog.Any("error", err))
+		}
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusConflict {
+			return storage.ErrIDCollision
+		}
+		return fmt.Errorf("failed to add message entity: %w", err)
 	}
 	return nil
 }
 
+// saveMessage writes the new chunks before the message and removes
+// the chunks of the previous values once the message points past them
+func (s *azMessageStore) saveMessage(ctx context.Context, msg *storage.Message) error {
+	_, err := s.replaceMessage(ctx, msg, nil)
+	return err
+}
+
+// replaceMessage writes the message along with its chunks, with the etag
+// it fails with errChanged if somebody has saved the message since it was read.
+// It returns the new ETag of the message.
+func (s *azMessageStore) replaceMessage(ctx context.Context, msg *storage.Message, etag *azcore.ETag) (azcore.ETag, error) {
+	marshalled, chunks, err := splitMessage(msg)
+	if err != nil {
+		return "", err
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	existing, err := listChunkKeys(ctx, client, msg.PartitionKey, msg.RowKey)
+	if err != nil {
+		return "", err
+	}
+	if err := writeChunks(ctx, client, chunks, existing); err != nil {
+		return "", err
+	}
+	var saved azcore.ETag
+	if etag != nil {
+		var resp aztables.UpdateEntityResponse
+		resp, err = client.UpdateEntity(ctx, marshalled, &aztables.UpdateEntityOptions{
+			IfMatch:    etag,
+			UpdateMode: aztables.UpdateModeReplace,
+		})
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusPreconditionFailed {
+			// the chunks written for this version are not pointed to
+			written := map[string]bool{}
+			for key := range chunks {
+				if !existing[key] {
+					written[key] = true
+				}
+			}
+			if err := deleteChunks(ctx, client, msg.PartitionKey, written, nil); err != nil {
+				slog.LogAttrs(ctx, slog.LevelError, "failed to delete unused message chunks", slog.String("id", msg.PartitionKey), slog.Any("error", err))
+			}
+			return "", errChanged
+		}
+		saved = resp.ETag
+	} else {
+		var resp aztables.UpsertEntityResponse
+		resp, err = client.UpsertEntity(ctx, marshalled, &aztables.UpsertEntityOptions{
+			UpdateMode: aztables.UpdateModeReplace,
+		})
+		saved = resp.ETag
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to save message entity: %w", err)
+	}
+	return saved, deleteChunks(ctx, client, msg.PartitionKey, existing, chunks)
+}
+
 func (s *azMessageStore) deleteMessage(ctx context.Context, msg *storage.Message) error {
 	client, err := s.getClient()
 	if err != nil {
@@ -210,5 +754,9 @@ func (s *azMessageStore) deleteMessage(ctx context.Context, msg *storage.Message
 	if err != nil {
 		return fmt.Errorf("failed to delete message entity: %w", err)
 	}
-	return nil
+	existing, err := listChunkKeys(ctx, client, msg.PartitionKey, msg.RowKey)
+	if err != nil {
+		return err
+	}
+	return deleteChunks(ctx, client, msg.PartitionKey, existing, nil)
 }
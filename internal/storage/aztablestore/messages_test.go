@@ -0,0 +1,145 @@
+package aztablestore_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+	"github.com/ivarprudnikov/secretshare/internal/storage/aztablestore"
+)
+
+// The tests need a table emulator, e.g. Azurite started with `azurite-table`
+// and AZTABLE_CONNECTION_STRING set to its connection string with the TableEndpoint
+func newEmulatorStore(t *testing.T) (storage.MessageStore, *aztables.Client) {
+	connectionString := os.Getenv(aztablestore.CONNECTION_STRING_ENV)
+	if connectionString == "" {
+		t.Skipf("%s is not set, skipping the table emulator tests", aztablestore.CONNECTION_STRING_ENV)
+	}
+	service, err := aztables.NewServiceClientFromConnectionString(connectionString, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	table := fmt.Sprintf("messages%d", time.Now().UnixNano())
+	_, err = service.CreateTable(context.Background(), table, nil)
+	var respErr *azcore.ResponseError
+	if err != nil && !(errors.As(err, &respErr) && respErr.ErrorCode == string(aztables.TableAlreadyExists)) {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() {
+		service.DeleteTable(context.Background(), table, nil)
+	})
+	store := aztablestore.NewAzMessageStore("devstoreaccount1", table, "12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+	return store, service.NewClient(table)
+}
+
+// countChunks lists the partition of the message for the rows of its chunks
+func countChunks(t *testing.T, client *aztables.Client, id string) int {
+	filter := fmt.Sprintf("PartitionKey eq '%s'", id)
+	pager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{Filter: &filter})
+	count := 0
+	for pager.More() {
+		response, err := pager.NextPage(context.Background())
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		for _, v := range response.Entities {
+			var entity aztables.Entity
+			if err := json.Unmarshal(v, &entity); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if strings.Contains(entity.RowKey, "~chunk~") {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestMessageStore_LargeContent(t *testing.T) {
+	store, client := newEmulatorStore(t)
+	text := strings.Repeat("0123456789abcdef", 200<<10)
+	file := storage.Attachment{Name: "large.bin", Type: "application/octet-stream", Data: []byte(strings.Repeat("x", 2<<20))}
+	msg, err := store.AddMessage(context.Background(), text, "testuser", storage.MessageOptions{
+		ExpiresIn:   time.Hour,
+		MaxViews:    2,
+		Attachments: []storage.Attachment{file},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	count, err := store.CountMessages(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("Expected the chunks not to be counted, got %d", count)
+	}
+	if countChunks(t, client, msg.PartitionKey) == 0 {
+		t.Fatalf("Expected the content to be chunked")
+	}
+	usage, err := store.GetUsage(context.Background(), "testuser")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if usage.ActiveMessages != 1 || usage.StoredBytes < int64(len(text)) {
+		t.Fatalf("Expected the chunked content to be measured, got %v", usage)
+	}
+
+	// The pin reset rewrites the chunks
+	reset, err := store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", msg.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	fullMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, reset.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if fullMsg == nil || fullMsg.Content != text {
+		t.Fatalf("Expected the content to be reassembled")
+	}
+	if len(fullMsg.Files) != 1 || string(fullMsg.Files[0].Data) != string(file.Data) {
+		t.Fatalf("Expected the attachment to be reassembled")
+	}
+
+	// The tombstone drops the chunks
+	fullMsg, err = store.GetFullMessage(context.Background(), msg.PartitionKey, reset.Pin, "")
+	if err != nil || fullMsg == nil {
+		t.Fatalf("Expected the second view, got %v", err)
+	}
+	if chunks := countChunks(t, client, msg.PartitionKey); chunks != 0 {
+		t.Fatalf("Expected no chunks to be left, got %d", chunks)
+	}
+	if err := store.DeleteMessage(context.Background(), msg.PartitionKey, "testuser"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if found, _ := store.GetMessage(context.Background(), msg.PartitionKey); found != nil {
+		t.Fatalf("Expected the message to be deleted")
+	}
+}
+
+func TestMessageStore_SmallContentIsNotChunked(t *testing.T) {
+	store, client := newEmulatorStore(t)
+	msg, err := store.AddMessage(context.Background(), "small", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if chunks := countChunks(t, client, msg.PartitionKey); chunks != 0 {
+		t.Fatalf("Expected no chunks, got %d", chunks)
+	}
+	fullMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if fullMsg == nil || fullMsg.Content != "small" {
+		t.Fatalf("Expected the content, got %v", fullMsg)
+	}
+}
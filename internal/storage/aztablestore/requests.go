@@ -0,0 +1,296 @@
+package aztablestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+type azRequestStore struct {
+	crypto.EntityEncryptHelper
+	accountName string
+	tableName   string
+	salt        string
+	pinPolicy   crypto.PinPolicy
+	idPolicy    crypto.IDPolicy
+}
+
+func NewAzRequestStore(accountName, tableName, salt string, pinPolicy crypto.PinPolicy, idPolicy crypto.IDPolicy) storage.RequestStore {
+	return &azRequestStore{accountName: accountName, tableName: tableName, salt: salt, pinPolicy: pinPolicy, idPolicy: idPolicy}
+}
+
+func (s *azRequestStore) getClient() (*aztables.Client, error) {
+	return getTableClient(s.accountName, s.tableName)
+}
+
+func (s *azRequestStore) AddRequest(ctx context.Context, username string, description string, expiresIn time.Duration) (*storage.SecretRequest, error) {
+	pin, err := crypto.MakePin(s.pinPolicy)
+	if err != nil {
+		return nil, err
+	}
+	id, err := crypto.MakeID(s.idPolicy)
+	if err != nil {
+		return nil, err
+	}
+	req, err := storage.NewSecretRequest(id, username, description, expiresIn, pin, s, s.salt)
+	if err != nil {
+		return nil, err
+	}
+	marshalled, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.AddEntity(ctx, marshalled, nil)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusConflict {
+			return nil, storage.ErrIDCollision
+		}
+		return nil, fmt.Errorf("failed to save request: %w", err)
+	}
+	// temporarily show the pin to the owner
+	req.Pin = pin
+	return &req, nil
+}
+
+func (s *azRequestStore) GetRequest(ctx context.Context, id string) (*storage.SecretRequest, error) {
+	req, err := s.findRequest(ctx, id)
+	if err != nil || req == nil {
+		return nil, err
+	}
+	if req.IsExpired() || req.IsAnswered() {
+		return nil, nil
+	}
+	return req, nil
+}
+
+func (s *azRequestStore) ListRequests(ctx context.Context, username string) ([]*storage.SecretRequest, error) {
+	var reqs []*storage.SecretRequest
+	client, err := s.getClient()
+	if err != nil {
+		return reqs, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	userFilter := fmt.Sprintf("RowKey eq '%s'", username)
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &userFilter,
+	})
+	for listPager.More() {
+		response, err := listPager.NextPage(ctx)
+		if err != nil {
+			return reqs, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var req *storage.SecretRequest
+			err = json.Unmarshal(v, &req)
+			if err != nil {
+				return reqs, fmt.Errorf("failed to unmarshal request in list of results: %w", err)
+			}
+			if !req.IsExpired() {
+				reqs = append(reqs, req)
+			}
+		}
+	}
+	return reqs, nil
+}
+
+// The owner is not known to the visitor, the request is found by the id
+// first and then updated on the condition nobody has answered it in between
+func (s *azRequestStore) SubmitSecret(ctx context.Context, id string, text string) error {
+	found, err := s.findRequest(ctx, id)
+	if err != nil {
+		return err
+	}
+	if found == nil || found.IsExpired() {
+		return storage.ErrRequestNotFound
+	}
+	req, etag, err := s.getRequest(ctx, id, found.RowKey)
+	if err != nil {
+		return err
+	}
+	if err := req.Answer(text); err != nil {
+		return err
+	}
+	err = s.updateRequest(ctx, req, etag)
+	if errors.Is(err, errChanged) {
+		return storage.ErrRequestAnswered
+	}
+	return err
+}
+
+func (s *azRequestStore) OpenSecret(ctx context.Context, id string, username string, pin string) (*storage.SecretRequest, error) {
+	req, etag, err := s.getRequest(ctx, id, username)
+	if err != nil {
+		return nil, err
+	}
+	if req.IsExpired() {
+		return nil, storage.ErrRequestNotFound
+	}
+	text, err := req.Open(s, s.salt, pin)
+	if errors.Is(err, storage.ErrInvalidPin) {
+		req.AttemptsRemaining -= 1
+		var saveErr error
+		if req.AttemptsRemaining <= 0 {
+			saveErr = s.DeleteRequest(ctx, id, username)
+		} else {
+			saveErr = s.updateRequest(ctx, req, etag)
+		}
+		if saveErr != nil {
+			return nil, saveErr
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the secret is read once
+	if err := s.DeleteRequest(ctx, id, username); err != nil {
+		return nil, err
+	}
+	req.Content = text
+	return req, nil
+}
+
+func (s *azRequestStore) DeleteRequest(ctx context.Context, id string, username string) error {
+	client, err := s.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.DeleteEntity(ctx, id, username, nil)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return storage.ErrRequestNotFound
+		}
+		return fmt.Errorf("failed to delete request entity: %w", err)
+	}
+	return nil
+}
+
+// The expiry is stored as a fixed width UTC string
+// therefore it is possible to compare it as text in the query
+func (s *azRequestStore) DeleteExpiredRequests(ctx context.Context) (int64, error) {
+	var count int64 = 0
+	client, err := s.getClient()
+	if err != nil {
+		return count, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	now, err := aztables.EDMDateTime(time.Now().UTC().Truncate(time.Second)).MarshalText()
+	if err != nil {
+		return count, fmt.Errorf("failed to format current time: %w", err)
+	}
+	expiredFilter := fmt.Sprintf("ExpiresAt le '%s'", now)
+	keySelector := "PartitionKey,RowKey"
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &expiredFilter,
+		Select: &keySelector,
+	})
+	for listPager.More() {
+		response, err := listPager.NextPage(ctx)
+		if err != nil {
+			return count, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var req *storage.SecretRequest
+			err = json.Unmarshal(v, &req)
+			if err != nil {
+				return count, fmt.Errorf("failed to unmarshal expired request: %w", err)
+			}
+			err = s.DeleteRequest(ctx, req.PartitionKey, req.RowKey)
+			if err != nil && !errors.Is(err, storage.ErrRequestNotFound) {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// findRequest looks the request up by the id only
+func (s *azRequestStore) findRequest(ctx context.Context, id string) (*storage.SecretRequest, error) {
+	// the id from the link goes into the filter
+	if !s.idPolicy.Accepts(id) {
+		return nil, nil
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	idFilter := fmt.Sprintf("PartitionKey eq '%s'", id)
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &idFilter,
+	})
+	for listPager.More() {
+		response, err := listPager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var req *storage.SecretRequest
+			err = json.Unmarshal(v, &req)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal request: %w", err)
+			}
+			return req, nil
+		}
+	}
+	return nil, nil
+}
+
+// getRequest reads the request of the owner along with its version
+func (s *azRequestStore) getRequest(ctx context.Context, id string, username string) (*storage.SecretRequest, azcore.ETag, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	resp, err := client.GetEntity(ctx, id, username, nil)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return nil, "", storage.ErrRequestNotFound
+		}
+		return nil, "", fmt.Errorf("failed to get request entity: %w", err)
+	}
+	var req *storage.SecretRequest
+	if err = json.Unmarshal(resp.Value, &req); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal request: %w", err)
+	}
+	return req, resp.ETag, nil
+}
+
+var errChanged = errors.New("entity was changed in the meantime")
+
+// updateRequest replaces the request if nobody has changed it since it was read
+func (s *azRequestStore) updateRequest(ctx context.Context, req *storage.SecretRequest, etag azcore.ETag) error {
+	marshalled, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.UpdateEntity(ctx, marshalled, &aztables.UpdateEntityOptions{
+		IfMatch:    &etag,
+		UpdateMode: aztables.UpdateModeReplace,
+	})
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusPreconditionFailed {
+			return errChanged
+		}
+		return fmt.Errorf("failed to update request entity: %w", err)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
@@ -124,3 +125,96 @@ func (u *azUserStore) GetUserWithPass(ctx context.Context, username string, pass
 	}
 	return nil, nil
 }
+
+// Merge keeps the other properties of the user as they are
+func (u *azUserStore) SetUserEmail(ctx context.Context, username string, email string) error {
+	marshalled, err := json.Marshal(map[string]string{
+		"PartitionKey": username,
+		"RowKey":       username,
+		"Email":        email,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal user email: %w", err)
+	}
+	client, err := u.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.UpdateEntity(ctx, marshalled, &aztables.UpdateEntityOptions{
+		UpdateMode: aztables.UpdateModeMerge,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update user email: %w", err)
+	}
+	return nil
+}
+
+func (u *azUserStore) SetUserQuota(ctx context.Context, username string, quota *storage.Quota) error {
+	encoded, err := storage.EncodeQuota(quota)
+	if err != nil {
+		return err
+	}
+	marshalled, err := json.Marshal(map[string]string{
+		"PartitionKey": username,
+		"RowKey":       username,
+		"Quota":        encoded,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal user quota: %w", err)
+	}
+	client, err := u.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.UpdateEntity(ctx, marshalled, &aztables.UpdateEntityOptions{
+		UpdateMode: aztables.UpdateModeMerge,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update user quota: %w", err)
+	}
+	return nil
+}
+
+// AddCreatedMessages saves the count again if another request
+// has changed the user since it was read
+func (u *azUserStore) AddCreatedMessages(ctx context.Context, username string, messages int) error {
+	client, err := u.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	for range MAX_UPDATE_ATTEMPTS {
+		resp, err := client.GetEntity(ctx, username, username, nil)
+		if err != nil {
+			return fmt.Errorf("failed to get user entity: %w", err)
+		}
+		var user *storage.User
+		if err := json.Unmarshal(resp.Value, &user); err != nil {
+			return fmt.Errorf("failed to unmarshal user: %w", err)
+		}
+		created, err := user.CountCreated(time.Now(), messages)
+		if err != nil {
+			return err
+		}
+		marshalled, err := json.Marshal(map[string]string{
+			"PartitionKey": username,
+			"RowKey":       username,
+			"Created":      created,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal created messages: %w", err)
+		}
+		_, err = client.UpdateEntity(ctx, marshalled, &aztables.UpdateEntityOptions{
+			IfMatch:    &resp.ETag,
+			UpdateMode: aztables.UpdateModeMerge,
+		})
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusPreconditionFailed {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update created messages: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to count the created messages in %d attempts: %w", MAX_UPDATE_ATTEMPTS, errChanged)
+}
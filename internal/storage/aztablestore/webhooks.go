@@ -0,0 +1,162 @@
+package aztablestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+type azWebhookStore struct {
+	crypto.EntityEncryptHelper
+	accountName string
+	tableName   string
+	salt        string
+}
+
+func NewAzWebhookStore(accountName, tableName, salt string) storage.WebhookStore {
+	return &azWebhookStore{accountName: accountName, tableName: tableName, salt: salt}
+}
+
+func (s *azWebhookStore) getClient() (*aztables.Client, error) {
+	return getTableClient(s.accountName, s.tableName)
+}
+
+// prefixFilter matches the row keys starting with the prefix in the partition of the user
+func prefixFilter(username string, prefix string) string {
+	upper := prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+	return fmt.Sprintf("PartitionKey eq '%s' and RowKey ge '%s' and RowKey lt '%s'", username, prefix, upper)
+}
+
+func (s *azWebhookStore) ListWebhooks(ctx context.Context, username string) ([]*storage.Webhook, error) {
+	var hooks []*storage.Webhook
+	client, err := s.getClient()
+	if err != nil {
+		return hooks, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	filter := prefixFilter(username, storage.WebhookKeyPrefix)
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &filter,
+	})
+	for listPager.More() {
+		response, err := listPager.NextPage(ctx)
+		if err != nil {
+			return hooks, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var hook *storage.Webhook
+			err = json.Unmarshal(v, &hook)
+			if err != nil {
+				return hooks, fmt.Errorf("failed to unmarshal webhook in list of results: %w", err)
+			}
+			if err = hook.OpenSecret(s, s.salt); err != nil {
+				return hooks, err
+			}
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks, nil
+}
+
+func (s *azWebhookStore) AddWebhook(ctx context.Context, username string, url string) (*storage.Webhook, error) {
+	existing, err := s.ListWebhooks(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= storage.MAX_WEBHOOKS {
+		return nil, fmt.Errorf("no more than %d webhooks are allowed", storage.MAX_WEBHOOKS)
+	}
+	hook, err := storage.NewWebhook(username, url)
+	if err != nil {
+		return nil, err
+	}
+	secret := hook.Secret
+	if err := hook.SealSecret(s, s.salt); err != nil {
+		return nil, err
+	}
+	marshalled, err := json.Marshal(hook)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal webhook: %w", err)
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	// adding fails if the generated id is already taken
+	_, err = client.AddEntity(ctx, marshalled, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save webhook: %w", err)
+	}
+	// temporarily show the secret to the user
+	hook.Secret = secret
+	return &hook, nil
+}
+
+func (s *azWebhookStore) DeleteWebhook(ctx context.Context, username string, id string) error {
+	client, err := s.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.DeleteEntity(ctx, username, id, nil)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return storage.ErrWebhookNotFound
+		}
+		return fmt.Errorf("failed to delete webhook entity: %w", err)
+	}
+	return nil
+}
+
+func (s *azWebhookStore) AddDelivery(ctx context.Context, delivery storage.WebhookDelivery) error {
+	marshalled, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook delivery: %w", err)
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	_, err = client.AddEntity(ctx, marshalled, nil)
+	if err != nil {
+		return fmt.Errorf("failed to save webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// The row keys of the deliveries sort the newest first,
+// the first page of the query contains the latest ones
+func (s *azWebhookStore) ListDeliveries(ctx context.Context, username string) ([]*storage.WebhookDelivery, error) {
+	var deliveries []*storage.WebhookDelivery
+	client, err := s.getClient()
+	if err != nil {
+		return deliveries, fmt.Errorf("failed to get aztable client: %w", err)
+	}
+	filter := prefixFilter(username, storage.DeliveryKeyPrefix)
+	top := int32(storage.MAX_WEBHOOK_DELIVERIES)
+	listPager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: &filter,
+		Top:    &top,
+	})
+	if listPager.More() {
+		response, err := listPager.NextPage(ctx)
+		if err != nil {
+			return deliveries, fmt.Errorf("failed to get page of results: %w", err)
+		}
+		for _, v := range response.Entities {
+			var delivery *storage.WebhookDelivery
+			err = json.Unmarshal(v, &delivery)
+			if err != nil {
+				return deliveries, fmt.Errorf("failed to unmarshal webhook delivery: %w", err)
+			}
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const MAX_BULK_ROWS = 100
+
+// BulkRow is a line of the uploaded CSV: the content, an optional label
+// and an optional expiry, the expiry is checked by the caller
+type BulkRow struct {
+	Line    int
+	Content string
+	Label   string
+	Expiry  string
+}
+
+// BulkMessage is the content of one of the messages created together
+type BulkMessage struct {
+	Text    string
+	Options MessageOptions
+}
+
+// ParseBulkCSV reads the rows of content,label,expiry, the header line
+// is optional and is recognised by its first column being "content"
+func ParseBulkCSV(r io.Reader) ([]BulkRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var rows []BulkRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("file is not a valid CSV: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		if len(rows) == 0 && line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "content") {
+			continue
+		}
+		if len(record) > 3 {
+			return nil, fmt.Errorf("line %d has more than the content, label and expiry columns", line)
+		}
+		row := BulkRow{Line: line, Content: record[0]}
+		if len(record) > 1 {
+			row.Label = strings.TrimSpace(record[1])
+		}
+		if len(record) > 2 {
+			row.Expiry = strings.TrimSpace(record[2])
+		}
+		if strings.TrimSpace(row.Content) == "" {
+			return nil, fmt.Errorf("line %d has no content", line)
+		}
+		rows = append(rows, row)
+		if len(rows) > MAX_BULK_ROWS {
+			return nil, fmt.Errorf("up to %d messages can be created at once", MAX_BULK_ROWS)
+		}
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("file has no messages")
+	}
+	return rows, nil
+}
+
+// AddMessages stores all the messages or none of them. The messages are kept
+// in separate partitions, so instead of a transaction the messages created
+// before a failure are deleted again. The listeners only hear about the
+// messages once all of them are stored.
+func AddMessages(ctx context.Context, store MessageStore, username string, batch []BulkMessage) ([]*Message, error) {
+	ctx, release := HoldEvents(ctx)
+	var created []*Message
+	for i, m := range batch {
+		msg, err := store.AddMessage(ctx, m.Text, username, m.Options)
+		if err != nil {
+			release(false)
+			for _, c := range created {
+				if err := store.DeleteMessage(ctx, c.PartitionKey, username); err != nil {
+					slog.LogAttrs(ctx, slog.LevelError, "failed to roll back bulk message", slog.String("id", c.PartitionKey), slog.String("username", username), slog.Any("error", err))
+				}
+			}
+			return nil, fmt.Errorf("message %d: %w", i+1, err)
+		}
+		created = append(created, msg)
+	}
+	release(true)
+	return created, nil
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const MAX_COPIES = 20
+const MAX_COPY_NAME_LENGTH = 64
+
+// ParseCopies splits the names of the people getting a copy of the message
+// each, the names are separated by commas and only shown to the owner
+func ParseCopies(value string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if utf8.RuneCountInString(name) > MAX_COPY_NAME_LENGTH {
+			return nil, fmt.Errorf("name %s must be up to %d characters", name, MAX_COPY_NAME_LENGTH)
+		}
+		if slices.Contains(names, name) {
+			return nil, fmt.Errorf("name %s is repeated", name)
+		}
+		names = append(names, name)
+	}
+	if len(names) > MAX_COPIES {
+		return nil, fmt.Errorf("a message can be sent to up to %d people separately", MAX_COPIES)
+	}
+	return names, nil
+}
+
+// MessageCopies are the copies of the message sent to several people, each copy
+// has its own link, pin and attempts. A message sent once is a group of its own.
+type MessageCopies struct {
+	BatchID  string
+	Messages []*Message
+}
+
+func (c *MessageCopies) IsBatch() bool {
+	return c.BatchID != ""
+}
+
+// Opened lists the names of the people who have read their copy
+func (c *MessageCopies) Opened() []string {
+	var names []string
+	for _, m := range c.Messages {
+		if m.IsOpened() {
+			names = append(names, m.CopyFor)
+		}
+	}
+	return names
+}
+
+func (c *MessageCopies) Names() []string {
+	var names []string
+	for _, m := range c.Messages {
+		names = append(names, m.CopyFor)
+	}
+	return names
+}
+
+// GroupCopies gathers the copies of the same message at the place of the first one,
+// otherwise the order of the messages is kept
+func GroupCopies(msgs []*Message) []*MessageCopies {
+	var groups []*MessageCopies
+	batches := map[string]*MessageCopies{}
+	for _, m := range msgs {
+		if m.BatchID == "" {
+			groups = append(groups, &MessageCopies{Messages: []*Message{m}})
+			continue
+		}
+		if batch, ok := batches[m.BatchID]; ok {
+			batch.Messages = append(batch.Messages, m)
+			continue
+		}
+		batch := &MessageCopies{BatchID: m.BatchID, Messages: []*Message{m}}
+		batches[m.BatchID] = batch
+		groups = append(groups, batch)
+	}
+	return groups
+}
+
+// BatchCopies lists all the copies of the batches the messages belong to,
+// the copies get random IDs so a page of the list usually has only some of them.
+// The copies of all the batches are listed together rather than batch by batch.
+func BatchCopies(ctx context.Context, store MessageStore, username string, msgs []*Message) (map[string]*MessageCopies, error) {
+	batches := map[string]*MessageCopies{}
+	var batchIDs []string
+	for _, m := range msgs {
+		if m.BatchID != "" && !slices.Contains(batchIDs, m.BatchID) {
+			batchIDs = append(batchIDs, m.BatchID)
+		}
+	}
+	if len(batchIDs) == 0 {
+		return batches, nil
+	}
+	opts := ListOptions{SortBy: SortByNewest, Limit: MAX_PAGE_SIZE, BatchIDs: batchIDs}
+	for {
+		page, err := store.ListMessages(ctx, username, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range page.Messages {
+			batch, ok := batches[m.BatchID]
+			if !ok {
+				batch = &MessageCopies{BatchID: m.BatchID}
+				batches[m.BatchID] = batch
+			}
+			batch.Messages = append(batch.Messages, m)
+		}
+		if page.NextCursor == "" {
+			return batches, nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// IsOpened is true once the message was read at least once
+func (m *Message) IsOpened() bool {
+	for _, e := range m.History() {
+		if e.Type == EventRead {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// EventDestroyed is sent once the message becomes a tombstone,
+// the status of the event tells whether it was read, destroyed or expired
+const EventDestroyed = "destroyed"
+
+// LifecycleEvent tells the listeners what happened to the message,
+// it never contains any secrets
+type LifecycleEvent struct {
+	Type              string    `json:"type"`
+	MessageID         string    `json:"message_id"`
+	Owner             string    `json:"owner"`
+	Status            string    `json:"status,omitempty"`
+	AttemptsRemaining int       `json:"attempts_remaining"`
+	ViewsRemaining    int       `json:"views_remaining"`
+	At                time.Time `json:"at"`
+}
+
+// MessageListener gets notified about the lifecycle of the messages.
+// It is called while the request is processed and must not block.
+type MessageListener interface {
+	MessageChanged(ctx context.Context, event LifecycleEvent)
+}
+
+// Notifier keeps the listeners of the message store,
+// it is embedded into the store implementations
+type Notifier struct {
+	mu        sync.RWMutex
+	listeners []MessageListener
+}
+
+func (n *Notifier) Subscribe(listener MessageListener) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.listeners = append(n.listeners, listener)
+}
+
+// Notify sends the event about the stored message to the listeners
+// and follows up with EventDestroyed if the message became a tombstone,
+// the events are kept back while the context holds them, see HoldEvents
+func (n *Notifier) Notify(ctx context.Context, eventType string, stored *Message) {
+	event := LifecycleEvent{
+		Type:              eventType,
+		MessageID:         stored.PartitionKey,
+		Owner:             stored.RowKey,
+		Status:            stored.Status,
+		AttemptsRemaining: stored.AttemptsRemaining,
+		ViewsRemaining:    stored.ViewsRemaining,
+		At:                time.Now().UTC(),
+	}
+	destroyed := eventType != EventDestroyed && stored.IsTombstone()
+	if held, ok := ctx.Value(heldEventsKey{}).(*heldEvents); ok {
+		held.mu.Lock()
+		defer held.mu.Unlock()
+		held.send = append(held.send, func() { n.send(ctx, event, destroyed) })
+		return
+	}
+	n.send(ctx, event, destroyed)
+}
+
+func (n *Notifier) send(ctx context.Context, event LifecycleEvent, destroyed bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, l := range n.listeners {
+		l.MessageChanged(ctx, event)
+	}
+	if destroyed {
+		event.Type = EventDestroyed
+		for _, l := range n.listeners {
+			l.MessageChanged(ctx, event)
+		}
+	}
+}
+
+type heldEventsKey struct{}
+
+type heldEvents struct {
+	mu   sync.Mutex
+	send []func()
+}
+
+// HoldEvents keeps back the events of the changes made with the returned context
+// until release is called, they are dropped instead of sent if the changes were undone
+func HoldEvents(ctx context.Context) (context.Context, func(send bool)) {
+	held := &heldEvents{}
+	release := func(send bool) {
+		held.mu.Lock()
+		pending := held.send
+		held.send = nil
+		held.mu.Unlock()
+		if !send {
+			return
+		}
+		for _, s := range pending {
+			s()
+		}
+	}
+	return context.WithValue(ctx, heldEventsKey{}, held), release
+}
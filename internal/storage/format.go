@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// Content types the creator picks for the message to be shown accordingly
+const (
+	FormatPlain    = "plain"
+	FormatPre      = "pre"
+	FormatMarkdown = "markdown"
+	FormatCode     = "code"
+)
+
+var languagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+#._-]{0,19}$`)
+
+// ContentFormat tells how the content is shown, it is encrypted along with
+// the content as the type of the content can tell something about it
+type ContentFormat struct {
+	Type string
+	// Language is the hint of the code highlighting, e.g. yaml or go
+	Language string `json:",omitempty"`
+}
+
+func (f ContentFormat) Validate() error {
+	switch f.Type {
+	case "", FormatPlain, FormatPre, FormatMarkdown:
+		if f.Language != "" {
+			return errors.New("language can only be set for code")
+		}
+	case FormatCode:
+		if f.Language != "" && !languagePattern.MatchString(f.Language) {
+			return errors.New("language must be up to 20 lowercase letters, digits or +#._-")
+		}
+	default:
+		return fmt.Errorf("unsupported content type %s", f.Type)
+	}
+	return nil
+}
+
+func (f ContentFormat) IsPlain() bool {
+	return f.Type == "" || f.Type == FormatPlain
+}
+
+// FileName is offered when the content gets downloaded
+func (f ContentFormat) FileName() string {
+	switch f.Type {
+	case FormatMarkdown:
+		return "message.md"
+	case FormatCode:
+		if f.Language != "" {
+			return "message." + f.Language
+		}
+	}
+	return "message.txt"
+}
+
+// SealFormat encrypts the content type with the same pin as the content,
+// the plain text messages do not store it at all
+func (m *Message) SealFormat(c Cipher, salt string, pin string, format ContentFormat) error {
+	if format.IsPlain() {
+		m.Format = ""
+		return nil
+	}
+	marshalled, err := json.Marshal(format)
+	if err != nil {
+		return fmt.Errorf("failed to marshal content format: %w", err)
+	}
+	ciphertext, err := c.Encrypt(string(marshalled), pin, salt)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt content format: %w", err)
+	}
+	m.Format = ciphertext
+	return nil
+}
+
+// OpenFormat decrypts the content type and makes it available in ContentFormat
+func (m *Message) OpenFormat(c Cipher, salt string, pin string) error {
+	if m.Format == "" {
+		m.ContentFormat = ContentFormat{Type: FormatPlain}
+		return nil
+	}
+	plaintext, err := c.Decrypt(m.Format, pin, salt)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt content format: %w", err)
+	}
+	var format ContentFormat
+	if err := json.Unmarshal([]byte(plaintext), &format); err != nil {
+		return fmt.Errorf("failed to unmarshal content format: %w", err)
+	}
+	m.ContentFormat = format
+	return nil
+}
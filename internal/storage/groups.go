@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/shamir"
+)
+
+var ErrGroupNotFound = errors.New("share group not found")
+var ErrNotEnoughShares = errors.New("not enough shares were redeemed")
+
+// GroupStore keeps the groups of the shares a secret was split into,
+// the holders redeem their shares into the group and once enough of them
+// did so the secret can be recovered with the PIN of the group
+type GroupStore interface {
+	// AddGroup creates the group expecting the given number of shares, the returned
+	// group holds the generated PIN which is shown to the owner once
+	AddGroup(ctx context.Context, username string, total int, threshold int, expiresIn time.Duration) (*ShareGroup, error)
+	// GetGroup returns the group which has not expired or nil
+	GetGroup(ctx context.Context, id string) (*ShareGroup, error)
+	// RedeemShare seals the share of a holder with the public key of the group
+	RedeemShare(ctx context.Context, id string, share string) (*ShareGroup, error)
+	// CombineShares recovers the secret from the redeemed shares and deletes the group,
+	// the wrong PIN uses up the attempts the same way as with the messages
+	CombineShares(ctx context.Context, id string, pin string) (string, error)
+	// DeleteGroup removes the group owned by the user, e.g. when its shares
+	// could not be stored, it returns ErrGroupNotFound for the group of someone else
+	DeleteGroup(ctx context.Context, id string, username string) error
+	DeleteExpiredGroups(ctx context.Context) (int64, error)
+}
+
+// ShareGroup collects the redeemed shares. They are sealed with the public key,
+// the private key is encrypted with the PIN of the group, so the server cannot
+// recover the secret even after enough shares were redeemed.
+type ShareGroup struct {
+	aztables.Entity
+	Total             int
+	Threshold         int
+	PublicKey         string
+	PrivateKey        string
+	Pin               string
+	AttemptsRemaining int
+	ExpiresAt         aztables.EDMDateTime
+	// Shares is a comma separated list of the sealed shares
+	Shares string
+}
+
+// NewShareGroup generates the key pair of the group and
+// encrypts the private key with the pin
+func NewShareGroup(id string, username string, total int, threshold int, expiresIn time.Duration, pin string, c Cipher, salt string) (ShareGroup, error) {
+	if total < shamir.MIN_SHARES || total > shamir.MAX_SHARES {
+		return ShareGroup{}, fmt.Errorf("number of shares must be between %d and %d", shamir.MIN_SHARES, shamir.MAX_SHARES)
+	}
+	if threshold < shamir.MIN_SHARES || threshold > total {
+		return ShareGroup{}, fmt.Errorf("required shares must be between %d and the number of shares", shamir.MIN_SHARES)
+	}
+	if expiresIn <= 0 {
+		return ShareGroup{}, errors.New("group expiry must be in the future")
+	}
+	public, private, err := crypto.GenerateBoxKey()
+	if err != nil {
+		return ShareGroup{}, err
+	}
+	sealedPrivate, err := c.Encrypt(private, pin, salt)
+	if err != nil {
+		return ShareGroup{}, fmt.Errorf("failed to encrypt the private key: %w", err)
+	}
+	pinHash, err := crypto.HashPass(pin)
+	if err != nil {
+		return ShareGroup{}, err
+	}
+	t := time.Now()
+	return ShareGroup{
+		Entity: aztables.Entity{
+			PartitionKey: id,
+			RowKey:       username,
+			Timestamp:    aztables.EDMDateTime(t),
+		},
+		Total:             total,
+		Threshold:         threshold,
+		PublicKey:         public,
+		PrivateKey:        sealedPrivate,
+		Pin:               pinHash,
+		AttemptsRemaining: MAX_PIN_ATTEMPTS,
+		ExpiresAt:         aztables.EDMDateTime(t.Add(expiresIn).UTC().Truncate(time.Second)),
+	}, nil
+}
+
+// SplitSecret splits the text into the shares which are stored as
+// the contents of the share messages
+func SplitSecret(text string, total int, threshold int) ([]string, error) {
+	shares, err := shamir.Split([]byte(text), total, threshold)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]string, len(shares))
+	for i, share := range shares {
+		encoded[i] = base64.StdEncoding.EncodeToString(share)
+	}
+	return encoded, nil
+}
+
+func (g *ShareGroup) ID() string {
+	return g.PartitionKey
+}
+
+func (g *ShareGroup) IsExpired() bool {
+	return !time.Now().Before(time.Time(g.ExpiresAt))
+}
+
+func (g *ShareGroup) FormattedExpiry() string {
+	return time.Time(g.ExpiresAt).Format(time.RFC822)
+}
+
+func (g *ShareGroup) Redeemed() int {
+	if g.Shares == "" {
+		return 0
+	}
+	return strings.Count(g.Shares, ",") + 1
+}
+
+func (g *ShareGroup) CanCombine() bool {
+	return g.Redeemed() >= g.Threshold
+}
+
+// Redeem seals the share of the holder
+func (g *ShareGroup) Redeem(share string) error {
+	if g.Redeemed() >= g.Total {
+		return errors.New("all shares were redeemed already")
+	}
+	sealed, err := crypto.SealToPublicKey(g.PublicKey, share)
+	if err != nil {
+		return fmt.Errorf("failed to seal the share: %w", err)
+	}
+	if g.Shares == "" {
+		g.Shares = sealed
+	} else {
+		g.Shares += "," + sealed
+	}
+	return nil
+}
+
+// Combine recovers the private key with the pin, opens the redeemed shares
+// and combines them into the secret
+func (g *ShareGroup) Combine(c Cipher, salt string, pin string) (string, error) {
+	if !g.CanCombine() {
+		return "", ErrNotEnoughShares
+	}
+	if err := crypto.CompareHashToPass(g.Pin, pin); err != nil {
+		return "", ErrInvalidPin
+	}
+	private, err := c.Decrypt(g.PrivateKey, pin, salt)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt the private key: %w", err)
+	}
+	var shares [][]byte
+	for _, sealed := range strings.Split(g.Shares, ",") {
+		encoded, err := crypto.OpenWithPrivateKey(private, sealed)
+		if err != nil {
+			return "", err
+		}
+		share, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode the share: %w", err)
+		}
+		shares = append(shares, share)
+	}
+	secret, err := shamir.Combine(shares)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
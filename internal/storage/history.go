@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+)
+
+// TOMBSTONE_RETENTION is how long the owner can see what happened
+// to the message after it was read, destroyed or expired
+const TOMBSTONE_RETENTION = 30 * 24 * time.Hour
+
+// Statuses of the message, the message is active until it becomes a tombstone
+const (
+	StatusActive    = ""
+	StatusRead      = "read"
+	StatusDestroyed = "destroyed"
+	StatusExpired   = "expired"
+)
+
+// Events kept in the message history
+const (
+	EventCreated  = "created"
+	EventRead     = "read"
+	EventFailed   = "failed"
+	EventPinReset = "pin_reset"
+	EventEdited   = "edited"
+	EventExpired  = "expired"
+)
+
+// MessageEvent is a non-secret record in the history of the message
+type MessageEvent struct {
+	Type string
+	At   time.Time
+	// Fingerprint coarsely describes the client which caused the event
+	Fingerprint string `json:",omitempty"`
+}
+
+var eventLabels = map[string]string{
+	EventCreated:  "Created",
+	EventRead:     "Read",
+	EventFailed:   "Failed attempt",
+	EventPinReset: "PIN reset",
+	EventEdited:   "Edited",
+	EventExpired:  "Expired",
+}
+
+func (e MessageEvent) Label() string {
+	if label, ok := eventLabels[e.Type]; ok {
+		return label
+	}
+	return e.Type
+}
+
+func (e MessageEvent) FormattedDate() string {
+	return e.At.Format(time.RFC822)
+}
+
+type fingerprintKey struct{}
+
+// WithClientFingerprint attaches the description of the reader
+// to the context so that the store can record it in the history
+func WithClientFingerprint(ctx context.Context, fingerprint string) context.Context {
+	return context.WithValue(ctx, fingerprintKey{}, fingerprint)
+}
+
+func ClientFingerprint(ctx context.Context) string {
+	if fingerprint, ok := ctx.Value(fingerprintKey{}).(string); ok {
+		return fingerprint
+	}
+	return ""
+}
+
+type beforeReadKey struct{}
+
+// WithBeforeRead attaches the step which has to succeed with the decrypted
+// content before the read is recorded, otherwise the message stays as it was
+func WithBeforeRead(ctx context.Context, step func(msg *Message, text string) error) context.Context {
+	return context.WithValue(ctx, beforeReadKey{}, step)
+}
+
+func BeforeRead(ctx context.Context, msg *Message, text string) error {
+	if step, ok := ctx.Value(beforeReadKey{}).(func(*Message, string) error); ok {
+		return step(msg, text)
+	}
+	return nil
+}
+
+// IsTombstone is true once the message can no longer be read
+// and only its history is kept for the owner
+func (m *Message) IsTombstone() bool {
+	return m.Status != StatusActive
+}
+
+// History returns the events in the order they happened
+func (m *Message) History() []MessageEvent {
+	var events []MessageEvent
+	if m.EventLog == "" {
+		return events
+	}
+	if err := json.Unmarshal([]byte(m.EventLog), &events); err != nil {
+		return nil
+	}
+	return events
+}
+
+// FailedAttempts counts the wrong pins entered so far
+func (m *Message) FailedAttempts() int {
+	var count int
+	for _, e := range m.History() {
+		if e.Type == EventFailed {
+			count++
+		}
+	}
+	return count
+}
+
+// StatusText describes what happened to the message for the owner
+func (m *Message) StatusText() string {
+	switch m.Status {
+	case StatusRead:
+		return "Read"
+	case StatusDestroyed:
+		return fmt.Sprintf("Destroyed after %d failed attempts", m.FailedAttempts())
+	case StatusExpired:
+		return "Expired unread"
+	}
+	return "Active"
+}
+
+func (m *Message) addEvent(ctx context.Context, eventType string) {
+	events := append(m.History(), MessageEvent{
+		Type:        eventType,
+		At:          time.Now().UTC().Truncate(time.Second),
+		Fingerprint: ClientFingerprint(ctx),
+	})
+	marshalled, err := json.Marshal(events)
+	if err != nil {
+		return
+	}
+	m.EventLog = string(marshalled)
+}
+
+// tombstone removes everything secret from the message, the tombstone
+// is deleted by the sweeper after the retention period
+func (m *Message) tombstone(status string) {
+	m.Status = status
+	m.Content = ""
+	m.Pin = ""
+	m.Attachments = ""
+	m.Files = nil
+	m.Format = ""
+	m.Size = 0
+	m.AttemptsRemaining = 0
+	m.ViewsRemaining = 0
+	m.ExpiresAt = aztables.EDMDateTime(time.Now().Add(TOMBSTONE_RETENTION).UTC().Truncate(time.Second))
+}
+
+// RecordRead uses up one view of the message. The message keeps
+// its secrets for the caller, the returned copy is the one to store,
+// it becomes a tombstone after the last view.
+func (m *Message) RecordRead(ctx context.Context) Message {
+	m.ViewsRemaining -= 1
+	m.addEvent(ctx, EventRead)
+	stored := *m
+	stored.Files = nil
+	if stored.ViewsRemaining <= 0 {
+		stored.tombstone(StatusRead)
+	}
+	return stored
+}
+
+// RecordFailedAttempt uses up one attempt, the returned copy
+// becomes a tombstone after the last attempt
+func (m *Message) RecordFailedAttempt(ctx context.Context) Message {
+	m.AttemptsRemaining -= 1
+	m.addEvent(ctx, EventFailed)
+	stored := *m
+	stored.Files = nil
+	if stored.AttemptsRemaining <= 0 {
+		stored.tombstone(StatusDestroyed)
+	}
+	return stored
+}
+
+// Expire turns the expired message into a tombstone
+func (m *Message) Expire(ctx context.Context) {
+	m.addEvent(ctx, EventExpired)
+	m.tombstone(StatusExpired)
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const MAX_TITLE_LENGTH = 100
+const MAX_LABELS = 10
+
+var labelPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// ParseLabels splits the labels separated by commas or spaces,
+// they are lowercased and the duplicates are dropped
+func ParseLabels(value string) ([]string, error) {
+	var labels []string
+	for _, label := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		label = strings.ToLower(label)
+		if !labelPattern.MatchString(label) {
+			return nil, fmt.Errorf("label %s must be up to 32 letters, digits, dashes or underscores", label)
+		}
+		if !slices.Contains(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) > MAX_LABELS {
+		return nil, fmt.Errorf("a message can have up to %d labels", MAX_LABELS)
+	}
+	return labels, nil
+}
+
+// SetLabels changes the title and the labels only the owner gets to see,
+// they are stored in plain text and must not contain anything secret
+func (m *Message) SetLabels(title string, labels []string) error {
+	title = strings.TrimSpace(title)
+	if utf8.RuneCountInString(title) > MAX_TITLE_LENGTH {
+		return fmt.Errorf("title must be up to %d characters", MAX_TITLE_LENGTH)
+	}
+	parsed, err := ParseLabels(strings.Join(labels, ","))
+	if err != nil {
+		return err
+	}
+	m.Title = title
+	m.Labels = strings.Join(parsed, ",")
+	return nil
+}
+
+func (m *Message) LabelList() []string {
+	if m.Labels == "" {
+		return nil
+	}
+	return strings.Split(m.Labels, ",")
+}
+
+func (m *Message) HasLabel(label string) bool {
+	return slices.Contains(m.LabelList(), strings.ToLower(label))
+}
+
+// HideOwnerDetails clears what only the owner is supposed to see
+// before the message is shown to the reader
+func (m *Message) HideOwnerDetails() {
+	m.Title = ""
+	m.Labels = ""
+	m.CopyFor = ""
+}
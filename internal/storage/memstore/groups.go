@@ -0,0 +1,122 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+type memGroupStore struct {
+	crypto.EntityEncryptHelper
+	// guards the shares and the attempts from the concurrent holders
+	mu        sync.Mutex
+	groups    map[string]storage.ShareGroup
+	salt      string
+	pinPolicy crypto.PinPolicy
+	idPolicy  crypto.IDPolicy
+}
+
+func NewMemGroupStore(salt string, pinPolicy crypto.PinPolicy, idPolicy crypto.IDPolicy) storage.GroupStore {
+	return &memGroupStore{groups: map[string]storage.ShareGroup{}, salt: salt, pinPolicy: pinPolicy, idPolicy: idPolicy}
+}
+
+func (s *memGroupStore) AddGroup(ctx context.Context, username string, total int, threshold int, expiresIn time.Duration) (*storage.ShareGroup, error) {
+	pin, err := crypto.MakePin(s.pinPolicy)
+	if err != nil {
+		return nil, err
+	}
+	id, err := crypto.MakeID(s.idPolicy)
+	if err != nil {
+		return nil, err
+	}
+	group, err := storage.NewShareGroup(id, username, total, threshold, expiresIn, pin, s, s.salt)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.groups[id]; ok {
+		return nil, storage.ErrIDCollision
+	}
+	s.groups[id] = group
+	// temporarily show the pin to the owner
+	group.Pin = pin
+	return &group, nil
+}
+
+func (s *memGroupStore) GetGroup(ctx context.Context, id string) (*storage.ShareGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, ok := s.groups[id]
+	if !ok || group.IsExpired() {
+		return nil, nil
+	}
+	return &group, nil
+}
+
+func (s *memGroupStore) RedeemShare(ctx context.Context, id string, share string) (*storage.ShareGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, ok := s.groups[id]
+	if !ok || group.IsExpired() {
+		return nil, storage.ErrGroupNotFound
+	}
+	if err := group.Redeem(share); err != nil {
+		return nil, err
+	}
+	s.groups[id] = group
+	return &group, nil
+}
+
+func (s *memGroupStore) CombineShares(ctx context.Context, id string, pin string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, ok := s.groups[id]
+	if !ok || group.IsExpired() {
+		return "", storage.ErrGroupNotFound
+	}
+	secret, err := group.Combine(s, s.salt, pin)
+	if errors.Is(err, storage.ErrInvalidPin) {
+		group.AttemptsRemaining -= 1
+		if group.AttemptsRemaining <= 0 {
+			delete(s.groups, id)
+		} else {
+			s.groups[id] = group
+		}
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	// the secret is recovered once
+	delete(s.groups, id)
+	return secret, nil
+}
+
+func (s *memGroupStore) DeleteGroup(ctx context.Context, id string, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, ok := s.groups[id]
+	if !ok || group.RowKey != username {
+		return storage.ErrGroupNotFound
+	}
+	delete(s.groups, id)
+	return nil
+}
+
+func (s *memGroupStore) DeleteExpiredGroups(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int64
+	for id, group := range s.groups {
+		if group.IsExpired() {
+			delete(s.groups, id)
+			count++
+		}
+	}
+	return count, nil
+}
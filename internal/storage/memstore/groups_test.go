@@ -0,0 +1,143 @@
+package memstore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+	"github.com/ivarprudnikov/secretshare/internal/storage/memstore"
+)
+
+func TestGroupStore_RedeemAndCombine(t *testing.T) {
+	store := memstore.NewMemGroupStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	group, err := store.AddGroup(context.Background(), "testuser", 5, 3, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if group.Pin == "" {
+		t.Fatalf("Expected the pin to be shown to the owner")
+	}
+	shares, err := storage.SplitSecret("root password", 5, 3)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for _, share := range shares[:2] {
+		if _, err := store.RedeemShare(context.Background(), group.ID(), share); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	_, err = store.CombineShares(context.Background(), group.ID(), group.Pin)
+	if !errors.Is(err, storage.ErrNotEnoughShares) {
+		t.Fatalf("Expected not enough shares error, got %v", err)
+	}
+
+	redeemed, err := store.RedeemShare(context.Background(), group.ID(), shares[4])
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if redeemed.Redeemed() != 3 || !redeemed.CanCombine() {
+		t.Fatalf("Expected three shares to be redeemed, got %d", redeemed.Redeemed())
+	}
+
+	_, err = store.CombineShares(context.Background(), group.ID(), "wrong")
+	if !errors.Is(err, storage.ErrInvalidPin) {
+		t.Fatalf("Expected invalid pin error, got %v", err)
+	}
+	found, _ := store.GetGroup(context.Background(), group.ID())
+	if found == nil || found.AttemptsRemaining != storage.MAX_PIN_ATTEMPTS-1 {
+		t.Fatalf("Expected the attempt to be used, got %v", found)
+	}
+
+	secret, err := store.CombineShares(context.Background(), group.ID(), group.Pin)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if secret != "root password" {
+		t.Fatalf("Expected the secret, got %s", secret)
+	}
+	found, _ = store.GetGroup(context.Background(), group.ID())
+	if found != nil {
+		t.Fatalf("Expected the group to be deleted after the secret was recovered")
+	}
+}
+
+func TestGroupStore_InvalidGroup(t *testing.T) {
+	store := memstore.NewMemGroupStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	if _, err := store.AddGroup(context.Background(), "testuser", 3, 4, time.Hour); err == nil {
+		t.Fatalf("Expected the threshold above the number of shares to be refused")
+	}
+	if _, err := store.RedeemShare(context.Background(), "missing", "share"); !errors.Is(err, storage.ErrGroupNotFound) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestGroupStore_ShareKeptWhenRedeemFails(t *testing.T) {
+	groups := memstore.NewMemGroupStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+	messages := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	group, err := groups.AddGroup(context.Background(), "testuser", 3, 2, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	shares, err := storage.SplitSecret("root password", 3, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	msg, err := messages.AddMessage(context.Background(), shares[0], "testuser", storage.MessageOptions{ExpiresIn: time.Hour, GroupID: group.ID()})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	redeem := func(groupID string) context.Context {
+		return storage.WithBeforeRead(context.Background(), func(m *storage.Message, text string) error {
+			_, err := groups.RedeemShare(context.Background(), groupID, text)
+			return err
+		})
+	}
+
+	// The group cannot take the share, the view is not used up
+	_, err = messages.GetFullMessage(redeem("missing"), msg.PartitionKey, msg.Pin, "")
+	if !errors.Is(err, storage.ErrGroupNotFound) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+	found, _ := messages.GetMessage(context.Background(), msg.PartitionKey)
+	if found == nil || found.ViewsRemaining != 1 || found.AttemptsRemaining != storage.MAX_PIN_ATTEMPTS {
+		t.Fatalf("Expected the share to be kept, got %v", found)
+	}
+
+	// Once redeemed the share is used up
+	if _, err := messages.GetFullMessage(redeem(group.ID()), msg.PartitionKey, msg.Pin, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	redeemed, _ := groups.GetGroup(context.Background(), group.ID())
+	if redeemed == nil || redeemed.Redeemed() != 1 {
+		t.Fatalf("Expected the share to be redeemed, got %v", redeemed)
+	}
+	found, _ = messages.GetMessage(context.Background(), msg.PartitionKey)
+	if found != nil {
+		t.Fatalf("Expected the share to be used up")
+	}
+}
+
+func TestGroupStore_DeleteGroup(t *testing.T) {
+	store := memstore.NewMemGroupStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	group, err := store.AddGroup(context.Background(), "testuser", 3, 2, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.DeleteGroup(context.Background(), group.ID(), "otheruser"); !errors.Is(err, storage.ErrGroupNotFound) {
+		t.Fatalf("Expected group not found error, got %v", err)
+	}
+	if err := store.DeleteGroup(context.Background(), group.ID(), "testuser"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if found, _ := store.GetGroup(context.Background(), group.ID()); found != nil {
+		t.Fatalf("Expected the group to be deleted")
+	}
+}
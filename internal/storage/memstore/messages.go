@@ -2,6 +2,7 @@ package memstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -9,29 +10,54 @@ import (
 	"github.com/ivarprudnikov/secretshare/internal/storage"
 )
 
+// MAX_UPDATE_ATTEMPTS is how many times a read or a wrong pin is saved again
+// if the message was saved by a parallel request at the same time
+const MAX_UPDATE_ATTEMPTS = 3
+
 type memMessageStore struct {
 	crypto.EntityEncryptHelper
-	messages sync.Map
-	salt     string
+	storage.Notifier
+	// messages keeps pointers to the messages which are never changed in place,
+	// so CompareAndSwap can tell if the message was saved in the meantime
+	messages  sync.Map
+	salt      string
+	pinPolicy crypto.PinPolicy
+	idPolicy  crypto.IDPolicy
 }
 
-func NewMemMessageStore(salt string) storage.MessageStore {
-	return &memMessageStore{messages: sync.Map{}, salt: salt}
+func NewMemMessageStore(salt string, pinPolicy crypto.PinPolicy, idPolicy crypto.IDPolicy) storage.MessageStore {
+	return &memMessageStore{messages: sync.Map{}, salt: salt, pinPolicy: pinPolicy, idPolicy: idPolicy}
 }
 
 func (s *memMessageStore) CountMessages(ctx context.Context) (int64, error) {
 	var count int64
 	s.messages.Range(func(k, v any) bool {
-		count++
+		if msg, ok := loadMessage(v); ok && !msg.IsTombstone() {
+			count++
+		}
 		return true
 	})
 	return count, nil
 }
 
-func (s *memMessageStore) ListMessages(ctx context.Context, username string) ([]*storage.Message, error) {
+func (s *memMessageStore) ListMessages(ctx context.Context, username string, opts storage.ListOptions) (*storage.MessagePage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
 	var msgs []*storage.Message
 	s.messages.Range(func(k, v any) bool {
-		if msg, ok := v.(storage.Message); ok && msg.RowKey == username {
+		if msg, ok := loadMessage(v); ok && msg.RowKey == username && !msg.IsExpired() && opts.Matches(&msg) {
+			msgs = append(msgs, &msg)
+		}
+		return true
+	})
+	return storage.PageMessages(msgs, opts)
+}
+
+func (s *memMessageStore) ListInbox(ctx context.Context, username string) ([]*storage.Message, error) {
+	var msgs []*storage.Message
+	s.messages.Range(func(k, v any) bool {
+		if msg, ok := loadMessage(v); ok && msg.HasRecipient(username) && !msg.IsTombstone() && !msg.IsExpired() {
 			msgs = append(msgs, &msg)
 		}
 		return true
@@ -39,10 +65,8 @@ func (s *memMessageStore) ListMessages(ctx context.Context, username string) ([]
 	return msgs, nil
 }
 
-// TODO: allow to reset the pin for the owner
-func (s *memMessageStore) AddMessage(ctx context.Context, text string, username string) (*storage.Message, error) {
-	// an easy to enter pin
-	pin, err := crypto.MakePin()
+func (s *memMessageStore) AddMessage(ctx context.Context, text string, username string, opts storage.MessageOptions) (*storage.Message, error) {
+	pin, generated, err := storage.ChoosePin(opts, s.pinPolicy)
 	if err != nil {
 		return nil, err
 	}
@@ -50,61 +74,304 @@ func (s *memMessageStore) AddMessage(ctx context.Context, text string, username
 	if err != nil {
 		return nil, err
 	}
-	msg, err := storage.NewMessage(username, ciphertext, pin)
+	msg, err := storage.NewMessage(username, ciphertext, pin, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = msg.SealAttachments(s, s.salt, pin, opts.Attachments)
 	if err != nil {
 		return nil, err
 	}
+	err = msg.SealFormat(s, s.salt, pin, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	msg.Measure()
 	// store unreadbale message, pin
-	s.messages.Store(msg.Entity.PartitionKey, msg)
-	// temporarily show the pin to the creator
-	msg.Pin = pin
+	err = storage.InsertWithID(ctx, &msg, s.idPolicy, s.insertMessage)
+	if err != nil {
+		return nil, err
+	}
+	s.Notify(ctx, storage.EventCreated, &msg)
+	// temporarily show the generated pin to the creator
+	msg.Pin = ""
+	if generated {
+		msg.Pin = pin
+	}
+	return &msg, nil
+}
+
+func (s *memMessageStore) AddEncryptedMessage(ctx context.Context, ciphertext string, verifier string, username string, opts storage.MessageOptions) (*storage.Message, error) {
+	msg, err := storage.NewClientEncryptedMessage(username, ciphertext, verifier, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = storage.InsertWithID(ctx, &msg, s.idPolicy, s.insertMessage)
+	if err != nil {
+		return nil, err
+	}
+	s.Notify(ctx, storage.EventCreated, &msg)
+	msg.Pin = ""
 	return &msg, nil
 }
 
+// insertMessage never overwrites the message with the same id
+func (s *memMessageStore) insertMessage(msg *storage.Message) error {
+	stored := *msg
+	if _, loaded := s.messages.LoadOrStore(msg.PartitionKey, &stored); loaded {
+		return storage.ErrIDCollision
+	}
+	return nil
+}
+
 func (s *memMessageStore) GetMessage(ctx context.Context, id string) (*storage.Message, error) {
-	if v, ok := s.messages.Load(id); ok {
-		if msg, ok := v.(storage.Message); ok {
-			// clear the pin to let the view know it needs decryption
-			msg.Pin = ""
-			return &msg, nil
-		} else {
-			return nil, fmt.Errorf("unexpected message type")
+	msg, err := s.getLiveMessage(ctx, id)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	// clear the pin to let the view know it needs decryption
+	msg.Pin = ""
+	msg.HideOwnerDetails()
+	return msg, nil
+}
+
+func (s *memMessageStore) GetFullMessage(ctx context.Context, id string, pin string, username string) (*storage.Message, error) {
+	// parallel reads and attempts are saved over each other, the loser loads the message again
+	for range MAX_UPDATE_ATTEMPTS {
+		msg, err := s.getFullMessage(ctx, id, pin, username)
+		if !errors.Is(err, storage.ErrMessageChanged) {
+			return msg, err
 		}
 	}
-	return nil, nil
+	return nil, storage.ErrMessageChanged
 }
 
-func (s *memMessageStore) GetFullMessage(ctx context.Context, id string, pin string) (*storage.Message, error) {
-	if v, ok := s.messages.Load(id); ok {
-		if msg, ok := v.(storage.Message); ok {
+func (s *memMessageStore) getFullMessage(ctx context.Context, id string, pin string, username string) (*storage.Message, error) {
+	msg, version, err := s.getLiveVersion(ctx, id)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+
+	if !msg.CanBeReadBy(username) {
+		return nil, storage.ErrNotRecipient
+	}
+	// the pin is not checked, so the attempts are not used up while locked
+	if msg.IsLocked() {
+		return nil, storage.ErrMessageLocked
+	}
 
-			if err := crypto.CompareHashToPass(msg.Pin, pin); err == nil {
+	if err := crypto.CompareHashToPass(msg.Pin, pin); err == nil {
+
+		text, err := msg.OpenContent(s, s.salt, pin)
+		if err != nil {
+			return nil, err
+		}
+		// the view is taken before the content is given out,
+		// the message becomes a tombstone after the last successful retrieval
+		original := *msg
+		stored := msg.RecordRead(ctx)
+		if !s.messages.CompareAndSwap(id, version, &stored) {
+			return nil, storage.ErrMessageChanged
+		}
+		if err := storage.BeforeRead(ctx, msg, text); err != nil {
+			// give the view back unless the message was saved again
+			s.messages.CompareAndSwap(id, &stored, &original)
+			return nil, err
+		}
+		s.Notify(ctx, storage.EventRead, &stored)
 
-				text, err := s.Decrypt(msg.Content, pin, s.salt)
-				if err != nil {
-					return nil, err
-				}
+		// decrypted files are not kept in the store
+		err = msg.OpenAttachments(s, s.salt, pin)
+		if err != nil {
+			return nil, err
+		}
+		err = msg.OpenFormat(s, s.salt, pin)
+		if err != nil {
+			return nil, err
+		}
+		msg.Content = text
+		msg.HideOwnerDetails()
+		return msg, nil
+	}
 
-				msg.Content = text
+	// If the pin was wrong then start tracking attempts
+	if err := s.recordFailedAttempt(ctx, msg, version); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
 
-				// self destruct the message after successful retrieval
-				s.messages.Delete(id)
+// recordFailedAttempt uses up an attempt for the wrong pin,
+// the message is destroyed after the last one.
+// It returns ErrMessageChanged if the message was saved since it was loaded.
+func (s *memMessageStore) recordFailedAttempt(ctx context.Context, msg *storage.Message, version any) error {
+	stored := msg.RecordFailedAttempt(ctx)
+	if !s.messages.CompareAndSwap(msg.PartitionKey, version, &stored) {
+		return storage.ErrMessageChanged
+	}
+	s.Notify(ctx, storage.EventFailed, &stored)
+	return nil
+}
 
-				return &msg, nil
-			}
+func (s *memMessageStore) storeMessage(msg storage.Message) {
+	s.messages.Store(msg.PartitionKey, &msg)
+}
 
-			msg.AttemptsRemaining -= 1
-			s.messages.Store(id, msg)
+func loadMessage(v any) (storage.Message, bool) {
+	if msg, ok := v.(*storage.Message); ok {
+		return *msg, true
+	}
+	return storage.Message{}, false
+}
 
-			// If the pin was wrong then start tracking attempts
-			if msg.AttemptsRemaining <= 0 {
-				s.messages.Delete(id)
-			}
-		} else {
-			// do not keep broken messages
+// getLiveMessage hides the tombstones and the expired messages
+// the sweeper might not have picked up yet
+func (s *memMessageStore) getLiveMessage(ctx context.Context, id string) (*storage.Message, error) {
+	msg, _, err := s.getLiveVersion(ctx, id)
+	return msg, err
+}
+
+// getLiveVersion is getLiveMessage that also returns the stored pointer,
+// saving with CompareAndSwap on it fails if the message was saved in the meantime
+func (s *memMessageStore) getLiveVersion(ctx context.Context, id string) (*storage.Message, any, error) {
+	v, ok := s.messages.Load(id)
+	if !ok {
+		return nil, nil, nil
+	}
+	msg, ok := loadMessage(v)
+	if !ok {
+		// do not keep broken messages
+		s.messages.Delete(id)
+		return nil, nil, fmt.Errorf("unexpected message type")
+	}
+	if msg.IsTombstone() {
+		if msg.IsExpired() {
 			s.messages.Delete(id)
-			return nil, fmt.Errorf("unexpected message type")
 		}
+		return nil, nil, nil
 	}
-	return nil, nil
+	if msg.IsExpired() {
+		msg.Expire(ctx)
+		s.storeMessage(msg)
+		s.Notify(ctx, storage.EventDestroyed, &msg)
+		return nil, nil, nil
+	}
+	return &msg, v, nil
+}
+
+func (s *memMessageStore) SetMessageLabels(ctx context.Context, id string, username string, title string, labels []string) (*storage.Message, error) {
+	msg, err := s.getLiveMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || msg.RowKey != username {
+		return nil, storage.ErrMessageNotFound
+	}
+	if err := msg.SetLabels(title, labels); err != nil {
+		return nil, err
+	}
+	s.storeMessage(*msg)
+	msg.Pin = ""
+	return msg, nil
+}
+
+func (s *memMessageStore) DeleteMessage(ctx context.Context, id string, username string) error {
+	if v, ok := s.messages.Load(id); ok {
+		if msg, ok := loadMessage(v); ok && msg.RowKey == username {
+			s.messages.Delete(id)
+			return nil
+		}
+	}
+	return storage.ErrMessageNotFound
+}
+
+func (s *memMessageStore) ResetMessagePin(ctx context.Context, id string, username string, oldPin string, content string) (*storage.Message, error) {
+	msg, version, err := s.getLiveVersion(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || msg.RowKey != username {
+		return nil, storage.ErrMessageNotFound
+	}
+	pin, err := msg.Rekey(s, s.salt, oldPin, content, s.pinPolicy)
+	if errors.Is(err, storage.ErrInvalidPin) {
+		if changed := s.recordFailedAttempt(ctx, msg, version); changed != nil {
+			return nil, changed
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the message read or destroyed in the meantime is not brought back
+	stored := *msg
+	if !s.messages.CompareAndSwap(id, version, &stored) {
+		return nil, storage.ErrMessageChanged
+	}
+	// temporarily show the new pin to the owner
+	msg.Pin = pin
+	return msg, nil
+}
+
+func (s *memMessageStore) UpdateMessage(ctx context.Context, id string, username string, content string, format storage.ContentFormat, pin string, room int64) (*storage.Message, error) {
+	msg, original, err := s.getLiveVersion(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || msg.RowKey != username {
+		return nil, storage.ErrMessageNotFound
+	}
+	// older messages were not measured when they were stored
+	msg.Measure()
+	before := msg.Size
+	newPin, err := msg.Edit(s, s.salt, content, format, pin, s.pinPolicy)
+	if errors.Is(err, storage.ErrInvalidPin) {
+		if changed := s.recordFailedAttempt(ctx, msg, original); changed != nil {
+			return nil, changed
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.CheckGrowth(before, msg.Size, room); err != nil {
+		return nil, err
+	}
+	// the message read or destroyed in the meantime is not brought back
+	stored := *msg
+	if !s.messages.CompareAndSwap(id, original, &stored) {
+		return nil, storage.ErrMessageChanged
+	}
+	// temporarily show the new pin to the owner
+	msg.Pin = newPin
+	return msg, nil
+}
+
+func (s *memMessageStore) GetUsage(ctx context.Context, username string) (*storage.Usage, error) {
+	usage := &storage.Usage{}
+	s.messages.Range(func(k, v any) bool {
+		if msg, ok := loadMessage(v); ok && msg.RowKey == username {
+			usage.Count(&msg)
+		}
+		return true
+	})
+	return usage, nil
+}
+
+func (s *memMessageStore) DeleteExpiredMessages(ctx context.Context) (int64, error) {
+	var count int64
+	s.messages.Range(func(k, v any) bool {
+		if msg, ok := loadMessage(v); ok && msg.IsExpired() {
+			if msg.IsTombstone() {
+				s.messages.Delete(k)
+			} else {
+				msg.Expire(ctx)
+				s.storeMessage(msg)
+				s.Notify(ctx, storage.EventDestroyed, &msg)
+			}
+			count++
+		}
+		return true
+	})
+	return count, nil
 }
@@ -2,19 +2,26 @@ package memstore_test
 
 import (
 	"context"
+	"errors"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
 	"github.com/ivarprudnikov/secretshare/internal/storage"
 	"github.com/ivarprudnikov/secretshare/internal/storage/memstore"
 )
 
 func TestMessageStore_GetMessage(t *testing.T) {
 	// Create a new MessageStore instance
-	store := memstore.NewMemMessageStore("12345678123456781234567812345678")
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
 
 	// Create a test message
 	content := "testcontent testcontent testcontent testcontent testcontent testcontent"
-	msg, err := store.AddMessage(context.Background(), content, "testuser")
+	msg, err := store.AddMessage(context.Background(), content, "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -46,17 +53,17 @@ func TestMessageStore_GetMessage(t *testing.T) {
 
 func TestMessageStore_GetFullMessage(t *testing.T) {
 	// Create a new MessageStore instance
-	store := memstore.NewMemMessageStore("12345678123456781234567812345678")
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
 
 	// Create a test message
 	content := "testcontent testcontent testcontent testcontent testcontent testcontent"
-	msg, err := store.AddMessage(context.Background(), content, "testuser")
+	msg, err := store.AddMessage(context.Background(), content, "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
 	// invalid Pin
-	foundMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, "foobar")
+	foundMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, "foobar", "")
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -65,7 +72,7 @@ func TestMessageStore_GetFullMessage(t *testing.T) {
 	}
 
 	// Get full message
-	foundMsg, err = store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin)
+	foundMsg, err = store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -76,23 +83,27 @@ func TestMessageStore_GetFullMessage(t *testing.T) {
 		t.Fatalf("Expected content %s, got %s", content, foundMsg.Content)
 	}
 
-	// Message was deleted after access
-	msgs, err := store.ListMessages(context.Background(), "testuser")
+	// Message was destroyed after access, only the tombstone is left
+	page, err := store.ListMessages(context.Background(), "testuser", storage.ListOptions{})
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
-	if len(msgs) != 0 {
-		t.Fatalf("Expected no messages, got %d", len(msgs))
+	msgs := page.Messages
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one tombstone, got %d", len(msgs))
+	}
+	if msgs[0].Status != storage.StatusRead || msgs[0].Content != "" || msgs[0].Pin != "" {
+		t.Fatalf("Expected a read tombstone without secrets, got %v", msgs[0])
 	}
 }
 
 func TestMessageStore_DeletedAfterFailedAttempts(t *testing.T) {
 	// Create a new MessageStore instance
-	store := memstore.NewMemMessageStore("12345678123456781234567812345678")
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
 
 	// Create a test message
 	content := "testcontent testcontent testcontent testcontent testcontent testcontent"
-	msg, err := store.AddMessage(context.Background(), content, "testuser")
+	msg, err := store.AddMessage(context.Background(), content, "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -105,7 +116,7 @@ func TestMessageStore_DeletedAfterFailedAttempts(t *testing.T) {
 
 	// invalid Pin
 	for range storage.MAX_PIN_ATTEMPTS {
-		store.GetFullMessage(context.Background(), msg.PartitionKey, "invalidpin")
+		store.GetFullMessage(context.Background(), msg.PartitionKey, "invalidpin", "")
 	}
 
 	goneMessage, _ := store.GetMessage(context.Background(), msg.PartitionKey)
@@ -117,7 +128,7 @@ func TestMessageStore_DeletedAfterFailedAttempts(t *testing.T) {
 func TestMessageStore_EncryptDecrypt(t *testing.T) {
 	// Create a new MessageStore instance
 	salt := "12345678123456781234567812345678"
-	store := memstore.NewMemMessageStore(salt)
+	store := memstore.NewMemMessageStore(salt, crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
 
 	message := "abc"
 	key := "pass"
@@ -133,3 +144,1034 @@ func TestMessageStore_EncryptDecrypt(t *testing.T) {
 		t.Fatalf("Decrypted content does not match original %s != %s", message, plaintext)
 	}
 }
+
+func TestMessageStore_ExpiredMessageIsGone(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	// Create a test message which expires almost immediately
+	content := "testcontent testcontent testcontent testcontent testcontent testcontent"
+	msg, err := store.AddMessage(context.Background(), content, "testuser", storage.MessageOptions{ExpiresIn: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	foundMsg, err := store.GetMessage(context.Background(), msg.PartitionKey)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if foundMsg != nil {
+		t.Fatalf("Expected expired message to be gone")
+	}
+
+	foundMsg, err = store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if foundMsg != nil {
+		t.Fatalf("Expected expired message not to be decrypted")
+	}
+}
+
+func TestMessageStore_DeleteExpiredMessages(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	_, err := store.AddMessage(context.Background(), "expiring", "testuser", storage.MessageOptions{ExpiresIn: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = store.AddMessage(context.Background(), "lasting", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	deleted, err := store.DeleteExpiredMessages(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if deleted != 1 {
+		t.Fatalf("Expected 1 deleted message, got %d", deleted)
+	}
+	total, _ := store.CountMessages(context.Background())
+	if total != 1 {
+		t.Fatalf("Expected 1 remaining message, got %d", total)
+	}
+}
+
+func TestMessageStore_MultipleViews(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	// Create a test message which can be read 3 times
+	content := "testcontent testcontent testcontent testcontent testcontent testcontent"
+	msg, err := store.AddMessage(context.Background(), content, "testuser", storage.MessageOptions{ExpiresIn: time.Hour, MaxViews: 3})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for i := 2; i >= 0; i-- {
+		foundMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if foundMsg == nil {
+			t.Fatalf("Expected message to be found, got nil")
+		}
+		if foundMsg.Content != content {
+			t.Fatalf("Expected content %s, got %s", content, foundMsg.Content)
+		}
+		if foundMsg.ViewsRemaining != i {
+			t.Fatalf("Expected %d remaining views, got %d", i, foundMsg.ViewsRemaining)
+		}
+	}
+
+	// Message was deleted after the last view
+	goneMessage, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if goneMessage != nil {
+		t.Fatalf("Expected the message to be deleted")
+	}
+}
+
+func TestMessageStore_Passphrase(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	content := "testcontent"
+	passphrase := "correct Horse battery staple"
+
+	_, err := store.AddMessage(context.Background(), content, "testuser", storage.MessageOptions{ExpiresIn: time.Hour, Passphrase: "weak"})
+	if err == nil {
+		t.Fatalf("Expected weak passphrase to be rejected")
+	}
+
+	msg, err := store.AddMessage(context.Background(), content, "testuser", storage.MessageOptions{ExpiresIn: time.Hour, Passphrase: passphrase})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if msg.Pin != "" {
+		t.Fatalf("Expected the passphrase not to be shown, got %s", msg.Pin)
+	}
+
+	foundMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, passphrase, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if foundMsg == nil || foundMsg.Content != content {
+		t.Fatalf("Expected message to be decrypted with the passphrase")
+	}
+}
+
+func TestMessageStore_DeleteMessage(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	msg, err := store.AddMessage(context.Background(), "testcontent", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Someone else cannot delete it
+	err = store.DeleteMessage(context.Background(), msg.PartitionKey, "otheruser")
+	if !errors.Is(err, storage.ErrMessageNotFound) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+	foundMsg, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if foundMsg == nil {
+		t.Fatalf("Expected message to be found, got nil")
+	}
+
+	// The owner can
+	err = store.DeleteMessage(context.Background(), msg.PartitionKey, "testuser")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	goneMessage, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if goneMessage != nil {
+		t.Fatalf("Expected the message to be deleted")
+	}
+
+	// Unknown message
+	err = store.DeleteMessage(context.Background(), msg.PartitionKey, "testuser")
+	if !errors.Is(err, storage.ErrMessageNotFound) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestMessageStore_ResetMessagePin(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	content := "testcontent"
+	msg, err := store.AddMessage(context.Background(), content, "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// burn one attempt
+	store.GetFullMessage(context.Background(), msg.PartitionKey, "invalidpin", "")
+
+	// Someone else cannot reset it
+	_, err = store.ResetMessagePin(context.Background(), msg.PartitionKey, "otheruser", msg.Pin, "")
+	if !errors.Is(err, storage.ErrMessageNotFound) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+
+	// Wrong old pin
+	_, err = store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", "invalidpin", "")
+	if !errors.Is(err, storage.ErrInvalidPin) {
+		t.Fatalf("Expected invalid pin error, got %v", err)
+	}
+
+	// Reset with the old pin
+	reset, err := store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", msg.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reset.PartitionKey != msg.PartitionKey {
+		t.Fatalf("Expected the same message id, got %s", reset.PartitionKey)
+	}
+	if reset.AttemptsRemaining != storage.MAX_PIN_ATTEMPTS {
+		t.Fatalf("Expected attempts to be reset, got %d", reset.AttemptsRemaining)
+	}
+
+	// Reset with the content
+	reset2, err := store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", "", "new content")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Previous pins no longer work
+	for _, pin := range []string{msg.Pin, reset.Pin} {
+		if pin == reset2.Pin {
+			continue
+		}
+		foundMsg, _ := store.GetFullMessage(context.Background(), msg.PartitionKey, pin, "")
+		if foundMsg != nil {
+			t.Fatalf("Expected old pin not to decrypt the message")
+		}
+	}
+
+	foundMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, reset2.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if foundMsg == nil || foundMsg.Content != "new content" {
+		t.Fatalf("Expected message to be decrypted with the new pin")
+	}
+}
+
+func TestMessageStore_ResetMessagePinAttempts(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	msg, err := store.AddMessage(context.Background(), "testcontent", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// A wrong old pin uses up an attempt
+	_, err = store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", "invalidpin", "")
+	if !errors.Is(err, storage.ErrInvalidPin) {
+		t.Fatalf("Expected invalid pin error, got %v", err)
+	}
+	foundMsg, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if foundMsg == nil || foundMsg.AttemptsRemaining != storage.MAX_PIN_ATTEMPTS-1 {
+		t.Fatalf("Expected an attempt to be used up, got %v", foundMsg)
+	}
+
+	// The owner cannot keep guessing
+	for range storage.MAX_PIN_ATTEMPTS - 1 {
+		store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", "invalidpin", "")
+	}
+	goneMessage, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if goneMessage != nil {
+		t.Fatalf("Expected the message to be deleted")
+	}
+	_, err = store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", msg.Pin, "")
+	if !errors.Is(err, storage.ErrMessageNotFound) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestMessageStore_ResetMessagePinWhileRead(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	for range 5 {
+		msg, err := store.AddMessage(context.Background(), "testcontent", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		var wg sync.WaitGroup
+		var read *storage.Message
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			read, _ = store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+		}()
+		go func() {
+			defer wg.Done()
+			store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", "", "newcontent")
+		}()
+		wg.Wait()
+
+		// The read fails with the old pin after the reset,
+		// but the reset never brings the read message back
+		if read == nil {
+			continue
+		}
+		if found, _ := store.GetMessage(context.Background(), msg.PartitionKey); found != nil {
+			t.Fatalf("Expected the read message to stay a tombstone")
+		}
+	}
+}
+
+func TestMessageStore_Attachments(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	file := storage.Attachment{Name: "kubeconfig.yaml", Type: "application/yaml", Data: []byte("apiVersion: v1")}
+	msg, err := store.AddMessage(context.Background(), "testcontent", "testuser", storage.MessageOptions{
+		ExpiresIn:   time.Hour,
+		MaxViews:    2,
+		Attachments: []storage.Attachment{file},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Encrypted message does not reveal the files
+	foundMsg, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if foundMsg.Attachments == "" || len(foundMsg.Files) != 0 {
+		t.Fatalf("Expected only encrypted attachments")
+	}
+	if strings.Contains(foundMsg.Attachments, "kubeconfig") {
+		t.Fatalf("Expected file name to be encrypted")
+	}
+
+	// Files survive the pin reset
+	reset, err := store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", msg.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", "", "new content")
+	if err == nil {
+		t.Fatalf("Expected reset without the old pin to fail when there are files")
+	}
+
+	fullMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, reset.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(fullMsg.Files) != 1 {
+		t.Fatalf("Expected 1 file, got %d", len(fullMsg.Files))
+	}
+	if fullMsg.Files[0].Name != file.Name || fullMsg.Files[0].Type != file.Type || string(fullMsg.Files[0].Data) != string(file.Data) {
+		t.Fatalf("Unexpected file %v", fullMsg.Files[0])
+	}
+
+	// Decrypted files are not kept in the store
+	foundMsg, _ = store.GetMessage(context.Background(), msg.PartitionKey)
+	if len(foundMsg.Files) != 0 {
+		t.Fatalf("Expected decrypted files not to be stored")
+	}
+}
+
+func TestMessageStore_ResetPinOfAttachmentsOnly(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	file := storage.Attachment{Name: "id_ed25519", Type: "application/octet-stream", Data: []byte("private key")}
+	msg, err := store.AddMessage(context.Background(), "", "testuser", storage.MessageOptions{
+		ExpiresIn:   time.Hour,
+		Attachments: []storage.Attachment{file},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	reset, err := store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", msg.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	fullMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, reset.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if fullMsg == nil || fullMsg.Content != "" || len(fullMsg.Files) != 1 {
+		t.Fatalf("Expected only the file to be kept, got %v", fullMsg)
+	}
+}
+
+func TestMessageStore_AddEncryptedMessage(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	ciphertext := "opaque-ciphertext"
+	verifier := "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"
+
+	_, err := store.AddEncryptedMessage(context.Background(), ciphertext, verifier, "testuser", storage.MessageOptions{
+		ExpiresIn:   time.Hour,
+		Attachments: []storage.Attachment{{Name: "file.txt"}},
+	})
+	if err == nil {
+		t.Fatalf("Expected attachments not to be supported")
+	}
+
+	msg, err := store.AddEncryptedMessage(context.Background(), ciphertext, verifier, "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !msg.ClientEncrypted {
+		t.Fatalf("Expected message to be marked as encrypted in the browser")
+	}
+
+	// Pin cannot be reset as the server does not know the key
+	_, err = store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", verifier, "")
+	if err == nil {
+		t.Fatalf("Expected pin reset to fail")
+	}
+
+	// invalid verifier burns an attempt
+	foundMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, "invalid", "")
+	if err != nil || foundMsg != nil {
+		t.Fatalf("Expected no message and no error, got %v %v", foundMsg, err)
+	}
+	foundMsg, _ = store.GetMessage(context.Background(), msg.PartitionKey)
+	if foundMsg.AttemptsRemaining != storage.MAX_PIN_ATTEMPTS-1 {
+		t.Fatalf("Expected attempt to be tracked, got %d", foundMsg.AttemptsRemaining)
+	}
+
+	// ciphertext is returned as it was stored
+	foundMsg, err = store.GetFullMessage(context.Background(), msg.PartitionKey, verifier, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if foundMsg == nil || foundMsg.Content != ciphertext {
+		t.Fatalf("Expected the stored ciphertext, got %v", foundMsg)
+	}
+
+	// read once
+	goneMessage, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if goneMessage != nil {
+		t.Fatalf("Expected the message to be deleted")
+	}
+}
+
+func TestMessageStore_Recipients(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	msg, err := store.AddMessage(context.Background(), "foobar", "testuser", storage.MessageOptions{
+		ExpiresIn:  time.Hour,
+		Recipients: []string{"alice", "bob"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// only recipients see the message in their inbox
+	inbox, err := store.ListInbox(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(inbox) != 1 || inbox[0].PartitionKey != msg.PartitionKey {
+		t.Fatalf("Expected message in the inbox, got %v", inbox)
+	}
+	inbox, _ = store.ListInbox(context.Background(), "testuser")
+	if len(inbox) != 0 {
+		t.Fatalf("Expected empty inbox, got %v", inbox)
+	}
+
+	// other users cannot open it even with the correct pin
+	for _, username := range []string{"", "testuser", "mallory"} {
+		foundMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, username)
+		if !errors.Is(err, storage.ErrNotRecipient) {
+			t.Fatalf("Expected not recipient error, got %v", err)
+		}
+		if foundMsg != nil {
+			t.Fatalf("Expected no message for %s", username)
+		}
+	}
+	foundMsg, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if foundMsg.AttemptsRemaining != storage.MAX_PIN_ATTEMPTS {
+		t.Fatalf("Expected attempts not to be consumed, got %d", foundMsg.AttemptsRemaining)
+	}
+
+	foundMsg, err = store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "bob")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if foundMsg == nil || foundMsg.Content != "foobar" {
+		t.Fatalf("Expected the recipient to read the message, got %v", foundMsg)
+	}
+}
+
+func TestMessageStore_History(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	msg, err := store.AddMessage(context.Background(), "foobar", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx := storage.WithClientFingerprint(context.Background(), "Firefox on Linux")
+	for range storage.MAX_PIN_ATTEMPTS {
+		store.GetFullMessage(ctx, msg.PartitionKey, "invalidpin", "")
+	}
+
+	// the correct pin does not work on a tombstone
+	foundMsg, err := store.GetFullMessage(ctx, msg.PartitionKey, msg.Pin, "")
+	if err != nil || foundMsg != nil {
+		t.Fatalf("Expected no message and no error, got %v %v", foundMsg, err)
+	}
+	total, _ := store.CountMessages(context.Background())
+	if total != 0 {
+		t.Fatalf("Expected tombstones not to be counted, got %d", total)
+	}
+
+	page, _ := store.ListMessages(context.Background(), "testuser", storage.ListOptions{})
+	msgs := page.Messages
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one tombstone, got %d", len(msgs))
+	}
+	tombstone := msgs[0]
+	if tombstone.Status != storage.StatusDestroyed {
+		t.Fatalf("Expected destroyed status, got %s", tombstone.Status)
+	}
+	if tombstone.StatusText() != "Destroyed after 5 failed attempts" {
+		t.Fatalf("Unexpected status text %s", tombstone.StatusText())
+	}
+	history := tombstone.History()
+	if len(history) != storage.MAX_PIN_ATTEMPTS+1 {
+		t.Fatalf("Expected creation and failed attempts in history, got %v", history)
+	}
+	if history[0].Type != storage.EventCreated || history[1].Type != storage.EventFailed {
+		t.Fatalf("Unexpected history %v", history)
+	}
+	if history[1].Fingerprint != "Firefox on Linux" {
+		t.Fatalf("Expected fingerprint to be recorded, got %s", history[1].Fingerprint)
+	}
+
+	// owner can remove the tombstone
+	err = store.DeleteMessage(context.Background(), msg.PartitionKey, "testuser")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	page, _ = store.ListMessages(context.Background(), "testuser", storage.ListOptions{})
+	msgs = page.Messages
+	if len(msgs) != 0 {
+		t.Fatalf("Expected no messages, got %d", len(msgs))
+	}
+}
+
+func TestMessageStore_Labels(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	msg, err := store.AddMessage(context.Background(), "foobar", "testuser", storage.MessageOptions{ExpiresIn: time.Hour, Title: "VPN for Bob", Labels: []string{"vpn", "work"}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	other, err := store.AddMessage(context.Background(), "foobar", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	page, _ := store.ListMessages(context.Background(), "testuser", storage.ListOptions{Label: "vpn"})
+	msgs := page.Messages
+	if len(msgs) != 1 || msgs[0].PartitionKey != msg.PartitionKey || msgs[0].Title != "VPN for Bob" {
+		t.Fatalf("Expected only the labelled message, got %v", msgs)
+	}
+
+	_, err = store.SetMessageLabels(context.Background(), other.PartitionKey, "otheruser", "stolen", nil)
+	if !errors.Is(err, storage.ErrMessageNotFound) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+	_, err = store.SetMessageLabels(context.Background(), other.PartitionKey, "testuser", "DB password", []string{"work"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	page, _ = store.ListMessages(context.Background(), "testuser", storage.ListOptions{Label: "work"})
+	msgs = page.Messages
+	if len(msgs) != 2 {
+		t.Fatalf("Expected both messages, got %d", len(msgs))
+	}
+
+	// the recipient never sees the owner details
+	shown, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if shown.Title != "" || shown.Labels != "" {
+		t.Fatalf("Expected owner details to be hidden, got %v", shown)
+	}
+	read, _ := store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+	if read.Title != "" || read.Labels != "" {
+		t.Fatalf("Expected owner details to be hidden, got %v", read)
+	}
+}
+
+func TestMessageStore_Pages(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	var created []string
+	for i := range 5 {
+		msg, err := store.AddMessage(context.Background(), "foobar", "testuser", storage.MessageOptions{ExpiresIn: time.Duration(i+1) * time.Hour})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		created = append(created, msg.PartitionKey)
+		if i == 0 {
+			store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+		}
+	}
+
+	for _, sortBy := range []string{storage.SortByID, storage.SortByNewest, storage.SortByExpiry} {
+		var seen []string
+		opts := storage.ListOptions{Limit: 2, SortBy: sortBy}
+		for {
+			page, err := store.ListMessages(context.Background(), "testuser", opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(page.Messages) > 2 {
+				t.Fatalf("Expected at most 2 messages, got %d", len(page.Messages))
+			}
+			for _, msg := range page.Messages {
+				seen = append(seen, msg.PartitionKey)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+		if len(seen) != 5 {
+			t.Fatalf("Expected all messages once sorted by %q, got %v", sortBy, seen)
+		}
+		// the tombstone is kept the longest
+		if sortBy == storage.SortByExpiry && (seen[0] != created[1] || seen[4] != created[0]) {
+			t.Fatalf("Expected messages expiring first, got %v", seen)
+		}
+	}
+
+	page, _ := store.ListMessages(context.Background(), "testuser", storage.ListOptions{Status: storage.ListStatusActive})
+	if len(page.Messages) != 4 {
+		t.Fatalf("Expected 4 active messages, got %d", len(page.Messages))
+	}
+	page, _ = store.ListMessages(context.Background(), "testuser", storage.ListOptions{Status: storage.StatusRead})
+	if len(page.Messages) != 1 || page.Messages[0].PartitionKey != created[0] {
+		t.Fatalf("Expected the read message, got %v", page.Messages)
+	}
+
+	page, _ = store.ListMessages(context.Background(), "testuser", storage.ListOptions{Limit: 2})
+	_, err := store.ListMessages(context.Background(), "testuser", storage.ListOptions{Limit: 2, SortBy: storage.SortByNewest, Cursor: page.NextCursor})
+	if !errors.Is(err, storage.ErrInvalidCursor) {
+		t.Fatalf("Expected the cursor of another sort order to fail, got %v", err)
+	}
+	_, err = store.ListMessages(context.Background(), "testuser", storage.ListOptions{SortBy: "size"})
+	if err == nil {
+		t.Fatalf("Expected unsupported sort order to fail")
+	}
+}
+
+func TestMessageStore_RandomIDs(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.IDPolicy{Encoding: crypto.IDBase32, Length: 20})
+
+	first, err := store.AddMessage(context.Background(), "foobar", "testuser", storage.MessageOptions{ExpiresIn: time.Hour, Passphrase: "Correct-Horse-1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	second, err := store.AddEncryptedMessage(context.Background(), "ciphertext", "verifier", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	third, err := store.AddEncryptedMessage(context.Background(), "ciphertext", "verifier", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	re := regexp.MustCompile(`^[a-z2-7]{20}$`)
+	for _, msg := range []*storage.Message{first, second, third} {
+		if !re.MatchString(msg.PartitionKey) {
+			t.Fatalf("Unexpected id %s", msg.PartitionKey)
+		}
+	}
+	if second.PartitionKey == third.PartitionKey {
+		t.Fatalf("Expected the same ciphertext to get different ids")
+	}
+}
+
+func TestMessageStore_NotBefore(t *testing.T) {
+	// Create a new MessageStore instance
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	msg, err := store.AddMessage(context.Background(), "foobar", "testuser", storage.MessageOptions{ExpiresIn: time.Hour, NotBefore: time.Now().Add(2 * time.Second)})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// neither the right nor the wrong pin is checked while locked
+	for _, pin := range []string{msg.Pin, "invalidpin", "invalidpin", "invalidpin", "invalidpin", "invalidpin"} {
+		_, err = store.GetFullMessage(context.Background(), msg.PartitionKey, pin, "")
+		if !errors.Is(err, storage.ErrMessageLocked) {
+			t.Fatalf("Expected locked error, got %v", err)
+		}
+	}
+	locked, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if locked.AttemptsRemaining != storage.MAX_PIN_ATTEMPTS || !locked.IsLocked() {
+		t.Fatalf("Expected attempts to be kept while locked, got %d", locked.AttemptsRemaining)
+	}
+
+	time.Sleep(time.Until(time.Time(locked.NotBefore)) + 10*time.Millisecond)
+	foundMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if foundMsg == nil || foundMsg.Content != "foobar" {
+		t.Fatalf("Expected the message to unlock, got %v", foundMsg)
+	}
+}
+
+func TestMessageStore_Format(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	_, err := store.AddMessage(context.Background(), "testcontent", "testuser", storage.MessageOptions{
+		ExpiresIn: time.Hour,
+		Format:    storage.ContentFormat{Type: storage.FormatCode, Language: "<script>"},
+	})
+	if err == nil {
+		t.Fatalf("Expected invalid language to fail")
+	}
+
+	format := storage.ContentFormat{Type: storage.FormatCode, Language: "yaml"}
+	msg, err := store.AddMessage(context.Background(), "apiVersion: v1", "testuser", storage.MessageOptions{
+		ExpiresIn: time.Hour,
+		MaxViews:  2,
+		Format:    format,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Encrypted message does not reveal the type
+	foundMsg, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if foundMsg.Format == "" || strings.Contains(foundMsg.Format, "yaml") {
+		t.Fatalf("Expected the format to be encrypted")
+	}
+
+	// Format survives the pin reset
+	reset, err := store.ResetMessagePin(context.Background(), msg.PartitionKey, "testuser", msg.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	fullMsg, err := store.GetFullMessage(context.Background(), msg.PartitionKey, reset.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if fullMsg.ContentFormat != format {
+		t.Fatalf("Expected format %v, got %v", format, fullMsg.ContentFormat)
+	}
+	if fullMsg.ContentFormat.FileName() != "message.yaml" {
+		t.Fatalf("Unexpected file name %s", fullMsg.ContentFormat.FileName())
+	}
+}
+
+func TestMessageStore_UpdateMessage(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+	msg, err := store.AddMessage(context.Background(), "typo", "testuser", storage.MessageOptions{ExpiresIn: time.Hour, MaxViews: 2})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	id, pin := msg.PartitionKey, msg.Pin
+
+	// Only the owner can edit
+	if _, err := store.UpdateMessage(context.Background(), id, "other", "fixed", storage.ContentFormat{}, "", math.MaxInt64); !errors.Is(err, storage.ErrMessageNotFound) {
+		t.Fatalf("Expected ErrMessageNotFound, got %v", err)
+	}
+	if _, err := store.UpdateMessage(context.Background(), id, "testuser", "fixed", storage.ContentFormat{}, "wrong", math.MaxInt64); !errors.Is(err, storage.ErrInvalidPin) {
+		t.Fatalf("Expected ErrInvalidPin, got %v", err)
+	}
+
+	// The edit cannot grow the message past the room left in the quota
+	if _, err := store.UpdateMessage(context.Background(), id, "testuser", "fixed typo", storage.ContentFormat{}, pin, 8); !errors.Is(err, storage.ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+	}
+
+	// A failed attempt is reset by the edit
+	if failed, _ := store.GetFullMessage(context.Background(), id, "wrong", ""); failed != nil {
+		t.Fatalf("Expected the wrong pin to fail")
+	}
+
+	// The existing pin is kept when re-entered
+	updated, err := store.UpdateMessage(context.Background(), id, "testuser", "fixed", storage.ContentFormat{Type: storage.FormatPre}, pin, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if updated.PartitionKey != id || updated.Pin != "" {
+		t.Fatalf("Expected the same id and no new pin, got %s %s", updated.PartitionKey, updated.Pin)
+	}
+	if updated.AttemptsRemaining != storage.MAX_PIN_ATTEMPTS {
+		t.Fatalf("Expected the attempts to be reset, got %d", updated.AttemptsRemaining)
+	}
+
+	// Otherwise a new pin is generated and the old one stops working
+	updated, err = store.UpdateMessage(context.Background(), id, "testuser", "fixed again", storage.ContentFormat{}, "", math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if updated.Pin == "" || updated.Pin == pin {
+		t.Fatalf("Expected a new pin")
+	}
+	if old, _ := store.GetFullMessage(context.Background(), id, pin, ""); old != nil {
+		t.Fatalf("Expected the old pin to stop working")
+	}
+	fullMsg, err := store.GetFullMessage(context.Background(), id, updated.Pin, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if fullMsg.Content != "fixed again" {
+		t.Fatalf("Expected the edited content, got %s", fullMsg.Content)
+	}
+
+	// Read messages can no longer be edited
+	if _, err := store.UpdateMessage(context.Background(), id, "testuser", "too late", storage.ContentFormat{}, "", math.MaxInt64); !errors.Is(err, storage.ErrMessageOpened) {
+		t.Fatalf("Expected ErrMessageOpened, got %v", err)
+	}
+}
+
+func TestMessageStore_UpdateMessageAttempts(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+	msg, err := store.AddMessage(context.Background(), "typo", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The owner cannot keep guessing the pin
+	for range storage.MAX_PIN_ATTEMPTS {
+		if _, err := store.UpdateMessage(context.Background(), msg.PartitionKey, "testuser", "fixed", storage.ContentFormat{}, "wrong", math.MaxInt64); !errors.Is(err, storage.ErrInvalidPin) {
+			t.Fatalf("Expected ErrInvalidPin, got %v", err)
+		}
+	}
+	goneMessage, _ := store.GetMessage(context.Background(), msg.PartitionKey)
+	if goneMessage != nil {
+		t.Fatalf("Expected the message to be deleted")
+	}
+}
+
+func TestMessageStore_UpdateMessageWhileRead(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	for range 50 {
+		msg, err := store.AddMessage(context.Background(), "typo", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		var wg sync.WaitGroup
+		var read *storage.Message
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			read, _ = store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+		}()
+		go func() {
+			defer wg.Done()
+			store.UpdateMessage(context.Background(), msg.PartitionKey, "testuser", "fixed", storage.ContentFormat{}, msg.Pin, math.MaxInt64)
+		}()
+		wg.Wait()
+
+		// The edit never brings the read message back
+		if read == nil {
+			t.Fatalf("Expected the message to be read")
+		}
+		if found, _ := store.GetMessage(context.Background(), msg.PartitionKey); found != nil {
+			t.Fatalf("Expected the read message to stay a tombstone")
+		}
+	}
+}
+
+func TestMessageStore_ParallelReads(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	for range 5 {
+		msg, err := store.AddMessage(context.Background(), "testcontent", "testuser", storage.MessageOptions{ExpiresIn: time.Hour, MaxViews: 1})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		reads := 0
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				read, _ := store.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+				if read != nil {
+					mu.Lock()
+					reads++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		// The single view is given out once
+		if reads != 1 {
+			t.Fatalf("Expected the message to be read once, got %d", reads)
+		}
+	}
+}
+
+func TestMessageStore_ParallelFailedAttempts(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	for range 5 {
+		msg, err := store.AddMessage(context.Background(), "testcontent", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		var wg sync.WaitGroup
+		for range storage.MAX_PIN_ATTEMPTS {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// the attempt refused as changed has not been counted
+				for {
+					_, err := store.GetFullMessage(context.Background(), msg.PartitionKey, "invalidpin", "")
+					if !errors.Is(err, storage.ErrMessageChanged) {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		// None of the parallel attempts is lost
+		if found, _ := store.GetMessage(context.Background(), msg.PartitionKey); found != nil {
+			t.Fatalf("Expected the message to be destroyed after %d attempts", storage.MAX_PIN_ATTEMPTS)
+		}
+	}
+}
+
+type recordingListener struct {
+	events []storage.LifecycleEvent
+}
+
+func (l *recordingListener) MessageChanged(ctx context.Context, event storage.LifecycleEvent) {
+	l.events = append(l.events, event)
+}
+
+func TestMessageStore_AddMessages(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+	listener := &recordingListener{}
+	store.Subscribe(listener)
+
+	msgs, err := storage.AddMessages(context.Background(), store, "testuser", []storage.BulkMessage{
+		{Text: "first", Options: storage.MessageOptions{ExpiresIn: time.Hour, Labels: []string{"contractors"}}},
+		{Text: "second", Options: storage.MessageOptions{ExpiresIn: time.Hour}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].Pin == "" || msgs[1].Pin == "" {
+		t.Fatalf("Expected 2 messages with their pins")
+	}
+	if len(listener.events) != 2 {
+		t.Fatalf("Expected 2 created events, got %d", len(listener.events))
+	}
+
+	// A failed message removes the ones created before it
+	_, err = storage.AddMessages(context.Background(), store, "other", []storage.BulkMessage{
+		{Text: "first", Options: storage.MessageOptions{ExpiresIn: time.Hour}},
+		{Text: "second", Options: storage.MessageOptions{ExpiresIn: time.Hour, MaxViews: storage.MAX_MESSAGE_VIEWS + 1}},
+	})
+	if err == nil {
+		t.Fatalf("Expected the invalid message to fail")
+	}
+	page, err := store.ListMessages(context.Background(), "other", storage.ListOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(page.Messages) != 0 {
+		t.Fatalf("Expected no messages to be left, got %d", len(page.Messages))
+	}
+	if len(listener.events) != 2 {
+		t.Fatalf("Expected no events about the removed messages, got %d", len(listener.events)-2)
+	}
+}
+
+func TestMessageStore_GetUsage(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+	first, err := store.AddMessage(context.Background(), "first", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = store.AddMessage(context.Background(), "second", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = store.AddMessage(context.Background(), "other", "other", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	usage, err := store.GetUsage(context.Background(), "testuser")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	estimated := storage.EstimateSize(len("first"), storage.MessageOptions{}) + storage.EstimateSize(len("second"), storage.MessageOptions{})
+	if usage.ActiveMessages != 2 || usage.StoredBytes != estimated {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+
+	// The read message is not active anymore
+	if _, err := store.GetFullMessage(context.Background(), first.PartitionKey, first.Pin, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	read, err := store.GetUsage(context.Background(), "testuser")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if read.ActiveMessages != 1 || read.StoredBytes >= usage.StoredBytes {
+		t.Fatalf("Unexpected usage after the read %v", read)
+	}
+}
+
+func TestMessageStore_BatchCopies(t *testing.T) {
+	store := memstore.NewMemMessageStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	copies := map[string][]string{"batch": {"alice", "bob", "carol"}, "other": {"dave", "erin"}}
+	for batchID, names := range copies {
+		for _, name := range names {
+			_, err := store.AddMessage(context.Background(), "testcontent", "testuser", storage.MessageOptions{ExpiresIn: time.Hour, BatchID: batchID, CopyFor: name})
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		}
+	}
+	if _, err := store.AddMessage(context.Background(), "testcontent", "testuser", storage.MessageOptions{ExpiresIn: time.Hour}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Every page shows the whole batch
+	opts := storage.ListOptions{SortBy: storage.SortByID, Limit: 1}
+	for {
+		page, err := store.ListMessages(context.Background(), "testuser", opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		batches, err := storage.BatchCopies(context.Background(), store, "testuser", page.Messages)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if page.Messages[0].BatchID == "" {
+			if len(batches) != 0 {
+				t.Fatalf("Expected no batch, got %v", batches)
+			}
+		} else if batchID := page.Messages[0].BatchID; len(batches) != 1 || batches[batchID] == nil || len(batches[batchID].Names()) != len(copies[batchID]) {
+			t.Fatalf("Expected all the copies of %s, got %v", batchID, batches)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
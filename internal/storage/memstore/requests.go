@@ -0,0 +1,134 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+type memRequestStore struct {
+	crypto.EntityEncryptHelper
+	// guards the answer and the attempts from the concurrent visitors
+	mu        sync.Mutex
+	requests  map[string]storage.SecretRequest
+	salt      string
+	pinPolicy crypto.PinPolicy
+	idPolicy  crypto.IDPolicy
+}
+
+func NewMemRequestStore(salt string, pinPolicy crypto.PinPolicy, idPolicy crypto.IDPolicy) storage.RequestStore {
+	return &memRequestStore{requests: map[string]storage.SecretRequest{}, salt: salt, pinPolicy: pinPolicy, idPolicy: idPolicy}
+}
+
+func (s *memRequestStore) AddRequest(ctx context.Context, username string, description string, expiresIn time.Duration) (*storage.SecretRequest, error) {
+	pin, err := crypto.MakePin(s.pinPolicy)
+	if err != nil {
+		return nil, err
+	}
+	id, err := crypto.MakeID(s.idPolicy)
+	if err != nil {
+		return nil, err
+	}
+	req, err := storage.NewSecretRequest(id, username, description, expiresIn, pin, s, s.salt)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.requests[id]; ok {
+		return nil, storage.ErrIDCollision
+	}
+	s.requests[id] = req
+	// temporarily show the pin to the owner
+	req.Pin = pin
+	return &req, nil
+}
+
+func (s *memRequestStore) GetRequest(ctx context.Context, id string) (*storage.SecretRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req, ok := s.requests[id]
+	if !ok || req.IsExpired() || req.IsAnswered() {
+		return nil, nil
+	}
+	return &req, nil
+}
+
+func (s *memRequestStore) ListRequests(ctx context.Context, username string) ([]*storage.SecretRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var reqs []*storage.SecretRequest
+	for _, req := range s.requests {
+		if req.RowKey == username && !req.IsExpired() {
+			reqs = append(reqs, &req)
+		}
+	}
+	return reqs, nil
+}
+
+func (s *memRequestStore) SubmitSecret(ctx context.Context, id string, text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req, ok := s.requests[id]
+	if !ok || req.IsExpired() {
+		return storage.ErrRequestNotFound
+	}
+	if err := req.Answer(text); err != nil {
+		return err
+	}
+	s.requests[id] = req
+	return nil
+}
+
+func (s *memRequestStore) OpenSecret(ctx context.Context, id string, username string, pin string) (*storage.SecretRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req, ok := s.requests[id]
+	if !ok || req.RowKey != username || req.IsExpired() {
+		return nil, storage.ErrRequestNotFound
+	}
+	text, err := req.Open(s, s.salt, pin)
+	if errors.Is(err, storage.ErrInvalidPin) {
+		req.AttemptsRemaining -= 1
+		if req.AttemptsRemaining <= 0 {
+			delete(s.requests, id)
+		} else {
+			s.requests[id] = req
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the secret is read once
+	delete(s.requests, id)
+	req.Content = text
+	return &req, nil
+}
+
+func (s *memRequestStore) DeleteRequest(ctx context.Context, id string, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req, ok := s.requests[id]; ok && req.RowKey == username {
+		delete(s.requests, id)
+		return nil
+	}
+	return storage.ErrRequestNotFound
+}
+
+func (s *memRequestStore) DeleteExpiredRequests(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int64
+	for id, req := range s.requests {
+		if req.IsExpired() {
+			delete(s.requests, id)
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,83 @@
+package memstore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+	"github.com/ivarprudnikov/secretshare/internal/storage/memstore"
+)
+
+func TestRequestStore_SubmitAndOpen(t *testing.T) {
+	// Create a new RequestStore instance
+	store := memstore.NewMemRequestStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	req, err := store.AddRequest(context.Background(), "testuser", "The staging API key", time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if req.Pin == "" {
+		t.Fatalf("Expected the pin to be shown to the owner")
+	}
+
+	found, err := store.GetRequest(context.Background(), req.ID())
+	if err != nil || found == nil || found.Description != "The staging API key" {
+		t.Fatalf("Expected the request, got %v %v", found, err)
+	}
+
+	err = store.SubmitSecret(context.Background(), req.ID(), "sk_test_123")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	err = store.SubmitSecret(context.Background(), req.ID(), "overwrite")
+	if !errors.Is(err, storage.ErrRequestAnswered) {
+		t.Fatalf("Expected the request to accept one secret, got %v", err)
+	}
+	found, _ = store.GetRequest(context.Background(), req.ID())
+	if found != nil {
+		t.Fatalf("Expected the answered request to be hidden from the visitors")
+	}
+
+	reqs, _ := store.ListRequests(context.Background(), "testuser")
+	if len(reqs) != 1 || !reqs[0].IsAnswered() || reqs[0].Content == "sk_test_123" {
+		t.Fatalf("Expected the answered request with the sealed secret, got %v", reqs)
+	}
+
+	_, err = store.OpenSecret(context.Background(), req.ID(), "otheruser", req.Pin)
+	if !errors.Is(err, storage.ErrRequestNotFound) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+	opened, err := store.OpenSecret(context.Background(), req.ID(), "testuser", req.Pin)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if opened.Content != "sk_test_123" {
+		t.Fatalf("Expected the secret, got %s", opened.Content)
+	}
+	reqs, _ = store.ListRequests(context.Background(), "testuser")
+	if len(reqs) != 0 {
+		t.Fatalf("Expected the request to be deleted once opened, got %d", len(reqs))
+	}
+}
+
+func TestRequestStore_FailedAttempts(t *testing.T) {
+	// Create a new RequestStore instance
+	store := memstore.NewMemRequestStore("12345678123456781234567812345678", crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+
+	req, _ := store.AddRequest(context.Background(), "testuser", "", time.Hour)
+	store.SubmitSecret(context.Background(), req.ID(), "sk_test_123")
+
+	for range storage.MAX_PIN_ATTEMPTS {
+		_, err := store.OpenSecret(context.Background(), req.ID(), "testuser", "invalidpin")
+		if !errors.Is(err, storage.ErrInvalidPin) {
+			t.Fatalf("Expected invalid pin error, got %v", err)
+		}
+	}
+	_, err := store.OpenSecret(context.Background(), req.ID(), "testuser", req.Pin)
+	if !errors.Is(err, storage.ErrRequestNotFound) {
+		t.Fatalf("Expected the request to be deleted after failed attempts, got %v", err)
+	}
+}
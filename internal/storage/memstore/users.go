@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/ivarprudnikov/secretshare/internal/crypto"
 	"github.com/ivarprudnikov/secretshare/internal/storage"
@@ -58,3 +59,52 @@ func (u *memUserStore) GetUserWithPass(ctx context.Context, username string, pas
 	}
 	return nil, nil
 }
+
+func (u *memUserStore) SetUserEmail(ctx context.Context, username string, email string) error {
+	if v, ok := u.users.Load(username); ok {
+		if usr, ok := v.(storage.User); ok {
+			usr.Email = email
+			u.users.Store(username, usr)
+			return nil
+		}
+	}
+	return errors.New("user not found")
+}
+
+func (u *memUserStore) SetUserQuota(ctx context.Context, username string, quota *storage.Quota) error {
+	encoded, err := storage.EncodeQuota(quota)
+	if err != nil {
+		return err
+	}
+	if v, ok := u.users.Load(username); ok {
+		if usr, ok := v.(storage.User); ok {
+			usr.Quota = encoded
+			u.users.Store(username, usr)
+			return nil
+		}
+	}
+	return errors.New("user not found")
+}
+
+func (u *memUserStore) AddCreatedMessages(ctx context.Context, username string, messages int) error {
+	for {
+		v, ok := u.users.Load(username)
+		if !ok {
+			return errors.New("user not found")
+		}
+		usr, ok := v.(storage.User)
+		if !ok {
+			return errors.New("user not found")
+		}
+		updated := usr
+		created, err := usr.CountCreated(time.Now(), messages)
+		if err != nil {
+			return err
+		}
+		updated.Created = created
+		// the count of another request is not lost
+		if u.users.CompareAndSwap(username, usr, updated) {
+			return nil
+		}
+	}
+}
@@ -3,6 +3,7 @@ package memstore_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/ivarprudnikov/secretshare/internal/storage"
 	"github.com/ivarprudnikov/secretshare/internal/storage/memstore"
@@ -50,3 +51,69 @@ func TestUserStore_GetUserWithPass(t *testing.T) {
 		t.Fatalf("Expected user to be nil, got %v", foundUser)
 	}
 }
+
+func TestUserStore_SetUserEmail(t *testing.T) {
+	// Create a new UserStore instance
+	store := memstore.NewMemUserStore("123")
+	store.AddUser(context.Background(), "testuser", "testpassword", []string{})
+
+	err := store.SetUserEmail(context.Background(), "testuser", "test@example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	foundUser, _ := store.GetUser(context.Background(), "testuser")
+	if foundUser.Email != "test@example.com" {
+		t.Fatalf("Expected email to be set, got %s", foundUser.Email)
+	}
+
+	err = store.SetUserEmail(context.Background(), "unknown", "test@example.com")
+	if err == nil {
+		t.Fatalf("Expected error for unknown user")
+	}
+}
+
+func TestUserStore_SetUserQuota(t *testing.T) {
+	store := memstore.NewMemUserStore("123")
+	store.AddUser(context.Background(), "testuser", "testpassword", nil)
+	defaults := storage.Quota{ActiveMessages: 1}
+
+	quota := storage.Quota{ActiveMessages: 5, StoredBytes: 10, DailyMessages: 2}
+	if err := store.SetUserQuota(context.Background(), "testuser", &quota); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	usr, _ := store.GetUser(context.Background(), "testuser")
+	if usr.GetQuota(defaults) != quota {
+		t.Fatalf("Expected the quota to be set, got %v", usr.GetQuota(defaults))
+	}
+
+	if err := store.SetUserQuota(context.Background(), "testuser", nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	usr, _ = store.GetUser(context.Background(), "testuser")
+	if usr.HasQuota() || usr.GetQuota(defaults) != defaults {
+		t.Fatalf("Expected the default quota")
+	}
+
+	if err := store.SetUserQuota(context.Background(), "missing", &quota); err == nil {
+		t.Fatalf("Expected the missing user to fail")
+	}
+}
+
+func TestUserStore_AddCreatedMessages(t *testing.T) {
+	store := memstore.NewMemUserStore("123")
+	store.AddUser(context.Background(), "testuser", "testpassword", nil)
+
+	for range 2 {
+		if err := store.AddCreatedMessages(context.Background(), "testuser", 3); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	usr, _ := store.GetUser(context.Background(), "testuser")
+	if daily := usr.GetCreatedCount().Daily(time.Now()); daily != 6 {
+		t.Fatalf("Expected 6 messages created today, got %d", daily)
+	}
+
+	if err := store.AddCreatedMessages(context.Background(), "missing", 1); err == nil {
+		t.Fatalf("Expected the missing user to fail")
+	}
+}
@@ -0,0 +1,98 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+type memWebhookStore struct {
+	crypto.EntityEncryptHelper
+	webhooks   sync.Map
+	mu         sync.Mutex
+	deliveries map[string][]storage.WebhookDelivery
+	salt       string
+}
+
+func NewMemWebhookStore(salt string) storage.WebhookStore {
+	return &memWebhookStore{webhooks: sync.Map{}, deliveries: map[string][]storage.WebhookDelivery{}, salt: salt}
+}
+
+func (s *memWebhookStore) ListWebhooks(ctx context.Context, username string) ([]*storage.Webhook, error) {
+	var hooks []*storage.Webhook
+	var err error
+	s.webhooks.Range(func(k, v any) bool {
+		if hook, ok := v.(storage.Webhook); ok && hook.PartitionKey == username {
+			if err = hook.OpenSecret(s, s.salt); err != nil {
+				return false
+			}
+			hooks = append(hooks, &hook)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].RowKey < hooks[j].RowKey
+	})
+	return hooks, nil
+}
+
+func (s *memWebhookStore) AddWebhook(ctx context.Context, username string, url string) (*storage.Webhook, error) {
+	existing, err := s.ListWebhooks(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= storage.MAX_WEBHOOKS {
+		return nil, fmt.Errorf("no more than %d webhooks are allowed", storage.MAX_WEBHOOKS)
+	}
+	hook, err := storage.NewWebhook(username, url)
+	if err != nil {
+		return nil, err
+	}
+	secret := hook.Secret
+	if err := hook.SealSecret(s, s.salt); err != nil {
+		return nil, err
+	}
+	if _, loaded := s.webhooks.LoadOrStore(username+"/"+hook.RowKey, hook); loaded {
+		return nil, errors.New("webhook id is already taken")
+	}
+	// temporarily show the secret to the user
+	hook.Secret = secret
+	return &hook, nil
+}
+
+func (s *memWebhookStore) DeleteWebhook(ctx context.Context, username string, id string) error {
+	if _, loaded := s.webhooks.LoadAndDelete(username + "/" + id); !loaded {
+		return storage.ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (s *memWebhookStore) AddDelivery(ctx context.Context, delivery storage.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// only the latest deliveries are kept
+	deliveries := append([]storage.WebhookDelivery{delivery}, s.deliveries[delivery.PartitionKey]...)
+	if len(deliveries) > storage.MAX_WEBHOOK_DELIVERIES {
+		deliveries = deliveries[:storage.MAX_WEBHOOK_DELIVERIES]
+	}
+	s.deliveries[delivery.PartitionKey] = deliveries
+	return nil
+}
+
+func (s *memWebhookStore) ListDeliveries(ctx context.Context, username string) ([]*storage.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deliveries []*storage.WebhookDelivery
+	for _, d := range s.deliveries[username] {
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, nil
+}
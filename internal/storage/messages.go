@@ -2,6 +2,11 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
@@ -9,15 +14,137 @@ import (
 )
 
 const MAX_PIN_ATTEMPTS = 5
+const MAX_MESSAGE_VIEWS = 10
+
+var ErrMessageNotFound = errors.New("message not found")
+var ErrInvalidPin = errors.New("invalid pin")
+var ErrNotRecipient = errors.New("message is restricted to other recipients")
+var ErrIDCollision = errors.New("message id is taken")
+var ErrMessageLocked = errors.New("message is locked until its not-before time")
+var ErrMessageOpened = errors.New("message was read already")
+var ErrMessageChanged = errors.New("message was changed in the meantime")
+
+// MAX_TIME_LOCK limits how far in the future the message can be unlocked
+const MAX_TIME_LOCK = 30 * 24 * time.Hour
+
+// ANONYMOUS_OWNER is stored as the owner of the messages created without an account,
+// it is not a valid username so the messages never show up in anyone's list
+const ANONYMOUS_OWNER = "~anonymous"
+
+// MAX_ID_ATTEMPTS is how many random ids are tried before giving up,
+// more than one collision means the ids are too short
+const MAX_ID_ATTEMPTS = 3
 
 type MessageStore interface {
 	CountMessages(ctx context.Context) (int64, error)
-	ListMessages(ctx context.Context, username string) ([]*Message, error)
-	AddMessage(ctx context.Context, text string, username string) (*Message, error)
+	// ListMessages returns a page of the active messages of the owner along with
+	// the tombstones, the NextCursor of the page is passed in the options to get the next one
+	ListMessages(ctx context.Context, username string, opts ListOptions) (*MessagePage, error)
+	// ListInbox returns the messages restricted to the given recipient
+	ListInbox(ctx context.Context, username string) ([]*Message, error)
+	AddMessage(ctx context.Context, text string, username string, opts MessageOptions) (*Message, error)
 	GetMessage(ctx context.Context, id string) (*Message, error)
-	GetFullMessage(ctx context.Context, id string, pin string) (*Message, error)
+	// AddEncryptedMessage stores the content encrypted by the client, the server
+	// only checks the verifier derived from the key and never sees the key itself
+	AddEncryptedMessage(ctx context.Context, ciphertext string, verifier string, username string, opts MessageOptions) (*Message, error)
+	// GetFullMessage decrypts the message for the reader and records the read
+	// or the failed attempt in the history, username is empty
+	// for anonymous readers. Restricted messages return ErrNotRecipient
+	// without using up the attempts if the reader is not one of the recipients,
+	// the same way the locked messages return ErrMessageLocked before NotBefore.
+	// Parallel reads are saved over each other with a few retries,
+	// ErrMessageChanged is returned if they all lose.
+	GetFullMessage(ctx context.Context, id string, pin string, username string) (*Message, error)
+	// SetMessageLabels changes the title and the labels of the active message
+	// owned by the user, they are never shown to the recipient
+	SetMessageLabels(ctx context.Context, id string, username string, title string, labels []string) (*Message, error)
+	// DeleteMessage removes the message owned by the user, it returns
+	// ErrMessageNotFound if the message does not exist or belongs to someone else
+	DeleteMessage(ctx context.Context, id string, username string) error
+	// ResetMessagePin re-encrypts the message owned by the user under a new pin,
+	// the content is recovered with the old pin or provided again. A wrong
+	// old pin uses up an attempt the same way as in GetFullMessage. It returns
+	// ErrMessageChanged if the message was read or saved during the reset.
+	ResetMessagePin(ctx context.Context, id string, username string, oldPin string, content string) (*Message, error)
+	// UpdateMessage replaces the content of the unread message owned by the user
+	// keeping its ID, the pin is kept if it is given and generated otherwise.
+	// It returns ErrMessageOpened once the message has been read and ErrMessageChanged
+	// if it was saved by someone else during the edit, a wrong pin uses up an attempt.
+	// The re-encrypted message can grow by up to room bytes, see Quota.Room,
+	// ErrQuotaExceeded is returned otherwise.
+	UpdateMessage(ctx context.Context, id string, username string, content string, format ContentFormat, pin string, room int64) (*Message, error)
+	// DeleteExpiredMessages turns the expired messages into tombstones and
+	// deletes the tombstones kept longer than TOMBSTONE_RETENTION
+	DeleteExpiredMessages(ctx context.Context) (int64, error)
 	Encrypt(text, pass, salt string) (string, error)
 	Decrypt(ciphertext, pass, salt string) (string, error)
+	// GetUsage measures the messages the user keeps, the messages created
+	// during the day are counted with the user, see AddCreatedMessages
+	GetUsage(ctx context.Context, username string) (*Usage, error)
+	// Subscribe registers the listener of the message lifecycle events
+	Subscribe(listener MessageListener)
+}
+
+// Cipher encrypts the message content with the key derived from the pin
+type Cipher interface {
+	Encrypt(text, pass, salt string) (string, error)
+	Decrypt(ciphertext, pass, salt string) (string, error)
+}
+
+// MessageOptions are the choices the creator makes about the message lifecycle
+type MessageOptions struct {
+	// ExpiresIn is the time after which the unread message gets deleted,
+	// it is counted from NotBefore for the locked messages
+	ExpiresIn time.Duration
+	// NotBefore is the time the message can be decrypted at the earliest,
+	// zero means it can be read right away
+	NotBefore time.Time
+	// MaxViews is the number of successful reads before the message gets deleted,
+	// defaults to a single read
+	MaxViews int
+	// Passphrase chosen by the creator replaces the generated PIN
+	Passphrase string
+	// Attachments get encrypted with the same pin as the content
+	Attachments []Attachment
+	// Recipients are the usernames of the only accounts allowed to open the message,
+	// anyone with the link and the pin can open it when empty
+	Recipients []string
+	// Title and Labels help the owner to tell the messages apart
+	Title  string
+	Labels []string
+	// GroupID makes the message a share of the secret split across the group,
+	// the share is redeemed into the group instead of being shown to the reader
+	GroupID string
+	// BatchID links the copies of the message sent to several people,
+	// CopyFor is the name of the person getting this copy
+	BatchID string
+	CopyFor string
+	// Format is the type the content is shown as
+	Format ContentFormat
+}
+
+// Attachment is a file shared along with the message,
+// the name and the type are encrypted together with the data
+type Attachment struct {
+	Name string
+	Type string
+	Data []byte
+}
+
+// ChoosePin returns the passphrase picked by the creator
+// or generates a pin following the policy otherwise
+func ChoosePin(opts MessageOptions, policy crypto.PinPolicy) (pin string, generated bool, err error) {
+	if opts.Passphrase != "" {
+		if err := crypto.CheckPassphrase(opts.Passphrase); err != nil {
+			return "", false, err
+		}
+		return opts.Passphrase, false, nil
+	}
+	pin, err = crypto.MakePin(policy)
+	if err != nil {
+		return "", false, err
+	}
+	return pin, true, nil
 }
 
 type Message struct {
@@ -25,6 +152,38 @@ type Message struct {
 	Content           string
 	Pin               string
 	AttemptsRemaining int
+	ViewsRemaining    int
+	ExpiresAt         aztables.EDMDateTime
+	// NotBefore is the time lock, the zero value means the message is not locked
+	NotBefore aztables.EDMDateTime
+	// Recipients is a comma separated list of usernames allowed to open the message
+	Recipients string
+	// ClientEncrypted content was encrypted in the browser with a key unknown to the server
+	ClientEncrypted bool
+	// Attachments contains the encrypted list of files
+	Attachments string
+	// Files are available only after the message is decrypted
+	Files []Attachment `json:"-"`
+	// Format contains the encrypted content type, empty for plain text
+	Format string
+	// ContentFormat is available only after the message is decrypted
+	ContentFormat ContentFormat `json:"-"`
+	// Status tells what happened to the message, see IsTombstone
+	Status string
+	// EventLog contains the JSON list of non-secret history events
+	EventLog string
+	// Title is a plain text note of the owner
+	Title string
+	// Labels is a comma separated list of tags the owner can filter by
+	Labels string
+	// GroupID is set for the shares of a split secret, see ShareGroup
+	GroupID string
+	// BatchID is shared by the copies of the message, see MessageCopies
+	BatchID string
+	// CopyFor is the plain text name of the person the copy is meant for
+	CopyFor string
+	// Size is the number of ciphertext bytes counted in the quota, see Measure
+	Size int64
 }
 
 func (m *Message) FormattedDate() string {
@@ -32,20 +191,319 @@ func (m *Message) FormattedDate() string {
 	return t.Format(time.RFC822)
 }
 
-func NewMessage(username string, ciphertext string, pin string) (Message, error) {
+func (m *Message) FormattedExpiry() string {
+	t := time.Time(m.ExpiresAt)
+	return t.Format(time.RFC822)
+}
+
+func (m *Message) IsShare() bool {
+	return m.GroupID != ""
+}
+
+func (m *Message) IsAnonymous() bool {
+	return m.RowKey == ANONYMOUS_OWNER
+}
+
+func (m *Message) IsRestricted() bool {
+	return m.Recipients != ""
+}
+
+func (m *Message) HasRecipient(username string) bool {
+	if username == "" {
+		return false
+	}
+	for _, v := range strings.Split(m.Recipients, ",") {
+		if username == v {
+			return true
+		}
+	}
+	return false
+}
+
+// CanBeReadBy checks if the reader is allowed to attempt the decryption
+func (m *Message) CanBeReadBy(username string) bool {
+	return !m.IsRestricted() || m.HasRecipient(username)
+}
+
+// IsLocked tells if the time lock has not passed yet
+func (m *Message) IsLocked() bool {
+	t := time.Time(m.NotBefore)
+	return !t.IsZero() && time.Now().Before(t)
+}
+
+func (m *Message) FormattedNotBefore() string {
+	t := time.Time(m.NotBefore)
+	return t.Format(time.RFC822)
+}
+
+// UnlocksAt is the time lock in RFC 3339 for the countdown in the browser
+func (m *Message) UnlocksAt() string {
+	return time.Time(m.NotBefore).UTC().Format(time.RFC3339)
+}
+
+// Messages stored before the expiry was introduced do not have it set
+// and are kept until they are read or the attempts are exhausted.
+func (m *Message) IsExpired() bool {
+	t := time.Time(m.ExpiresAt)
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// NewMessage prepares the message to be stored, the ID
+// is assigned by the store when inserting, see InsertWithID
+func NewMessage(username string, ciphertext string, pin string, opts MessageOptions) (Message, error) {
+	if opts.ExpiresIn <= 0 {
+		return Message{}, errors.New("message expiry must be in the future")
+	}
+	views := opts.MaxViews
+	if views == 0 {
+		views = 1
+	}
+	if err := opts.Format.Validate(); err != nil {
+		return Message{}, err
+	}
+	if views < 0 || views > MAX_MESSAGE_VIEWS {
+		return Message{}, fmt.Errorf("message views must be between 1 and %d", MAX_MESSAGE_VIEWS)
+	}
 	pinHash, err := crypto.HashPass(pin)
 	if err != nil {
 		return Message{}, err
 	}
 	t := time.Now()
-	return Message{
+	readableFrom := t
+	var notBefore time.Time
+	if !opts.NotBefore.IsZero() {
+		if !opts.NotBefore.After(t) {
+			return Message{}, errors.New("message time lock must be in the future")
+		}
+		if opts.NotBefore.After(t.Add(MAX_TIME_LOCK)) {
+			return Message{}, fmt.Errorf("message time lock must be within %d days", int(MAX_TIME_LOCK.Hours()/24))
+		}
+		notBefore = opts.NotBefore.UTC().Truncate(time.Second)
+		readableFrom = notBefore
+	}
+	// the expiry gets stored as text, keep it in UTC and without fractions
+	// so that it can be compared as a string in table queries
+	expiresAt := readableFrom.Add(opts.ExpiresIn).UTC().Truncate(time.Second)
+	msg := Message{
 		Entity: aztables.Entity{
-			PartitionKey: crypto.HashText(ciphertext),
-			RowKey:       username,
-			Timestamp:    aztables.EDMDateTime(t),
+			RowKey:    username,
+			Timestamp: aztables.EDMDateTime(t),
 		},
 		Content:           ciphertext,
 		Pin:               pinHash,
 		AttemptsRemaining: MAX_PIN_ATTEMPTS,
-	}, nil
+		ViewsRemaining:    views,
+		ExpiresAt:         aztables.EDMDateTime(expiresAt),
+		NotBefore:         aztables.EDMDateTime(notBefore),
+		Recipients:        strings.Join(opts.Recipients, ","),
+		GroupID:           opts.GroupID,
+		BatchID:           opts.BatchID,
+		CopyFor:           opts.CopyFor,
+	}
+	if err := msg.SetLabels(opts.Title, opts.Labels); err != nil {
+		return Message{}, err
+	}
+	msg.addEvent(context.Background(), EventCreated)
+	return msg, nil
+}
+
+// InsertWithID gives the message a random ID and inserts it, another ID is tried
+// if the insert reports ErrIDCollision. The ID is not derived from the content
+// so it does not tell anything about it.
+func InsertWithID(ctx context.Context, msg *Message, policy crypto.IDPolicy, insert func(*Message) error) error {
+	for range MAX_ID_ATTEMPTS {
+		id, err := crypto.MakeID(policy)
+		if err != nil {
+			return err
+		}
+		msg.PartitionKey = id
+		err = insert(msg)
+		if !errors.Is(err, ErrIDCollision) {
+			return err
+		}
+		slog.LogAttrs(ctx, slog.LevelWarn, "message id collision", slog.String("id", id))
+	}
+	return fmt.Errorf("failed to find a free message id in %d attempts: %w", MAX_ID_ATTEMPTS, ErrIDCollision)
+}
+
+// Rekey encrypts the message content under a new pin and resets the attempts.
+// The server cannot decrypt the content without the old pin, so either
+// the old pin or the original content has to be provided.
+// The new pin is returned to be shown to the owner once.
+func (m *Message) Rekey(c Cipher, salt string, oldPin string, content string, policy crypto.PinPolicy) (string, error) {
+	if m.ClientEncrypted {
+		return "", errors.New("the pin of a message encrypted in the browser cannot be reset")
+	}
+	text := content
+	if oldPin != "" {
+		if err := crypto.CompareHashToPass(m.Pin, oldPin); err != nil {
+			return "", ErrInvalidPin
+		}
+		plaintext, err := c.Decrypt(m.Content, oldPin, salt)
+		if err != nil {
+			return "", err
+		}
+		text = plaintext
+		if err := m.OpenAttachments(c, salt, oldPin); err != nil {
+			return "", err
+		}
+		if err := m.OpenFormat(c, salt, oldPin); err != nil {
+			return "", err
+		}
+	} else if m.Attachments != "" {
+		return "", errors.New("the old pin is required to keep the attachments")
+	} else if text == "" {
+		return "", errors.New("either the old pin or the content is required")
+	}
+	pin, err := crypto.MakePin(policy)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := c.Encrypt(text, pin, salt)
+	if err != nil {
+		return "", err
+	}
+	pinHash, err := crypto.HashPass(pin)
+	if err != nil {
+		return "", err
+	}
+	if err := m.SealAttachments(c, salt, pin, m.Files); err != nil {
+		return "", err
+	}
+	// the content provided again is plain text unless the type was recovered with the old pin
+	if err := m.SealFormat(c, salt, pin, m.ContentFormat); err != nil {
+		return "", err
+	}
+	m.Files = nil
+	m.ContentFormat = ContentFormat{}
+	m.Content = ciphertext
+	m.Measure()
+	m.Pin = pinHash
+	m.AttemptsRemaining = MAX_PIN_ATTEMPTS
+	m.addEvent(context.Background(), EventPinReset)
+	return pin, nil
+}
+
+// CanEdit tells whether the owner can still replace the content
+func (m *Message) CanEdit() bool {
+	return !m.IsTombstone() && !m.ClientEncrypted && !m.IsShare() && !m.IsOpened()
+}
+
+// Edit re-encrypts the new content under the given pin or a generated one,
+// the attachments are kept only when the pin is given. It returns
+// the generated pin, or an empty string when the given pin is kept.
+func (m *Message) Edit(c Cipher, salt string, content string, format ContentFormat, pin string, policy crypto.PinPolicy) (string, error) {
+	if m.IsOpened() {
+		return "", ErrMessageOpened
+	}
+	if m.ClientEncrypted || m.IsShare() {
+		return "", errors.New("the content of this message cannot be changed")
+	}
+	if content == "" {
+		return "", errors.New("content is required")
+	}
+	if err := format.Validate(); err != nil {
+		return "", err
+	}
+	generated := ""
+	if pin != "" {
+		if err := crypto.CompareHashToPass(m.Pin, pin); err != nil {
+			return "", ErrInvalidPin
+		}
+		if err := m.OpenAttachments(c, salt, pin); err != nil {
+			return "", err
+		}
+	} else {
+		if m.Attachments != "" {
+			return "", errors.New("the pin is required to keep the attachments")
+		}
+		newPin, err := crypto.MakePin(policy)
+		if err != nil {
+			return "", err
+		}
+		pinHash, err := crypto.HashPass(newPin)
+		if err != nil {
+			return "", err
+		}
+		pin, generated = newPin, newPin
+		m.Pin = pinHash
+	}
+	ciphertext, err := c.Encrypt(content, pin, salt)
+	if err != nil {
+		return "", err
+	}
+	if err := m.SealAttachments(c, salt, pin, m.Files); err != nil {
+		return "", err
+	}
+	if err := m.SealFormat(c, salt, pin, format); err != nil {
+		return "", err
+	}
+	m.Files = nil
+	m.Content = ciphertext
+	m.Measure()
+	m.AttemptsRemaining = MAX_PIN_ATTEMPTS
+	m.addEvent(context.Background(), EventEdited)
+	return generated, nil
+}
+
+// NewClientEncryptedMessage creates a message out of the content encrypted in the browser,
+// the verifier gets stored instead of the pin and is needed to retrieve the content
+func NewClientEncryptedMessage(username string, ciphertext string, verifier string, opts MessageOptions) (Message, error) {
+	if ciphertext == "" || verifier == "" {
+		return Message{}, errors.New("ciphertext and verifier are required")
+	}
+	if opts.Passphrase != "" || len(opts.Attachments) > 0 || !opts.Format.IsPlain() {
+		return Message{}, errors.New("passphrase, attachments and content types are not supported for messages encrypted in the browser")
+	}
+	msg, err := NewMessage(username, ciphertext, verifier, opts)
+	if err != nil {
+		return Message{}, err
+	}
+	msg.ClientEncrypted = true
+	msg.Measure()
+	return msg, nil
+}
+
+// OpenContent decrypts the content with the pin, messages encrypted
+// in the browser are returned as is for the browser to decrypt
+func (m *Message) OpenContent(c Cipher, salt string, pin string) (string, error) {
+	if m.ClientEncrypted {
+		return m.Content, nil
+	}
+	return c.Decrypt(m.Content, pin, salt)
+}
+
+// SealAttachments encrypts the files with the same pin as the content
+func (m *Message) SealAttachments(c Cipher, salt string, pin string, files []Attachment) error {
+	if len(files) == 0 {
+		m.Attachments = ""
+		return nil
+	}
+	marshalled, err := json.Marshal(files)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attachments: %w", err)
+	}
+	ciphertext, err := c.Encrypt(string(marshalled), pin, salt)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt attachments: %w", err)
+	}
+	m.Attachments = ciphertext
+	return nil
+}
+
+// OpenAttachments decrypts the files and makes them available in Files
+func (m *Message) OpenAttachments(c Cipher, salt string, pin string) error {
+	if m.Attachments == "" {
+		return nil
+	}
+	plaintext, err := c.Decrypt(m.Attachments, pin, salt)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt attachments: %w", err)
+	}
+	var files []Attachment
+	if err := json.Unmarshal([]byte(plaintext), &files); err != nil {
+		return fmt.Errorf("failed to unmarshal attachments: %w", err)
+	}
+	m.Files = files
+	return nil
 }
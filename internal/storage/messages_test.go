@@ -0,0 +1,225 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+func TestMessage_Expiry(t *testing.T) {
+	msg, err := storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if msg.IsExpired() {
+		t.Fatal("new message should not be expired")
+	}
+	expiresAt := time.Time(msg.ExpiresAt)
+	if expiresAt.Location() != time.UTC || expiresAt.Nanosecond() != 0 {
+		t.Fatalf("expiry must be in UTC without fractions %v", expiresAt)
+	}
+
+	expired, err := storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{ExpiresIn: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if !expired.IsExpired() {
+		t.Fatal("message should be expired")
+	}
+
+	_, err = storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{})
+	if err == nil {
+		t.Fatal("message without expiry must fail")
+	}
+}
+
+func TestMessage_Views(t *testing.T) {
+	msg, err := storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if msg.ViewsRemaining != 1 {
+		t.Fatalf("message should be read once by default, got %d", msg.ViewsRemaining)
+	}
+
+	msg, err = storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{ExpiresIn: time.Hour, MaxViews: 4})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if msg.ViewsRemaining != 4 {
+		t.Fatalf("unexpected remaining views %d", msg.ViewsRemaining)
+	}
+
+	_, err = storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{ExpiresIn: time.Hour, MaxViews: storage.MAX_MESSAGE_VIEWS + 1})
+	if err == nil {
+		t.Fatal("too many views must fail")
+	}
+}
+
+func TestMessage_Tombstone(t *testing.T) {
+	msg, err := storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{ExpiresIn: time.Hour, MaxViews: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	stored := msg.RecordRead(context.Background())
+	if stored.IsTombstone() || stored.Content != "ciphertext" {
+		t.Fatal("message with views left should stay active")
+	}
+
+	stored = msg.RecordRead(context.Background())
+	if !stored.IsTombstone() || stored.Status != storage.StatusRead {
+		t.Fatalf("message should become a read tombstone, got %s", stored.Status)
+	}
+	if stored.Content != "" || stored.Pin != "" {
+		t.Fatal("tombstone must not keep secrets")
+	}
+	if msg.Content != "ciphertext" {
+		t.Fatal("caller should keep the content")
+	}
+	if !time.Time(stored.ExpiresAt).After(time.Now().Add(storage.TOMBSTONE_RETENTION - time.Minute)) {
+		t.Fatalf("tombstone should be kept for the retention period, got %v", stored.ExpiresAt)
+	}
+	if len(stored.History()) != 3 {
+		t.Fatalf("expected creation and two reads, got %v", stored.History())
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := storage.ParseLabels("Work, vpn work\tprod")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(labels) != 3 || labels[0] != "work" || labels[1] != "vpn" || labels[2] != "prod" {
+		t.Fatalf("Unexpected labels %v", labels)
+	}
+	for _, invalid := range []string{"a,b,c,d,e,f,g,h,i,j,k", "no/slashes", "-leading", "abcdefghijklmnopqrstuvwxyz0123456789"} {
+		if _, err := storage.ParseLabels(invalid); err == nil {
+			t.Fatalf("Expected labels %q to be rejected", invalid)
+		}
+	}
+	_, err = storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{ExpiresIn: time.Hour, Title: strings.Repeat("a", storage.MAX_TITLE_LENGTH+1)})
+	if err == nil {
+		t.Fatal("too long title must fail")
+	}
+}
+
+func TestInsertWithID(t *testing.T) {
+	msg, err := storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var tried []string
+	err = storage.InsertWithID(context.Background(), &msg, crypto.DefaultIDPolicy, func(m *storage.Message) error {
+		tried = append(tried, m.PartitionKey)
+		if len(tried) == 1 {
+			return storage.ErrIDCollision
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(tried) != 2 || tried[0] == tried[1] || msg.PartitionKey != tried[1] {
+		t.Fatalf("Expected a new id after the collision, got %v", tried)
+	}
+
+	err = storage.InsertWithID(context.Background(), &msg, crypto.DefaultIDPolicy, func(m *storage.Message) error {
+		return storage.ErrIDCollision
+	})
+	if !errors.Is(err, storage.ErrIDCollision) {
+		t.Fatalf("Expected to give up after repeated collisions, got %v", err)
+	}
+}
+
+func TestMessage_NotBefore(t *testing.T) {
+	notBefore := time.Now().Add(24 * time.Hour)
+	msg, err := storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{ExpiresIn: time.Hour, NotBefore: notBefore})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !msg.IsLocked() {
+		t.Fatal("message should be locked")
+	}
+	// the expiry counts from the unlock time
+	if !time.Time(msg.ExpiresAt).After(notBefore) {
+		t.Fatalf("expiry should be after the time lock, got %v", time.Time(msg.ExpiresAt))
+	}
+
+	for _, invalid := range []time.Time{time.Now().Add(-time.Minute), time.Now().Add(storage.MAX_TIME_LOCK + time.Hour)} {
+		_, err = storage.NewMessage("foo", "ciphertext", "1234", storage.MessageOptions{ExpiresIn: time.Hour, NotBefore: invalid})
+		if err == nil {
+			t.Fatalf("time lock %v must fail", invalid)
+		}
+	}
+}
+
+func TestGroupCopies(t *testing.T) {
+	names, err := storage.ParseCopies(" Alice, Bob ,,Carol")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(names) != 3 || names[0] != "Alice" || names[1] != "Bob" || names[2] != "Carol" {
+		t.Fatalf("Unexpected names %v", names)
+	}
+	if _, err := storage.ParseCopies("Alice, Alice"); err == nil {
+		t.Fatal("Expected the repeated name to be rejected")
+	}
+
+	var msgs []*storage.Message
+	for _, opts := range []storage.MessageOptions{
+		{ExpiresIn: time.Hour, BatchID: "batch", CopyFor: "Alice"},
+		{ExpiresIn: time.Hour},
+		{ExpiresIn: time.Hour, BatchID: "batch", CopyFor: "Bob"},
+	} {
+		msg, err := storage.NewMessage("foo", "ciphertext", "1234", opts)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		msgs = append(msgs, &msg)
+	}
+	// Bob has read the copy
+	msgs[2].EventLog = `[{"Type":"created"},{"Type":"read"}]`
+
+	groups := storage.GroupCopies(msgs)
+	if len(groups) != 2 || !groups[0].IsBatch() || groups[1].IsBatch() {
+		t.Fatalf("Expected the copies to be grouped, got %v", groups)
+	}
+	if len(groups[0].Messages) != 2 || groups[0].Messages[1].CopyFor != "Bob" {
+		t.Fatalf("Unexpected copies %v", groups[0].Messages)
+	}
+	if opened := groups[0].Opened(); len(opened) != 1 || opened[0] != "Bob" {
+		t.Fatalf("Expected Bob to have opened the copy, got %v", opened)
+	}
+}
+
+func TestParseBulkCSV(t *testing.T) {
+	rows, err := storage.ParseBulkCSV(strings.NewReader("content,label,expiry\n\"multi\nline\",contractors,7d\nsecond\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(rows))
+	}
+	if rows[0].Content != "multi\nline" || rows[0].Label != "contractors" || rows[0].Expiry != "7d" {
+		t.Fatalf("Unexpected row %v", rows[0])
+	}
+	if rows[1].Content != "second" || rows[1].Label != "" || rows[1].Expiry != "" || rows[1].Line != 4 {
+		t.Fatalf("Unexpected row %v", rows[1])
+	}
+
+	for _, invalid := range []string{"", "content\n", "a,b,c,d\n", "first\n\" \",label\n", "\"unterminated\n"} {
+		if _, err := storage.ParseBulkCSV(strings.NewReader(invalid)); err == nil {
+			t.Fatalf("Expected %q to be invalid", invalid)
+		}
+	}
+	if _, err := storage.ParseBulkCSV(strings.NewReader(strings.Repeat("x\n", storage.MAX_BULK_ROWS+1))); err == nil {
+		t.Fatalf("Expected too many rows to fail")
+	}
+}
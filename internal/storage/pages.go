@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const DEFAULT_PAGE_SIZE = 20
+const MAX_PAGE_SIZE = 100
+
+// The messages are ordered by the ID unless sorted otherwise,
+// it is the natural order of both stores
+const (
+	SortByID     = ""
+	SortByNewest = "newest"
+	SortByExpiry = "expiry"
+)
+
+// ListStatusActive keeps only the messages which can still be read,
+// other statuses match the tombstones
+const ListStatusActive = "active"
+
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// ListOptions narrow down and page the messages of the owner
+type ListOptions struct {
+	// Cursor is the NextCursor of the previous page, empty for the first one
+	Cursor string
+	// Limit is the maximum number of messages on the page, defaults to DEFAULT_PAGE_SIZE
+	Limit int
+	// SortBy is one of SortByID, SortByNewest or SortByExpiry
+	SortBy string
+	// Status keeps only the messages in the status, see ListStatusActive
+	Status string
+	// Label keeps only the messages tagged with it
+	Label string
+	// BatchIDs keeps only the copies sent together in these batches, see MessageCopies
+	BatchIDs []string
+}
+
+// MessagePage is one page of the list, NextCursor is empty on the last one
+type MessagePage struct {
+	Messages   []*Message
+	NextCursor string
+}
+
+func (o ListOptions) Validate() error {
+	if o.Limit < 0 || o.Limit > MAX_PAGE_SIZE {
+		return fmt.Errorf("page size must be between 1 and %d", MAX_PAGE_SIZE)
+	}
+	if !slices.Contains([]string{SortByID, SortByNewest, SortByExpiry}, o.SortBy) {
+		return fmt.Errorf("unsupported sort order %s", o.SortBy)
+	}
+	if !slices.Contains([]string{"", ListStatusActive, StatusRead, StatusDestroyed, StatusExpired}, o.Status) {
+		return fmt.Errorf("unsupported status %s", o.Status)
+	}
+	return nil
+}
+
+func (o ListOptions) PageSize() int {
+	if o.Limit == 0 {
+		return DEFAULT_PAGE_SIZE
+	}
+	return o.Limit
+}
+
+// Matches checks if the message passes the filters
+func (o ListOptions) Matches(m *Message) bool {
+	switch o.Status {
+	case "":
+	case ListStatusActive:
+		if m.IsTombstone() {
+			return false
+		}
+	default:
+		if m.Status != o.Status {
+			return false
+		}
+	}
+	if len(o.BatchIDs) > 0 && !slices.Contains(o.BatchIDs, m.BatchID) {
+		return false
+	}
+	return o.Label == "" || m.HasLabel(o.Label)
+}
+
+// EncodeCursor joins the position in the list into an opaque token
+func EncodeCursor(parts ...string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(parts, "\n")))
+}
+
+// DecodeCursor splits the token made by EncodeCursor, the first part is
+// the sort order the cursor was made for
+func DecodeCursor(cursor string, sortBy string, size int) ([]string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.Split(string(decoded), "\n")
+	if len(parts) != size || parts[0] != sortBy {
+		return nil, ErrInvalidCursor
+	}
+	return parts, nil
+}
+
+// sortKey turns the sorted property into text which keeps the order
+func sortKey(m *Message, sortBy string) string {
+	const layout = "20060102150405.000000000"
+	switch sortBy {
+	case SortByNewest:
+		return time.Time(m.Timestamp).UTC().Format(layout)
+	case SortByExpiry:
+		return time.Time(m.ExpiresAt).UTC().Format(layout)
+	}
+	return ""
+}
+
+// compareMessages orders by the sorted property and then by the ID
+func compareMessages(sortBy string, keyA, idA, keyB, idB string) int {
+	c := strings.Compare(keyA, keyB)
+	if c == 0 {
+		c = strings.Compare(idA, idB)
+	}
+	if sortBy == SortByNewest {
+		return -c
+	}
+	return c
+}
+
+// PageMessages sorts the already filtered messages and cuts out the page
+// following the cursor. The cursor remembers the last message shown,
+// so the messages added or removed in between do not shift the pages.
+func PageMessages(msgs []*Message, opts ListOptions) (*MessagePage, error) {
+	var after []string
+	if opts.Cursor != "" {
+		parts, err := DecodeCursor(opts.Cursor, opts.SortBy, 3)
+		if err != nil {
+			return nil, err
+		}
+		after = parts[1:]
+	}
+	sorted := slices.Clone(msgs)
+	slices.SortFunc(sorted, func(a, b *Message) int {
+		return compareMessages(opts.SortBy, sortKey(a, opts.SortBy), a.PartitionKey, sortKey(b, opts.SortBy), b.PartitionKey)
+	})
+	if after != nil {
+		start, _ := slices.BinarySearchFunc(sorted, after, func(m *Message, after []string) int {
+			return compareMessages(opts.SortBy, sortKey(m, opts.SortBy), m.PartitionKey, after[0], after[1])
+		})
+		// skip the last message of the previous page if it is still there
+		if start < len(sorted) && sorted[start].PartitionKey == after[1] {
+			start++
+		}
+		sorted = sorted[start:]
+	}
+	page := &MessagePage{Messages: sorted}
+	if len(sorted) > opts.PageSize() {
+		page.Messages = sorted[:opts.PageSize()]
+		last := page.Messages[len(page.Messages)-1]
+		page.NextCursor = EncodeCursor(opts.SortBy, sortKey(last, opts.SortBy), last.PartitionKey)
+	}
+	return page, nil
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QUOTA_DAY is the window of the daily message limit, it is rolling
+// and starts a day before the new message, the messages are counted by the hour
+const QUOTA_DAY = 24 * time.Hour
+
+// Quota limits what a user keeps in the store, zero means no limit
+type Quota struct {
+	// ActiveMessages are the messages which were not read, destroyed or expired yet
+	ActiveMessages int
+	// StoredBytes is the ciphertext of the active messages with their files
+	StoredBytes int64
+	// DailyMessages are the messages created during the last QUOTA_DAY
+	DailyMessages int
+}
+
+func (q Quota) Validate() error {
+	if q.ActiveMessages < 0 || q.StoredBytes < 0 || q.DailyMessages < 0 {
+		return errors.New("quota limits must not be negative")
+	}
+	return nil
+}
+
+// Usage is what the user keeps in the store, measured the same way as the Quota
+type Usage struct {
+	ActiveMessages int
+	StoredBytes    int64
+	// DailyMessages are counted with the user, see CreatedCount
+	DailyMessages int
+}
+
+// Count adds the message owned by the user to the usage
+func (u *Usage) Count(m *Message) {
+	if !m.IsTombstone() && !m.IsExpired() {
+		u.ActiveMessages++
+		u.StoredBytes += m.Size
+	}
+}
+
+// CreatedCount is the number of messages the user created in each hour, it is
+// kept with the user so deleting the messages does not reset the daily limit
+type CreatedCount map[int64]int
+
+func createdHour(t time.Time) int64 {
+	return t.Unix() / int64(time.Hour/time.Second)
+}
+
+// Daily sums up the hours of the last QUOTA_DAY
+func (c CreatedCount) Daily(now time.Time) int {
+	from := createdHour(now.Add(-QUOTA_DAY))
+	total := 0
+	for hour, count := range c {
+		if hour > from {
+			total += count
+		}
+	}
+	return total
+}
+
+// Add counts the new messages and forgets the hours before the last QUOTA_DAY
+func (c CreatedCount) Add(now time.Time, messages int) CreatedCount {
+	from := createdHour(now.Add(-QUOTA_DAY))
+	added := CreatedCount{}
+	for hour, count := range c {
+		if hour > from {
+			added[hour] = count
+		}
+	}
+	added[createdHour(now)] += messages
+	return added
+}
+
+// Check refuses the new messages which would take the usage over the quota,
+// the size is the ciphertext they will be stored as, see EstimateSize
+func (q Quota) Check(u *Usage, messages int, size int64) error {
+	if q.ActiveMessages > 0 && messages > 0 && u.ActiveMessages+messages > q.ActiveMessages {
+		return fmt.Errorf("%w: up to %d active messages are allowed", ErrQuotaExceeded, q.ActiveMessages)
+	}
+	if q.StoredBytes > 0 && u.StoredBytes+size > q.StoredBytes {
+		return fmt.Errorf("%w: up to %d bytes can be stored", ErrQuotaExceeded, q.StoredBytes)
+	}
+	if q.DailyMessages > 0 && messages > 0 && u.DailyMessages+messages > q.DailyMessages {
+		return fmt.Errorf("%w: up to %d messages can be created per day", ErrQuotaExceeded, q.DailyMessages)
+	}
+	return nil
+}
+
+// Room is how many more bytes the user can store, the messages
+// can grow by any amount if the stored bytes are not limited
+func (q Quota) Room(u *Usage) int64 {
+	if q.StoredBytes == 0 {
+		return math.MaxInt64
+	}
+	return max(q.StoredBytes-u.StoredBytes, 0)
+}
+
+// CheckGrowth refuses the edit which makes the message take more than the room
+// left in the quota, the sizes are measured after the encryption
+func CheckGrowth(before int64, after int64, room int64) error {
+	if after-before > room {
+		return fmt.Errorf("%w: the message can grow by up to %d bytes", ErrQuotaExceeded, room)
+	}
+	return nil
+}
+
+// EstimateSize tells the size of the message encrypted on the server from the
+// length of its text, so the quota can be checked before the work is done.
+// It matches the Size set by Measure.
+func EstimateSize(text int, opts MessageOptions) int64 {
+	size := crypto.SealedSize(text)
+	if len(opts.Attachments) > 0 {
+		if marshalled, err := json.Marshal(opts.Attachments); err == nil {
+			size += crypto.SealedSize(len(marshalled))
+		}
+	}
+	if !opts.Format.IsPlain() {
+		if marshalled, err := json.Marshal(opts.Format); err == nil {
+			size += crypto.SealedSize(len(marshalled))
+		}
+	}
+	return int64(size)
+}
+
+// Measure records the size of the ciphertext kept for the message,
+// it is called once the content and the files are encrypted
+func (m *Message) Measure() {
+	m.Size = int64(len(m.Content) + len(m.Attachments) + len(m.Format))
+}
+
+// GetQuota returns the quota set for the user by an admin or the defaults otherwise
+func (u *User) GetQuota(defaults Quota) Quota {
+	if u.Quota == "" {
+		return defaults
+	}
+	var quota Quota
+	if err := json.Unmarshal([]byte(u.Quota), &quota); err != nil {
+		return defaults
+	}
+	return quota
+}
+
+func (u *User) HasQuota() bool {
+	return u.Quota != ""
+}
+
+func (u *User) GetCreatedCount() CreatedCount {
+	var count CreatedCount
+	if u.Created != "" {
+		json.Unmarshal([]byte(u.Created), &count)
+	}
+	return count
+}
+
+// CountCreated adds the new messages to the ones the user created during the day,
+// the returned value is stored with the user
+func (u *User) CountCreated(now time.Time, messages int) (string, error) {
+	data, err := json.Marshal(u.GetCreatedCount().Add(now, messages))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// EncodeQuota turns the quota into the value stored with the user,
+// nil removes the quota of the user and the defaults apply again
+func EncodeQuota(quota *Quota) (string, error) {
+	if quota == nil {
+		return "", nil
+	}
+	if err := quota.Validate(); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(quota)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+)
+
+const MAX_REQUEST_DESCRIPTION = 200
+
+var ErrRequestNotFound = errors.New("secret request not found")
+var ErrRequestAnswered = errors.New("secret request was answered already")
+
+// RequestStore keeps the "drop box" links the users create to receive
+// a secret from someone without an account
+type RequestStore interface {
+	// AddRequest creates the link to receive a secret, the returned
+	// request holds the generated PIN which is shown to the owner once
+	AddRequest(ctx context.Context, username string, description string, expiresIn time.Duration) (*SecretRequest, error)
+	// GetRequest returns the request waiting for the secret, it is nil
+	// once the request expires or gets answered
+	GetRequest(ctx context.Context, id string) (*SecretRequest, error)
+	// ListRequests returns the requests of the owner which have not expired
+	ListRequests(ctx context.Context, username string) ([]*SecretRequest, error)
+	// SubmitSecret seals the secret of the visitor with the public key of the request,
+	// every request can be answered once
+	SubmitSecret(ctx context.Context, id string, text string) error
+	// OpenSecret decrypts the received secret for the owner and deletes the request,
+	// the wrong PIN uses up the attempts the same way as with the messages
+	OpenSecret(ctx context.Context, id string, username string, pin string) (*SecretRequest, error)
+	// DeleteRequest removes the request owned by the user, it returns
+	// ErrRequestNotFound if it does not exist or belongs to someone else
+	DeleteRequest(ctx context.Context, id string, username string) error
+	DeleteExpiredRequests(ctx context.Context) (int64, error)
+}
+
+// SecretRequest is the inbound message. The visitor seals the secret with
+// the public key, the private key is encrypted with the PIN only the owner
+// knows, so neither the visitor nor the server can read the secret afterwards.
+type SecretRequest struct {
+	aztables.Entity
+	// Description tells the visitor what to send, it is not secret
+	Description       string
+	PublicKey         string
+	PrivateKey        string
+	Pin               string
+	AttemptsRemaining int
+	ExpiresAt         aztables.EDMDateTime
+	// Content is empty until the visitor answers the request
+	Content    string
+	ReceivedAt aztables.EDMDateTime
+}
+
+// NewSecretRequest generates the key pair of the request and
+// encrypts the private key with the pin
+func NewSecretRequest(id string, username string, description string, expiresIn time.Duration, pin string, c Cipher, salt string) (SecretRequest, error) {
+	description = strings.TrimSpace(description)
+	if utf8.RuneCountInString(description) > MAX_REQUEST_DESCRIPTION {
+		return SecretRequest{}, fmt.Errorf("description must be up to %d characters", MAX_REQUEST_DESCRIPTION)
+	}
+	if expiresIn <= 0 {
+		return SecretRequest{}, errors.New("request expiry must be in the future")
+	}
+	public, private, err := crypto.GenerateBoxKey()
+	if err != nil {
+		return SecretRequest{}, err
+	}
+	sealedPrivate, err := c.Encrypt(private, pin, salt)
+	if err != nil {
+		return SecretRequest{}, fmt.Errorf("failed to encrypt the private key: %w", err)
+	}
+	pinHash, err := crypto.HashPass(pin)
+	if err != nil {
+		return SecretRequest{}, err
+	}
+	t := time.Now()
+	return SecretRequest{
+		Entity: aztables.Entity{
+			PartitionKey: id,
+			RowKey:       username,
+			Timestamp:    aztables.EDMDateTime(t),
+		},
+		Description:       description,
+		PublicKey:         public,
+		PrivateKey:        sealedPrivate,
+		Pin:               pinHash,
+		AttemptsRemaining: MAX_PIN_ATTEMPTS,
+		ExpiresAt:         aztables.EDMDateTime(t.Add(expiresIn).UTC().Truncate(time.Second)),
+	}, nil
+}
+
+func (r *SecretRequest) ID() string {
+	return r.PartitionKey
+}
+
+func (r *SecretRequest) IsAnswered() bool {
+	return r.Content != ""
+}
+
+func (r *SecretRequest) IsExpired() bool {
+	return !time.Now().Before(time.Time(r.ExpiresAt))
+}
+
+func (r *SecretRequest) FormattedDate() string {
+	return time.Time(r.Timestamp).Format(time.RFC822)
+}
+
+func (r *SecretRequest) FormattedExpiry() string {
+	return time.Time(r.ExpiresAt).Format(time.RFC822)
+}
+
+func (r *SecretRequest) FormattedReceivedAt() string {
+	return time.Time(r.ReceivedAt).Format(time.RFC822)
+}
+
+// Answer seals the secret of the visitor
+func (r *SecretRequest) Answer(text string) error {
+	if r.IsAnswered() {
+		return ErrRequestAnswered
+	}
+	if text == "" {
+		return errors.New("secret is empty")
+	}
+	sealed, err := crypto.SealToPublicKey(r.PublicKey, text)
+	if err != nil {
+		return fmt.Errorf("failed to seal the secret: %w", err)
+	}
+	r.Content = sealed
+	r.ReceivedAt = aztables.EDMDateTime(time.Now().UTC().Truncate(time.Second))
+	return nil
+}
+
+// Open recovers the private key with the pin and decrypts the received secret
+func (r *SecretRequest) Open(c Cipher, salt string, pin string) (string, error) {
+	if !r.IsAnswered() {
+		return "", errors.New("the secret has not been received yet")
+	}
+	if err := crypto.CompareHashToPass(r.Pin, pin); err != nil {
+		return "", ErrInvalidPin
+	}
+	private, err := c.Decrypt(r.PrivateKey, pin, salt)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt the private key: %w", err)
+	}
+	return crypto.OpenWithPrivateKey(private, r.Content)
+}
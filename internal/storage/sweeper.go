@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// RunSweeper periodically removes expired messages from the store
+// until the context gets cancelled. Expired messages are already
+// hidden from the readers, this physically deletes them.
+func RunSweeper(ctx context.Context, store MessageStore, interval time.Duration) {
+	sweep(ctx, "messages", store.DeleteExpiredMessages, interval)
+}
+
+// RunRequestSweeper removes the expired secret requests the same way
+func RunRequestSweeper(ctx context.Context, store RequestStore, interval time.Duration) {
+	sweep(ctx, "requests", store.DeleteExpiredRequests, interval)
+}
+
+// RunGroupSweeper removes the expired share groups the same way
+func RunGroupSweeper(ctx context.Context, store GroupStore, interval time.Duration) {
+	sweep(ctx, "share groups", store.DeleteExpiredGroups, interval)
+}
+
+func sweep(ctx context.Context, kind string, deleteExpired func(context.Context) (int64, error), interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := deleteExpired(ctx)
+			if err != nil {
+				slog.LogAttrs(ctx, slog.LevelError, "failed to delete expired "+kind, slog.Any("error", err))
+				continue
+			}
+			if deleted > 0 {
+				slog.LogAttrs(ctx, slog.LevelInfo, "deleted expired "+kind, slog.Int64("total", deleted))
+			}
+		}
+	}
+}
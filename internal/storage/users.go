@@ -10,18 +10,32 @@ import (
 )
 
 const PERMISSION_READ_STATS = "read:stats"
+const PERMISSION_MANAGE_QUOTAS = "manage:quotas"
 
 type UserStore interface {
 	CountUsers(ctx context.Context) (int64, error)
 	AddUser(ctx context.Context, username string, password string, permissions []string) (*User, error)
 	GetUser(ctx context.Context, username string) (*User, error)
 	GetUserWithPass(ctx context.Context, username string, password string) (*User, error)
+	// SetUserEmail changes the address the notifications are sent to, empty disables them
+	SetUserEmail(ctx context.Context, username string, email string) error
+	// SetUserQuota overrides the default quota of the user, nil restores the default
+	SetUserQuota(ctx context.Context, username string, quota *Quota) error
+	// AddCreatedMessages counts the messages the user has stored towards
+	// the daily limit, they keep counting after they are deleted
+	AddCreatedMessages(ctx context.Context, username string, messages int) error
 }
 
 type User struct {
 	aztables.Entity
 	Password    string
 	Permissions string
+	// Email is optional and only used for the notifications
+	Email string
+	// Quota is the JSON of the quota set by an admin, empty for the default one
+	Quota string
+	// Created is the JSON of the CreatedCount of the last day
+	Created string
 }
 
 func (u *User) FormattedDate() string {
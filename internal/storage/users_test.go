@@ -2,7 +2,9 @@ package storage_test
 
 import (
 	"encoding/json"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/ivarprudnikov/secretshare/internal/crypto"
 	"github.com/ivarprudnikov/secretshare/internal/storage"
@@ -45,3 +47,81 @@ func TestUser(t *testing.T) {
 		t.Fatalf("user should not have arbitrary permission")
 	}
 }
+
+func TestUser_Quota(t *testing.T) {
+	defaults := storage.Quota{ActiveMessages: 2, StoredBytes: 100, DailyMessages: 3}
+	usr, err := storage.NewUser("foo", "bar", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if usr.HasQuota() || usr.GetQuota(defaults) != defaults {
+		t.Fatalf("Expected the default quota")
+	}
+
+	override := storage.Quota{ActiveMessages: 0, StoredBytes: 1000, DailyMessages: 10}
+	usr.Quota, err = storage.EncodeQuota(&override)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !usr.HasQuota() || usr.GetQuota(defaults) != override {
+		t.Fatalf("Expected the overridden quota, got %v", usr.GetQuota(defaults))
+	}
+	if _, err := storage.EncodeQuota(&storage.Quota{DailyMessages: -1}); err == nil {
+		t.Fatalf("Expected a negative limit to be invalid")
+	}
+
+	usage := &storage.Usage{ActiveMessages: 1, StoredBytes: 60, DailyMessages: 2}
+	if err := defaults.Check(usage, 1, 40); err != nil {
+		t.Fatalf("Expected the message to fit, got %v", err)
+	}
+	for _, c := range []struct {
+		messages int
+		size     int64
+	}{{2, 0}, {1, 41}} {
+		if err := defaults.Check(usage, c.messages, c.size); !errors.Is(err, storage.ErrQuotaExceeded) {
+			t.Fatalf("Expected ErrQuotaExceeded for %v, got %v", c, err)
+		}
+	}
+	usage.ActiveMessages = 0
+	usage.DailyMessages = 3
+	if err := defaults.Check(usage, 1, 0); !errors.Is(err, storage.ErrQuotaExceeded) {
+		t.Fatalf("Expected the daily limit to be reached, got %v", err)
+	}
+	// zero turns the limit off
+	if err := override.Check(&storage.Usage{ActiveMessages: 500}, 1, 0); err != nil {
+		t.Fatalf("Expected no limit of the active messages, got %v", err)
+	}
+	// the edit only checks the size
+	if err := defaults.Check(usage, 0, 40); err != nil {
+		t.Fatalf("Expected the edit to fit, got %v", err)
+	}
+	if err := defaults.Check(usage, 0, 101); !errors.Is(err, storage.ErrQuotaExceeded) {
+		t.Fatalf("Expected the edit to exceed the stored bytes, got %v", err)
+	}
+}
+
+func TestUser_CountCreated(t *testing.T) {
+	usr, err := storage.NewUser("foo", "bar", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	now := time.Now()
+	usr.Created, err = usr.CountCreated(now.Add(-25*time.Hour), 5)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	usr.Created, err = usr.CountCreated(now.Add(-2*time.Hour), 2)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if daily := usr.GetCreatedCount().Daily(now); daily != 2 {
+		t.Fatalf("Expected only the last day to count, got %d", daily)
+	}
+	usr.Created, err = usr.CountCreated(now, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if count := usr.GetCreatedCount(); len(count) != 2 || count.Daily(now) != 3 {
+		t.Fatalf("Expected the older hours to be forgotten, got %v", count)
+	}
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+)
+
+// MAX_WEBHOOKS is the number of webhooks a user can register
+const MAX_WEBHOOKS = 5
+
+// MAX_WEBHOOK_DELIVERIES is the number of the latest deliveries listed to the user
+const MAX_WEBHOOK_DELIVERIES = 50
+
+// Webhooks and their deliveries share the partition of the user,
+// the row keys are prefixed to tell them apart
+const (
+	WebhookKeyPrefix  = "hook-"
+	DeliveryKeyPrefix = "delivery-"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+type WebhookStore interface {
+	ListWebhooks(ctx context.Context, username string) ([]*Webhook, error)
+	// AddWebhook registers the url and generates the signing secret,
+	// the secret is returned to be shown to the user once
+	AddWebhook(ctx context.Context, username string, url string) (*Webhook, error)
+	// DeleteWebhook returns ErrWebhookNotFound if the webhook does not belong to the user
+	DeleteWebhook(ctx context.Context, username string, id string) error
+	AddDelivery(ctx context.Context, delivery WebhookDelivery) error
+	// ListDeliveries returns the latest deliveries, the newest first
+	ListDeliveries(ctx context.Context, username string) ([]*WebhookDelivery, error)
+}
+
+type Webhook struct {
+	aztables.Entity
+	URL string
+	// Secret signs the payloads, it is stored encrypted
+	Secret string
+}
+
+func (w *Webhook) FormattedDate() string {
+	t := time.Time(w.Timestamp)
+	return t.Format(time.RFC822)
+}
+
+// ID of the webhook is unique for the user
+func (w *Webhook) ID() string {
+	return w.RowKey
+}
+
+// NewWebhook validates the url and generates the id and the signing secret
+func NewWebhook(username string, rawURL string) (Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return Webhook{}, errors.New("webhook url must be an absolute http or https url")
+	}
+	if u.User != nil {
+		return Webhook{}, errors.New("webhook url must not contain credentials")
+	}
+	id, err := crypto.RandomHex(8)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("failed to generate webhook id: %w", err)
+	}
+	secret, err := crypto.RandomHex(32)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	return Webhook{
+		Entity: aztables.Entity{
+			PartitionKey: username,
+			RowKey:       WebhookKeyPrefix + id,
+			Timestamp:    aztables.EDMDateTime(time.Now()),
+		},
+		URL:    u.String(),
+		Secret: secret,
+	}, nil
+}
+
+// WebhookDelivery records a single attempt to deliver the event
+type WebhookDelivery struct {
+	aztables.Entity
+	WebhookID  string
+	URL        string
+	Event      string
+	MessageID  string
+	Attempt    int
+	StatusCode int
+	Error      string
+}
+
+func (d *WebhookDelivery) FormattedDate() string {
+	t := time.Time(d.Timestamp)
+	return t.Format(time.RFC822)
+}
+
+func (d *WebhookDelivery) Succeeded() bool {
+	return d.Error == "" && d.StatusCode >= 200 && d.StatusCode < 300
+}
+
+// SealSecret encrypts the signing secret before the webhook is stored
+func (w *Webhook) SealSecret(c Cipher, salt string) error {
+	ciphertext, err := c.Encrypt(w.Secret, w.PartitionKey+w.RowKey, salt)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt webhook secret: %w", err)
+	}
+	w.Secret = ciphertext
+	return nil
+}
+
+// OpenSecret decrypts the signing secret of the stored webhook
+func (w *Webhook) OpenSecret(c Cipher, salt string) error {
+	plaintext, err := c.Decrypt(w.Secret, w.PartitionKey+w.RowKey, salt)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt webhook secret: %w", err)
+	}
+	w.Secret = plaintext
+	return nil
+}
+
+// NewWebhookDelivery keeps the newest deliveries first when sorted by the row key
+func NewWebhookDelivery(webhook *Webhook, event LifecycleEvent, attempt int) (WebhookDelivery, error) {
+	suffix, err := crypto.RandomHex(4)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	t := time.Now()
+	return WebhookDelivery{
+		Entity: aztables.Entity{
+			PartitionKey: webhook.PartitionKey,
+			RowKey:       fmt.Sprintf("%s%019d-%s", DeliveryKeyPrefix, math.MaxInt64-t.UnixNano(), suffix),
+			Timestamp:    aztables.EDMDateTime(t),
+		},
+		WebhookID: webhook.ID(),
+		URL:       webhook.URL,
+		Event:     event.Type,
+		MessageID: event.MessageID,
+		Attempt:   attempt,
+	}, nil
+}
@@ -0,0 +1,207 @@
+// Package webhooks delivers the message lifecycle events to the urls registered by the users.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+)
+
+// Headers sent along with the payload
+const (
+	HeaderEvent     = "X-Secretshare-Event"
+	HeaderTimestamp = "X-Secretshare-Timestamp"
+	HeaderSignature = "X-Secretshare-Signature"
+)
+
+const userAgent = "secretshare-webhooks"
+
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// Options tune the delivery, the zero values fall back to the defaults
+type Options struct {
+	// MaxAttempts to deliver a single event, defaults to 5
+	MaxAttempts int
+	// Backoff before the first retry, it doubles on every attempt, defaults to 1s
+	Backoff time.Duration
+	// Timeout of a single request, defaults to 10s
+	Timeout time.Duration
+	// QueueSize is the number of events waiting for the delivery, defaults to 100
+	QueueSize int
+	// AllowPrivate lets the webhooks reach loopback and private networks,
+	// only meant for local development and tests
+	AllowPrivate bool
+}
+
+// Dispatcher listens to the message store and posts the events
+// to the webhooks of the message owner in the background
+type Dispatcher struct {
+	store  storage.WebhookStore
+	client *http.Client
+	queue  chan storage.LifecycleEvent
+	opts   Options
+}
+
+func NewDispatcher(store storage.WebhookStore, opts Options) *Dispatcher {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 100
+	}
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if !opts.AllowPrivate {
+		dialer.Control = denyPrivateAddress
+	}
+	client := &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		// redirects could lead to the addresses which are not allowed
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &Dispatcher{
+		store:  store,
+		client: client,
+		queue:  make(chan storage.LifecycleEvent, opts.QueueSize),
+		opts:   opts,
+	}
+}
+
+// MessageChanged queues the event, it gets dropped if the queue is full
+func (d *Dispatcher) MessageChanged(ctx context.Context, event storage.LifecycleEvent) {
+	select {
+	case d.queue <- event:
+	default:
+		slog.LogAttrs(ctx, slog.LevelError, "webhook queue is full, dropping event", slog.String("id", event.MessageID), slog.String("event", event.Type))
+	}
+}
+
+// Run delivers the queued events until the context gets cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-d.queue:
+			d.dispatch(ctx, event)
+		}
+	}
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context, event storage.LifecycleEvent) {
+	hooks, err := d.store.ListWebhooks(ctx, event.Owner)
+	if err != nil {
+		slog.LogAttrs(ctx, slog.LevelError, "failed to list webhooks", slog.String("username", event.Owner), slog.Any("error", err))
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.LogAttrs(ctx, slog.LevelError, "failed to marshal webhook event", slog.Any("error", err))
+		return
+	}
+	for _, hook := range hooks {
+		go d.deliver(ctx, hook, event, body)
+	}
+}
+
+// deliver retries with exponential backoff and records every attempt
+func (d *Dispatcher) deliver(ctx context.Context, hook *storage.Webhook, event storage.LifecycleEvent, body []byte) {
+	backoff := d.opts.Backoff
+	for attempt := 1; attempt <= d.opts.MaxAttempts; attempt++ {
+		statusCode, err := d.post(ctx, hook, event, body)
+		d.record(ctx, hook, event, attempt, statusCode, err)
+		if err == nil && statusCode >= 200 && statusCode < 300 {
+			return
+		}
+		if attempt == d.opts.MaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	slog.LogAttrs(ctx, slog.LevelError, "webhook delivery failed", slog.String("username", hook.PartitionKey), slog.String("webhook", hook.ID()), slog.String("event", event.Type))
+}
+
+func (d *Dispatcher) post(ctx context.Context, hook *storage.Webhook, event storage.LifecycleEvent, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(HeaderEvent, event.Type)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(hook.Secret, timestamp, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) record(ctx context.Context, hook *storage.Webhook, event storage.LifecycleEvent, attempt int, statusCode int, deliveryErr error) {
+	delivery, err := storage.NewWebhookDelivery(hook, event, attempt)
+	if err != nil {
+		slog.LogAttrs(ctx, slog.LevelError, "failed to create webhook delivery", slog.Any("error", err))
+		return
+	}
+	delivery.StatusCode = statusCode
+	if deliveryErr != nil {
+		delivery.Error = deliveryErr.Error()
+	}
+	if err := d.store.AddDelivery(ctx, delivery); err != nil {
+		slog.LogAttrs(ctx, slog.LevelError, "failed to record webhook delivery", slog.Any("error", err))
+	}
+}
+
+// Sign returns the signature the receiver can verify with the secret
+// it got when the webhook was registered: HMAC-SHA256 of "timestamp.body"
+func Sign(secret string, timestamp string, body []byte) string {
+	return crypto.HmacText(secret, timestamp+"."+string(body))
+}
+
+// denyPrivateAddress checks the resolved address right before connecting
+// to prevent the webhooks from reaching the internal services
+func denyPrivateAddress(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errPrivateAddress, address)
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%w: %s", errPrivateAddress, address)
+	}
+	return nil
+}
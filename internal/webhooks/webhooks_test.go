@@ -0,0 +1,177 @@
+package webhooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/storage"
+	"github.com/ivarprudnikov/secretshare/internal/storage/memstore"
+	"github.com/ivarprudnikov/secretshare/internal/webhooks"
+)
+
+const salt = "12345678123456781234567812345678"
+
+// waitForDeliveries polls the delivery log until the expected number of attempts is recorded
+func waitForDeliveries(t *testing.T, store storage.WebhookStore, username string, expected int) []*storage.WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries, err := store.ListDeliveries(context.Background(), username)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(deliveries) >= expected {
+			return deliveries
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d deliveries in time", expected)
+	return nil
+}
+
+func TestDispatcher_SignedDelivery(t *testing.T) {
+	received := make(chan storage.LifecycleEvent, 10)
+	var secret string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		expected := "sha256=" + webhooks.Sign(secret, r.Header.Get(webhooks.HeaderTimestamp), body)
+		if r.Header.Get(webhooks.HeaderSignature) != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event storage.LifecycleEvent
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer srv.Close()
+
+	hooks := memstore.NewMemWebhookStore(salt)
+	hook, err := hooks.AddWebhook(context.Background(), "testuser", srv.URL)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	secret = hook.Secret
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dispatcher := webhooks.NewDispatcher(hooks, webhooks.Options{AllowPrivate: true})
+	go dispatcher.Run(ctx)
+
+	messages := memstore.NewMemMessageStore(salt, crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+	messages.Subscribe(dispatcher)
+	msg, err := messages.AddMessage(context.Background(), "foobar", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	select {
+	case event := <-received:
+		if event.Type != storage.EventCreated || event.MessageID != msg.PartitionKey || event.Owner != "testuser" {
+			t.Fatalf("Unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the event to be delivered")
+	}
+
+	deliveries := waitForDeliveries(t, hooks, "testuser", 1)
+	if !deliveries[0].Succeeded() || deliveries[0].WebhookID != hook.ID() {
+		t.Fatalf("Expected successful delivery, got %v", deliveries[0])
+	}
+}
+
+func TestDispatcher_LifecycleEvents(t *testing.T) {
+	received := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(webhooks.HeaderEvent)
+	}))
+	defer srv.Close()
+
+	hooks := memstore.NewMemWebhookStore(salt)
+	hooks.AddWebhook(context.Background(), "testuser", srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dispatcher := webhooks.NewDispatcher(hooks, webhooks.Options{AllowPrivate: true})
+	go dispatcher.Run(ctx)
+
+	messages := memstore.NewMemMessageStore(salt, crypto.DefaultPinPolicy, crypto.DefaultIDPolicy)
+	messages.Subscribe(dispatcher)
+	msg, _ := messages.AddMessage(context.Background(), "foobar", "testuser", storage.MessageOptions{ExpiresIn: time.Hour})
+	messages.GetFullMessage(context.Background(), msg.PartitionKey, "invalidpin", "")
+	messages.GetFullMessage(context.Background(), msg.PartitionKey, msg.Pin, "")
+
+	var events []string
+	for range 4 {
+		select {
+		case event := <-received:
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected more events, got %v", events)
+		}
+	}
+	// the deliveries of different events run concurrently
+	for _, expected := range []string{storage.EventCreated, storage.EventFailed, storage.EventRead, storage.EventDestroyed} {
+		if !strings.Contains(strings.Join(events, ","), expected) {
+			t.Fatalf("Expected %s event, got %v", expected, events)
+		}
+	}
+}
+
+func TestDispatcher_RetriesWithBackoff(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	hooks := memstore.NewMemWebhookStore(salt)
+	hooks.AddWebhook(context.Background(), "testuser", srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dispatcher := webhooks.NewDispatcher(hooks, webhooks.Options{AllowPrivate: true, Backoff: 10 * time.Millisecond})
+	go dispatcher.Run(ctx)
+
+	dispatcher.MessageChanged(context.Background(), storage.LifecycleEvent{Type: storage.EventCreated, MessageID: "abc", Owner: "testuser"})
+
+	deliveries := waitForDeliveries(t, hooks, "testuser", 3)
+	// newest first
+	if !deliveries[0].Succeeded() || deliveries[0].Attempt != 3 {
+		t.Fatalf("Expected the third attempt to succeed, got %v", deliveries[0])
+	}
+	if deliveries[2].Succeeded() || deliveries[2].StatusCode != http.StatusInternalServerError || deliveries[2].Attempt != 1 {
+		t.Fatalf("Expected the first attempt to fail, got %v", deliveries[2])
+	}
+}
+
+func TestDispatcher_DeniesPrivateAddresses(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer srv.Close()
+
+	hooks := memstore.NewMemWebhookStore(salt)
+	hooks.AddWebhook(context.Background(), "testuser", srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dispatcher := webhooks.NewDispatcher(hooks, webhooks.Options{MaxAttempts: 1})
+	go dispatcher.Run(ctx)
+
+	dispatcher.MessageChanged(context.Background(), storage.LifecycleEvent{Type: storage.EventCreated, MessageID: "abc", Owner: "testuser"})
+
+	deliveries := waitForDeliveries(t, hooks, "testuser", 1)
+	if deliveries[0].Succeeded() || !strings.Contains(deliveries[0].Error, "not public") {
+		t.Fatalf("Expected the loopback address to be denied, got %v", deliveries[0])
+	}
+	if calls.Load() != 0 {
+		t.Fatalf("Expected no requests to reach the server")
+	}
+}
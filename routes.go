@@ -1,19 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"embed"
+	"encoding/base64"
+	"encoding/csv"
 	"fmt"
 	"html/template"
+	"io"
 	"log/slog"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"errors"
 	"net/http"
+	netmail "net/mail"
+	"net/netip"
 	"net/url"
 
 	"github.com/gorilla/sessions"
+	"github.com/ivarprudnikov/secretshare/internal/configuration"
 	"github.com/ivarprudnikov/secretshare/internal/crypto"
+	"github.com/ivarprudnikov/secretshare/internal/mailer"
+	"github.com/ivarprudnikov/secretshare/internal/markdown"
+	"github.com/ivarprudnikov/secretshare/internal/ratelimit"
+	"github.com/ivarprudnikov/secretshare/internal/shamir"
 	"github.com/ivarprudnikov/secretshare/internal/storage"
 )
 
@@ -25,6 +42,35 @@ const VIEW_SESS_KEY = "session"
 const VIEW_DATA_KEY = "data"
 const VIEW_ERROR_KEY = "error"
 const failedPathQueryKey = "failedPath"
+const defaultMessageExpiry = "24h"
+
+// ANONYMOUS_FORM_OVERHEAD leaves room for the form fields and
+// the multipart boundaries on top of the anonymous message size
+const ANONYMOUS_FORM_OVERHEAD = int64(16 << 10)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// expiryOption is a choice of message lifetime offered when creating a message
+type expiryOption struct {
+	Value    string
+	Label    string
+	Duration time.Duration
+}
+
+var messageExpiryOptions = []expiryOption{
+	{Value: "1h", Label: "1 hour", Duration: time.Hour},
+	{Value: "24h", Label: "24 hours", Duration: 24 * time.Hour},
+	{Value: "7d", Label: "7 days", Duration: 7 * 24 * time.Hour},
+}
+
+func findMessageExpiry(value string) (time.Duration, bool) {
+	for _, o := range messageExpiryOptions {
+		if o.Value == value {
+			return o.Duration, true
+		}
+	}
+	return 0, false
+}
 
 // contextKey is the type used to store the user in the context.
 type contextKey int
@@ -40,26 +86,67 @@ var templatesFs embed.FS
 var tmpl *template.Template
 
 func init() {
-	tmpl = template.Must(template.ParseFS(templatesFs, "web/*.tmpl"))
+	tmpl = template.Must(template.New("").Funcs(template.FuncMap{
+		"downloadURL": downloadURL,
+		"markdown":    markdown.Render,
+	}).ParseFS(templatesFs, "web/*.tmpl"))
+}
+
+// downloadURL embeds the decrypted attachment in the page, the message might not exist
+// anymore after it was shown so the file cannot be downloaded separately
+func downloadURL(file storage.Attachment) template.URL {
+	return template.URL("data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString(file.Data))
 }
 
 func AddRoutes(
 	mux *http.ServeMux,
+	config *configuration.ConfigReader,
 	sessions *sessions.CookieStore,
 	messages storage.MessageStore,
 	users storage.UserStore,
+	hooks storage.WebhookStore,
+	requests storage.RequestStore,
+	groups storage.GroupStore,
+	mail mailer.Mailer,
 ) {
+	anonymous := config.GetAnonymousPolicy()
+	anonymousLimiter := ratelimit.NewLimiter(anonymous.RateLimit, time.Hour)
+	quota := config.GetDefaultQuota()
 	preReq := newAppMiddleware(sessions, users)
 	mux.Handle("GET /accounts/login", preReq(loginPageHandler(sessions)))
 	mux.Handle("POST /accounts/login", preReq(loginAccountHandler(sessions, users)))
 	mux.Handle("GET /accounts/logout", preReq(logoutAccountHandler(sessions)))
 	mux.Handle("GET /accounts/new", preReq(createAccountPageHandler(sessions)))
 	mux.Handle("POST /accounts", preReq(createAccountHandler(sessions, users)))
-	mux.Handle("GET /messages", preReq(hasAuth(listMsgHandler(sessions, messages))))
-	mux.Handle("POST /messages", preReq(hasAuth(createMsgHandler(sessions, messages))))
-	mux.Handle("GET /messages/new", preReq(hasAuth(createMsgPageHandler(sessions))))
+	mux.Handle("GET /accounts/settings", preReq(hasAuth(accountSettingsPageHandler(sessions, users, mail != nil))))
+	mux.Handle("POST /accounts/settings", preReq(hasAuth(accountSettingsHandler(sessions, users))))
+	mux.Handle("GET /messages", preReq(hasAuth(listMsgHandler(sessions, messages, requests, quota))))
+	mux.Handle("POST /messages", preReq(hasAuthOrAnonymous(anonymous.Enabled, createMsgHandler(sessions, messages, users, groups, mail, config.GetPublicURL(), anonymous, anonymousLimiter, config.IsTrustedProxy(), quota))))
+	mux.Handle("GET /messages/bulk", preReq(hasAuth(bulkMsgPageHandler(sessions))))
+	mux.Handle("POST /messages/bulk", preReq(hasAuth(bulkMsgHandler(sessions, messages, users, config.GetPublicURL(), quota))))
+	mux.Handle("GET /inbox", preReq(hasAuth(inboxHandler(sessions, messages))))
+	mux.Handle("GET /messages/new", preReq(hasAuthOrAnonymous(anonymous.Enabled, createMsgPageHandler(sessions, config.GetPinPolicy(), mail != nil, anonymous))))
 	mux.Handle("GET /messages/{id}", preReq(showMsgHandler(sessions, messages)))
-	mux.Handle("POST /messages/{id}", preReq(showMsgFullHandler(sessions, messages)))
+	mux.Handle("POST /messages/{id}", preReq(showMsgFullHandler(sessions, messages, groups, config.IsTrustedProxy())))
+	mux.Handle("POST /messages/{id}/delete", preReq(hasAuth(deleteMsgHandler(sessions, messages))))
+	mux.Handle("POST /messages/{id}/labels", preReq(hasAuth(labelMsgHandler(sessions, messages))))
+	mux.Handle("GET /messages/{id}/pin", preReq(hasAuth(resetPinPageHandler(sessions, messages))))
+	mux.Handle("POST /messages/{id}/pin", preReq(hasAuth(resetPinHandler(sessions, messages))))
+	mux.Handle("GET /messages/{id}/edit", preReq(hasAuth(editMsgPageHandler(sessions, messages))))
+	mux.Handle("POST /messages/{id}/edit", preReq(hasAuth(editMsgHandler(sessions, messages, quota))))
+	mux.Handle("GET /requests/new", preReq(hasAuth(createRequestPageHandler(sessions))))
+	mux.Handle("POST /requests", preReq(hasAuth(createRequestHandler(sessions, requests))))
+	mux.Handle("GET /requests/{id}", preReq(showRequestHandler(sessions, requests)))
+	mux.Handle("POST /requests/{id}", preReq(submitRequestHandler(sessions, requests)))
+	mux.Handle("POST /requests/{id}/open", preReq(hasAuth(openRequestHandler(sessions, requests))))
+	mux.Handle("POST /requests/{id}/delete", preReq(hasAuth(deleteRequestHandler(sessions, requests))))
+	mux.Handle("GET /groups/{id}", preReq(showGroupHandler(sessions, groups)))
+	mux.Handle("POST /groups/{id}", preReq(combineGroupHandler(sessions, groups)))
+	mux.Handle("GET /webhooks", preReq(hasAuth(listWebhooksHandler(sessions, hooks))))
+	mux.Handle("POST /webhooks", preReq(hasAuth(createWebhookHandler(sessions, hooks))))
+	mux.Handle("POST /webhooks/{id}/delete", preReq(hasAuth(deleteWebhookHandler(sessions, hooks))))
+	mux.Handle("GET /admin/quotas", preReq(hasAuth(hasPermission(storage.PERMISSION_MANAGE_QUOTAS, quotasPageHandler(sessions, users, messages, quota)))))
+	mux.Handle("POST /admin/quotas/{username}", preReq(hasAuth(hasPermission(storage.PERMISSION_MANAGE_QUOTAS, setQuotaHandler(sessions, users)))))
 	mux.Handle("GET /stats", preReq(hasAuth(hasPermission(storage.PERMISSION_READ_STATS, statsHandler(sessions, users, messages)))))
 	mux.Handle("GET /", indexPageHandler(sessions))
 }
@@ -196,7 +283,7 @@ func createAccountHandler(sessions *sessions.CookieStore, store storage.UserStor
 			sendError(r.Context(), sess, w, "username is empty", nil)
 			return
 		}
-		if matched, err := regexp.MatchString(`^[A-Za-z0-9_-]+$`, username); err != nil || !matched {
+		if !usernamePattern.MatchString(username) {
 			sendError(r.Context(), sess, w, "username can only consist of letters, numbers, underscore (_) and dash (-)", nil)
 			return
 		}
@@ -222,7 +309,7 @@ func createAccountHandler(sessions *sessions.CookieStore, store storage.UserStor
 	}
 }
 
-func listMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore) http.HandlerFunc {
+func listMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore, requests storage.RequestStore, defaultQuota storage.Quota) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -230,33 +317,126 @@ func listMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore)
 		}
 		sess, _ := sessions.Get(r, SESS_COOKIE)
 		username := sess.Values[SESS_USER_KEY]
-		messages, err := store.ListMessages(r.Context(), username.(string))
+		query := r.URL.Query()
+		opts := storage.ListOptions{
+			Cursor: query.Get("cursor"),
+			SortBy: query.Get("sort"),
+			Status: query.Get("status"),
+			Label:  strings.ToLower(query.Get("label")),
+		}
+		if err := opts.Validate(); err != nil {
+			sendError(r.Context(), sess, w, err.Error(), nil)
+			return
+		}
+		page, err := store.ListMessages(r.Context(), username.(string), opts)
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			sendError(r.Context(), sess, w, "the page does not exist, start from the first one", err)
+			return
+		}
 		if err != nil {
 			sendError(r.Context(), sess, w, "failed to list messages", err)
 			return
 		}
+		// the paging links keep the filters
+		next := url.Values{}
+		for k, v := range map[string]string{"sort": opts.SortBy, "status": opts.Status, "label": opts.Label} {
+			if v != "" {
+				next.Set(k, v)
+			}
+		}
+		reqs, err := requests.ListRequests(r.Context(), username.(string))
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to list secret requests", err)
+			return
+		}
+		u, ok := r.Context().Value(userKey).(*storage.User)
+		if !ok {
+			sendError(r.Context(), sess, w, "failed to get a user", nil)
+			return
+		}
+		usage, err := getUsage(r.Context(), store, u)
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to measure the usage", err)
+			return
+		}
+		quota := u.GetQuota(defaultQuota)
+		batches, err := storage.BatchCopies(r.Context(), store, username.(string), page.Messages)
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to list the copies of the messages", err)
+			return
+		}
+		first := "/messages?" + next.Encode()
+		next.Set("cursor", page.NextCursor)
 		tmpl.ExecuteTemplate(w, "message.list.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: map[string]interface{}{
+				"Rows":      messageRows(page.Messages, batches),
+				"Options":   opts,
+				"FirstPage": first,
+				"NextPage":  "/messages?" + next.Encode(),
+				"HasNext":   page.NextCursor != "",
+				"Requests":  reqs,
+				"Usage":     usage,
+				"Quota":     quota,
+			},
+		})
+	}
+}
+
+func inboxHandler(sessions *sessions.CookieStore, store storage.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		username := sess.Values[SESS_USER_KEY]
+		messages, err := store.ListInbox(r.Context(), username.(string))
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to list inbox messages", err)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "message.inbox.tmpl", map[string]interface{}{
 			VIEW_SESS_KEY: sess.Values,
 			VIEW_DATA_KEY: messages,
 		})
 	}
 }
 
-func createMsgPageHandler(sessions *sessions.CookieStore) http.HandlerFunc {
+func createMsgPageHandler(sessions *sessions.CookieStore, pinPolicy crypto.PinPolicy, mailEnabled bool, anonymous configuration.AnonymousPolicy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		sess, _ := sessions.Get(r, SESS_COOKIE)
+		_, hasUser := r.Context().Value(userKey).(*storage.User)
 		tmpl.ExecuteTemplate(w, "message.create.tmpl", map[string]interface{}{
 			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: map[string]interface{}{
+				"ExpiryOptions":    messageExpiryOptions,
+				"DefaultExpiry":    defaultMessageExpiry,
+				"MaxViews":         storage.MAX_MESSAGE_VIEWS,
+				"MinPassphrase":    crypto.MinPassphraseLength,
+				"PinFormat":        pinPolicy.Describe(),
+				"MailEnabled":      mailEnabled,
+				"MaxShares":        shamir.MAX_SHARES,
+				"MaxCopies":        storage.MAX_COPIES,
+				"Anonymous":        !hasUser,
+				"AnonymousExpiry":  formatDuration(anonymous.Expiry),
+				"AnonymousMaxSize": anonymous.MaxSize,
+			},
 		})
 	}
 }
 
-func createMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore) http.HandlerFunc {
+func createMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore, users storage.UserStore, groups storage.GroupStore, mail mailer.Mailer, publicURL string, anonymous configuration.AnonymousPolicy, limiter *ratelimit.Limiter, trustedProxy bool, quota storage.Quota) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		sess, _ := sessions.Get(r, SESS_COOKIE)
-		err := r.ParseMultipartForm(MAX_FORM_SIZE)
-		if err != nil {
-			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+		var username string
+		limit, tooLarge := MAX_FORM_SIZE, fmt.Sprintf("message is too large, it can be up to %d MB", MAX_FORM_SIZE>>20)
+		if u, ok := r.Context().Value(userKey).(*storage.User); ok {
+			username = u.PartitionKey
+		} else {
+			// hasAuthOrAnonymous lets the request through only if anonymous messages are enabled
+			username = storage.ANONYMOUS_OWNER
+			limit = anonymous.MaxSize + ANONYMOUS_FORM_OVERHEAD
+			tooLarge = fmt.Sprintf("message is too large, it can be up to %d bytes without an account", anonymous.MaxSize)
+		}
+		isAnonymous := username == storage.ANONYMOUS_OWNER
+		if !parseLimitedForm(w, r, sess, limit, tooLarge) {
 			return
 		}
 		csrf := r.PostForm.Get("_csrf")
@@ -264,22 +444,568 @@ func createMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore
 			sendError(r.Context(), sess, w, "invalid token", nil)
 			return
 		}
-		payload := r.PostForm.Get("payload")
-		if payload == "" {
-			sendError(r.Context(), sess, w, "payload is empty", nil)
+		if isAnonymous && !limiter.Allow(rateLimitKey(r, trustedProxy)) {
+			slog.LogAttrs(r.Context(), slog.LevelInfo, "anonymous message rate limited", slog.String("client", rateLimitKey(r, trustedProxy)))
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Hour.Seconds()/float64(anonymous.RateLimit))))
+			sendErrorStatus(r.Context(), sess, w, http.StatusTooManyRequests, "too many messages were created, try again later or log in", nil)
 			return
 		}
-		username := sess.Values[SESS_USER_KEY]
-		msg, err := store.AddMessage(r.Context(), payload, username.(string))
+		opts, err := readMessageOptions(r)
+		if err != nil {
+			sendError(r.Context(), sess, w, err.Error(), nil)
+			return
+		}
+		if isAnonymous {
+			if err := restrictAnonymous(r, &opts, anonymous); err != nil {
+				sendError(r.Context(), sess, w, err.Error(), nil)
+				return
+			}
+		} else {
+			count := requestedMessages(r)
+			if !checkQuota(w, r, sess, store, quota, count, estimateSize(r, opts)*int64(count)) {
+				return
+			}
+		}
+		if r.PostForm.Get("shares") != "" {
+			createShares(w, r, sess, store, users, groups, username, opts)
+			return
+		}
+		if r.PostForm.Get("copies") != "" {
+			createCopies(w, r, sess, store, users, username, opts)
+			return
+		}
+		for _, recipient := range opts.Recipients {
+			usr, err := users.GetUser(r.Context(), recipient)
+			if err != nil {
+				sendError(r.Context(), sess, w, "failed to check recipients", err)
+				return
+			}
+			if usr == nil {
+				sendError(r.Context(), sess, w, fmt.Sprintf("recipient %s does not exist", recipient), nil)
+				return
+			}
+		}
+		var msg *storage.Message
+		payload := r.PostForm.Get("payload")
+		ciphertext := r.PostForm.Get("ciphertext")
+		emailTo := strings.TrimSpace(r.PostForm.Get("email"))
+		if emailTo != "" {
+			if mail == nil {
+				sendError(r.Context(), sess, w, "sending emails is not enabled", nil)
+				return
+			}
+			if _, err := netmail.ParseAddress(emailTo); err != nil {
+				sendError(r.Context(), sess, w, "recipient email address is not valid", err)
+				return
+			}
+			// the key of the link is only known to the browser
+			if ciphertext != "" {
+				sendError(r.Context(), sess, w, "the link to a message encrypted in the browser cannot be emailed", nil)
+				return
+			}
+		}
+		if ciphertext != "" {
+			// zero-knowledge mode, the content was encrypted in the browser
+			if payload != "" {
+				sendError(r.Context(), sess, w, "plain text must not be sent along with the encrypted content", nil)
+				return
+			}
+			verifier := r.PostForm.Get("verifier")
+			msg, err = store.AddEncryptedMessage(r.Context(), ciphertext, verifier, username, opts)
+		} else {
+			if payload == "" && len(opts.Attachments) == 0 {
+				sendError(r.Context(), sess, w, "payload is empty", nil)
+				return
+			}
+			msg, err = store.AddMessage(r.Context(), payload, username, opts)
+		}
 		if err != nil {
 			sendError(r.Context(), sess, w, "failed to store message", err)
 			return
 		}
+		countCreated(r, users, 1)
+		// the message is stored already, a failed email is only reported
+		var emailErr error
+		if emailTo != "" {
+			emailErr = mailer.ShareLink(r.Context(), mail, emailTo, mailer.SharedMessage{
+				Sender:     username,
+				Link:       absoluteURL(r, publicURL, "/messages/"+msg.PartitionKey),
+				Passphrase: opts.Passphrase != "",
+				ExpiresAt:  msg.FormattedExpiry(),
+			})
+			if emailErr != nil {
+				slog.LogAttrs(r.Context(), slog.LevelError, "failed to email the link", slog.String("id", msg.PartitionKey), slog.Any("error", emailErr))
+			}
+		}
 		tmpl.ExecuteTemplate(w, "message.created.tmpl", map[string]interface{}{
 			VIEW_SESS_KEY: sess.Values,
 			VIEW_DATA_KEY: msg,
+			"emailTo":     emailTo,
+			"emailFailed": emailErr != nil,
+		})
+	}
+}
+
+// createShares splits the message into the shares and stores each of them as
+// a message of its own, the holders redeem them into the group by their PINs
+func createShares(w http.ResponseWriter, r *http.Request, sess *sessions.Session, store storage.MessageStore, users storage.UserStore, groups storage.GroupStore, username string, opts storage.MessageOptions) {
+	if username == storage.ANONYMOUS_OWNER {
+		sendError(r.Context(), sess, w, "log in to split the message into shares", nil)
+		return
+	}
+	if r.PostForm.Get("ciphertext") != "" || r.PostForm.Get("email") != "" || opts.Passphrase != "" ||
+		len(opts.Attachments) > 0 || len(opts.Recipients) > 0 || !opts.NotBefore.IsZero() {
+		sendError(r.Context(), sess, w, "the message split into shares cannot have files, a passphrase, recipients, a time lock, an email or be encrypted in the browser", nil)
+		return
+	}
+	payload := r.PostForm.Get("payload")
+	if payload == "" {
+		sendError(r.Context(), sess, w, "payload is empty", nil)
+		return
+	}
+	total, err := strconv.Atoi(r.PostForm.Get("shares"))
+	if err != nil {
+		sendError(r.Context(), sess, w, "number of shares is not valid", err)
+		return
+	}
+	threshold, err := strconv.Atoi(r.PostForm.Get("threshold"))
+	if err != nil {
+		sendError(r.Context(), sess, w, "number of required shares is not valid", err)
+		return
+	}
+	parts, err := storage.SplitSecret(payload, total, threshold)
+	if err != nil {
+		sendError(r.Context(), sess, w, err.Error(), nil)
+		return
+	}
+	group, err := groups.AddGroup(r.Context(), username, total, threshold, opts.ExpiresIn)
+	if err != nil {
+		sendError(r.Context(), sess, w, "failed to store share group", err)
+		return
+	}
+	var batch []storage.BulkMessage
+	for i, part := range parts {
+		shareOpts := opts
+		shareOpts.GroupID = group.ID()
+		// every holder redeems the share once
+		shareOpts.MaxViews = 1
+		shareOpts.Title = strings.TrimSpace(fmt.Sprintf("Share %d of %d %s", i+1, total, opts.Title))
+		batch = append(batch, storage.BulkMessage{Text: part, Options: shareOpts})
+	}
+	// the shares stored before a failure are deleted, the group goes with them
+	shares, err := storage.AddMessages(r.Context(), store, username, batch)
+	if err != nil {
+		if err := groups.DeleteGroup(r.Context(), group.ID(), username); err != nil {
+			slog.LogAttrs(r.Context(), slog.LevelError, "failed to roll back share group", slog.String("id", group.ID()), slog.String("username", username), slog.Any("error", err))
+		}
+		sendError(r.Context(), sess, w, "failed to store share", err)
+		return
+	}
+	countCreated(r, users, len(shares))
+	tmpl.ExecuteTemplate(w, "group.created.tmpl", map[string]interface{}{
+		VIEW_SESS_KEY: sess.Values,
+		VIEW_DATA_KEY: group,
+		"shares":      shares,
+	})
+}
+
+// createCopies stores a copy of the message for every named person,
+// each copy gets its own link, pin and attempts
+func createCopies(w http.ResponseWriter, r *http.Request, sess *sessions.Session, store storage.MessageStore, users storage.UserStore, username string, opts storage.MessageOptions) {
+	if username == storage.ANONYMOUS_OWNER {
+		sendError(r.Context(), sess, w, "log in to send separate copies", nil)
+		return
+	}
+	if r.PostForm.Get("ciphertext") != "" || r.PostForm.Get("email") != "" || opts.Passphrase != "" || len(opts.Recipients) > 0 {
+		sendError(r.Context(), sess, w, "separate copies cannot have a passphrase, recipients, an email or be encrypted in the browser", nil)
+		return
+	}
+	names, err := storage.ParseCopies(r.PostForm.Get("copies"))
+	if err != nil {
+		sendError(r.Context(), sess, w, err.Error(), nil)
+		return
+	}
+	if len(names) == 0 {
+		sendError(r.Context(), sess, w, "names of the people are empty", nil)
+		return
+	}
+	payload := r.PostForm.Get("payload")
+	if payload == "" && len(opts.Attachments) == 0 {
+		sendError(r.Context(), sess, w, "payload is empty", nil)
+		return
+	}
+	batchID, err := crypto.MakeID(crypto.DefaultIDPolicy)
+	if err != nil {
+		sendError(r.Context(), sess, w, "failed to store message", err)
+		return
+	}
+	var batch []storage.BulkMessage
+	for _, name := range names {
+		copyOpts := opts
+		copyOpts.BatchID = batchID
+		copyOpts.CopyFor = name
+		batch = append(batch, storage.BulkMessage{Text: payload, Options: copyOpts})
+	}
+	// none of the copies is left behind if one of them fails
+	copies, err := storage.AddMessages(r.Context(), store, username, batch)
+	if err != nil {
+		sendError(r.Context(), sess, w, "failed to store message", err)
+		return
+	}
+	countCreated(r, users, len(copies))
+	tmpl.ExecuteTemplate(w, "message.copies.tmpl", map[string]interface{}{
+		VIEW_SESS_KEY: sess.Values,
+		VIEW_DATA_KEY: copies,
+	})
+}
+
+func bulkMsgPageHandler(sessions *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		tmpl.ExecuteTemplate(w, "message.bulk.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: map[string]interface{}{
+				"ExpiryOptions": messageExpiryOptions,
+				"DefaultExpiry": defaultMessageExpiry,
+				"MaxRows":       storage.MAX_BULK_ROWS,
+			},
+		})
+	}
+}
+
+// bulkMsgHandler creates a message out of every line of the uploaded CSV,
+// the links and the pins are only returned in the response
+func bulkMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore, users storage.UserStore, publicURL string, quota storage.Quota) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		if !parseLimitedForm(w, r, sess, MAX_FORM_SIZE, fmt.Sprintf("request is too large, it can be up to %d MB", MAX_FORM_SIZE>>20)) {
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		defaultExpiry := r.PostForm.Get("expiry")
+		if defaultExpiry == "" {
+			defaultExpiry = defaultMessageExpiry
+		}
+		if _, ok := findMessageExpiry(defaultExpiry); !ok {
+			sendError(r.Context(), sess, w, "unsupported message expiry", nil)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			sendError(r.Context(), sess, w, "CSV file is required", err)
+			return
+		}
+		rows, err := storage.ParseBulkCSV(file)
+		file.Close()
+		if err != nil {
+			sendError(r.Context(), sess, w, err.Error(), nil)
+			return
+		}
+		var batch []storage.BulkMessage
+		var size int64
+		for _, row := range rows {
+			size += storage.EstimateSize(len(row.Content), storage.MessageOptions{})
+			expiry := row.Expiry
+			if expiry == "" {
+				expiry = defaultExpiry
+			}
+			expiresIn, ok := findMessageExpiry(expiry)
+			if !ok {
+				sendError(r.Context(), sess, w, fmt.Sprintf("line %d has an unsupported expiry %s", row.Line, row.Expiry), nil)
+				return
+			}
+			labels, err := storage.ParseLabels(row.Label)
+			if err != nil {
+				sendError(r.Context(), sess, w, fmt.Sprintf("line %d: %s", row.Line, err), nil)
+				return
+			}
+			batch = append(batch, storage.BulkMessage{
+				Text:    row.Content,
+				Options: storage.MessageOptions{ExpiresIn: expiresIn, MaxViews: 1, Labels: labels},
+			})
+		}
+		if !checkQuota(w, r, sess, store, quota, len(batch), size) {
+			return
+		}
+		username := sess.Values[SESS_USER_KEY].(string)
+		msgs, err := storage.AddMessages(r.Context(), store, username, batch)
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to store messages, none were created", err)
+			return
+		}
+		countCreated(r, users, len(msgs))
+		var out bytes.Buffer
+		writer := csv.NewWriter(&out)
+		writer.Write([]string{"id", "link", "pin", "label", "expires_at"})
+		for _, msg := range msgs {
+			writer.Write([]string{msg.PartitionKey, absoluteURL(r, publicURL, "/messages/"+msg.PartitionKey), msg.Pin, msg.Labels, msg.FormattedExpiry()})
+		}
+		writer.Flush()
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "messages created in bulk", slog.String("username", username), slog.Int("count", len(msgs)))
+		w.Header().Set("Cache-Control", "no-store")
+		tmpl.ExecuteTemplate(w, "message.bulk.created.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: map[string]interface{}{
+				"Messages": msgs,
+				"CSV":      template.URL("data:text/csv;base64," + base64.StdEncoding.EncodeToString(out.Bytes())),
+			},
+		})
+	}
+}
+
+// estimateSize tells the ciphertext stored for each of the messages the form creates,
+// the shares are the base64 of the content with a byte added by the split
+func estimateSize(r *http.Request, opts storage.MessageOptions) int64 {
+	if ciphertext := r.PostForm.Get("ciphertext"); ciphertext != "" {
+		return int64(len(ciphertext))
+	}
+	text := len(r.PostForm.Get("payload"))
+	if r.PostForm.Get("shares") != "" {
+		text = base64.StdEncoding.EncodedLen(text + 1)
+	}
+	return storage.EstimateSize(text, opts)
+}
+
+// requestedMessages tells how many messages the form creates,
+// the shares and the copies are checked later on
+func requestedMessages(r *http.Request) int {
+	if shares, err := strconv.Atoi(r.PostForm.Get("shares")); err == nil && shares > 1 {
+		return shares
+	}
+	if names, err := storage.ParseCopies(r.PostForm.Get("copies")); err == nil && len(names) > 0 {
+		return len(names)
+	}
+	return 1
+}
+
+// checkQuota refuses the new messages over the quota of the user in the context,
+// it responds with an error and returns false then. It only reads the usage,
+// the messages are counted with countCreated once they are stored.
+func checkQuota(w http.ResponseWriter, r *http.Request, sess *sessions.Session, store storage.MessageStore, defaultQuota storage.Quota, count int, size int64) bool {
+	u, ok := r.Context().Value(userKey).(*storage.User)
+	if !ok {
+		return true
+	}
+	usage, err := getUsage(r.Context(), store, u)
+	if err != nil {
+		sendError(r.Context(), sess, w, "failed to measure the usage", err)
+		return false
+	}
+	if err := u.GetQuota(defaultQuota).Check(usage, count, size); err != nil {
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "quota exceeded", slog.String("username", u.PartitionKey), slog.Any("error", err))
+		sendErrorStatus(r.Context(), sess, w, http.StatusForbidden, err.Error(), nil)
+		return false
+	}
+	return true
+}
+
+// countCreated adds the stored messages to the daily count of the user in the context,
+// they count for the day even if they are deleted later. The messages are
+// stored already, so a failure is only logged.
+func countCreated(r *http.Request, users storage.UserStore, count int) {
+	u, ok := r.Context().Value(userKey).(*storage.User)
+	if !ok || count == 0 {
+		return
+	}
+	if err := users.AddCreatedMessages(r.Context(), u.PartitionKey, count); err != nil {
+		slog.LogAttrs(r.Context(), slog.LevelError, "failed to count the created messages", slog.String("username", u.PartitionKey), slog.Int("count", count), slog.Any("error", err))
+	}
+}
+
+// getUsage measures the messages kept in the store along with
+// the ones the user has created during the day
+func getUsage(ctx context.Context, store storage.MessageStore, u *storage.User) (*storage.Usage, error) {
+	usage, err := store.GetUsage(ctx, u.PartitionKey)
+	if err != nil {
+		return nil, err
+	}
+	usage.DailyMessages = u.GetCreatedCount().Daily(time.Now())
+	return usage, nil
+}
+
+// messageRow is a message in the list of the owner,
+// the first of the copies leads the group of them
+type messageRow struct {
+	*storage.Message
+	Copies    *storage.MessageCopies
+	FirstCopy bool
+}
+
+func messageRows(msgs []*storage.Message, batches map[string]*storage.MessageCopies) []messageRow {
+	var rows []messageRow
+	for _, group := range storage.GroupCopies(msgs) {
+		for i, msg := range group.Messages {
+			row := messageRow{Message: msg}
+			if group.IsBatch() {
+				row.Copies = batches[group.BatchID]
+				row.FirstCopy = i == 0
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// restrictAnonymous applies the policy of the messages created without an account:
+// the expiry is fixed, the size is capped and the features tied to accounts are refused
+func restrictAnonymous(r *http.Request, opts *storage.MessageOptions, policy configuration.AnonymousPolicy) error {
+	if len(opts.Recipients) > 0 {
+		return errors.New("log in to send the message to recipients")
+	}
+	if !opts.NotBefore.IsZero() {
+		return errors.New("log in to lock the message until a time")
+	}
+	if r.PostForm.Get("email") != "" {
+		return errors.New("log in to email the link")
+	}
+	size := int64(len(r.PostForm.Get("payload")) + len(r.PostForm.Get("ciphertext")))
+	for _, file := range opts.Attachments {
+		size += int64(len(file.Data))
+	}
+	if size > policy.MaxSize {
+		return fmt.Errorf("message is too large, it can be up to %d bytes without an account", policy.MaxSize)
+	}
+	opts.ExpiresIn = policy.Expiry
+	// nobody can see the list of the anonymous messages
+	opts.Title = ""
+	opts.Labels = nil
+	return nil
+}
+
+// formatDuration shows the whole hours or minutes of the duration
+func formatDuration(d time.Duration) string {
+	unit, count := "minute", int(d.Minutes())
+	if d >= time.Hour && d%time.Hour == 0 {
+		unit, count = "hour", int(d.Hours())
+	}
+	if count != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", count, unit)
+}
+
+// readMessageOptions reads the message lifecycle choices from the submitted form,
+// the error message is meant to be shown to the user
+func readMessageOptions(r *http.Request) (storage.MessageOptions, error) {
+	var opts storage.MessageOptions
+	expiry := r.PostForm.Get("expiry")
+	if expiry == "" {
+		expiry = defaultMessageExpiry
+	}
+	expiresIn, ok := findMessageExpiry(expiry)
+	if !ok {
+		return opts, errors.New("unsupported message expiry")
+	}
+	opts.ExpiresIn = expiresIn
+	opts.MaxViews = 1
+	if views := r.PostForm.Get("views"); views != "" {
+		maxViews, err := strconv.Atoi(views)
+		if err != nil || maxViews < 1 || maxViews > storage.MAX_MESSAGE_VIEWS {
+			return opts, fmt.Errorf("views must be a number between 1 and %d", storage.MAX_MESSAGE_VIEWS)
+		}
+		opts.MaxViews = maxViews
+	}
+	opts.Passphrase = r.PostForm.Get("passphrase")
+	if opts.Passphrase != "" {
+		if err := crypto.CheckPassphrase(opts.Passphrase); err != nil {
+			return opts, err
+		}
+	}
+	attachments, err := readAttachments(r)
+	if err != nil {
+		return opts, errors.New("failed to read attachments")
+	}
+	opts.Attachments = attachments
+	recipients, err := readRecipients(r.PostForm.Get("recipients"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Recipients = recipients
+	notBefore, err := readNotBefore(r.PostForm.Get("notbefore"), r.PostForm.Get("tzoffset"))
+	if err != nil {
+		return opts, err
+	}
+	opts.NotBefore = notBefore
+	opts.Format = storage.ContentFormat{Type: r.PostForm.Get("format")}
+	if opts.Format.Type == storage.FormatCode {
+		opts.Format.Language = strings.ToLower(strings.TrimSpace(r.PostForm.Get("language")))
+	}
+	if err := opts.Format.Validate(); err != nil {
+		return opts, err
+	}
+	opts.Title = r.PostForm.Get("title")
+	labels, err := storage.ParseLabels(r.PostForm.Get("labels"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Labels = labels
+	return opts, nil
+}
+
+// readNotBefore reads the local time of the datetime-local input, the browser
+// sends its offset from UTC in minutes the same way as Date.getTimezoneOffset
+func readNotBefore(value string, offset string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	local, err := time.ParseInLocation("2006-01-02T15:04", value, time.UTC)
+	if err != nil {
+		return time.Time{}, errors.New("unlock time is not valid")
+	}
+	minutes := 0
+	if offset != "" {
+		minutes, err = strconv.Atoi(offset)
+		if err != nil || minutes < -14*60 || minutes > 14*60 {
+			return time.Time{}, errors.New("time zone offset is not valid")
+		}
+	}
+	return local.Add(time.Duration(minutes) * time.Minute), nil
+}
+
+// readRecipients splits the list of usernames separated by commas or spaces
+func readRecipients(value string) ([]string, error) {
+	var recipients []string
+	for _, recipient := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		if !usernamePattern.MatchString(recipient) {
+			return nil, fmt.Errorf("recipient %s is not a valid username", recipient)
+		}
+		if !slices.Contains(recipients, recipient) {
+			recipients = append(recipients, recipient)
+		}
+	}
+	return recipients, nil
+}
+
+// readAttachments reads the files uploaded along with the message
+func readAttachments(r *http.Request) ([]storage.Attachment, error) {
+	var attachments []storage.Attachment
+	for _, header := range r.MultipartForm.File["attachments"] {
+		f, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		contentType := header.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		attachments = append(attachments, storage.Attachment{
+			Name: filepath.Base(header.Filename),
+			Type: contentType,
+			Data: data,
 		})
 	}
+	return attachments, nil
 }
 
 func showMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore) http.HandlerFunc {
@@ -302,7 +1028,7 @@ func showMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore)
 	}
 }
 
-func showMsgFullHandler(sessions *sessions.CookieStore, store storage.MessageStore) http.HandlerFunc {
+func showMsgFullHandler(sessions *sessions.CookieStore, store storage.MessageStore, groups storage.GroupStore, trustedProxy bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
 		sess, _ := sessions.Get(r, SESS_COOKIE)
@@ -327,11 +1053,54 @@ func showMsgFullHandler(sessions *sessions.CookieStore, store storage.MessageSto
 			sendError(r.Context(), sess, w, "failed to get a message", nil)
 			return
 		}
-		msg, err := store.GetFullMessage(r.Context(), id, pin)
+		username := ""
+		if u, ok := r.Context().Value(userKey).(*storage.User); ok {
+			username = u.PartitionKey
+		}
+		ctx := storage.WithClientFingerprint(r.Context(), clientFingerprint(r, trustedProxy))
+		// the share is redeemed before the view is used up,
+		// so it is not lost if the group is gone already
+		var group *storage.ShareGroup
+		ctx = storage.WithBeforeRead(ctx, func(m *storage.Message, text string) error {
+			if !m.IsShare() {
+				return nil
+			}
+			var err error
+			group, err = groups.RedeemShare(r.Context(), m.GroupID, text)
+			return err
+		})
+		msg, err := store.GetFullMessage(ctx, id, pin, username)
+		if errors.Is(err, storage.ErrGroupNotFound) {
+			sendError(r.Context(), sess, w, "the secret was recovered already or has expired", nil)
+			return
+		}
+		if errors.Is(err, storage.ErrNotRecipient) {
+			slog.LogAttrs(r.Context(), slog.LevelInfo, "message restricted to other recipients", slog.String("id", id), slog.String("username", username))
+			w.WriteHeader(http.StatusForbidden)
+			tmpl.ExecuteTemplate(w, "403.tmpl", nil)
+			return
+		}
+		if errors.Is(err, storage.ErrMessageChanged) {
+			sendErrorStatus(r.Context(), sess, w, http.StatusConflict, "the message is being opened at the same time, try again", nil)
+			return
+		}
+		if errors.Is(err, storage.ErrMessageLocked) {
+			// the page shows the countdown instead of the form
+			http.Redirect(w, r, "/messages/"+id, http.StatusSeeOther)
+			return
+		}
 		if err != nil || msg == nil {
 			sendError(r.Context(), sess, w, "failed to get a message", err)
 			return
 		}
+		if msg.IsShare() {
+			tmpl.ExecuteTemplate(w, "group.show.tmpl", map[string]interface{}{
+				VIEW_SESS_KEY: sess.Values,
+				VIEW_DATA_KEY: group,
+				"redeemed":    true,
+			})
+			return
+		}
 		tmpl.ExecuteTemplate(w, "message.show.tmpl", map[string]interface{}{
 			VIEW_DATA_KEY: msg,
 			VIEW_SESS_KEY: sess.Values,
@@ -339,23 +1108,700 @@ func showMsgFullHandler(sessions *sessions.CookieStore, store storage.MessageSto
 	}
 }
 
-func statsHandler(sessions *sessions.CookieStore, userStore storage.UserStore, messageStore storage.MessageStore) http.HandlerFunc {
+func deleteMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
 		sess, _ := sessions.Get(r, SESS_COOKIE)
-		users, err := userStore.CountUsers(r.Context())
+		err := r.ParseForm()
 		if err != nil {
-			sendError(r.Context(), sess, w, "failed to get a user count", err)
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
 			return
 		}
-		messages, err := messageStore.CountMessages(r.Context())
-		if err != nil {
-			sendError(r.Context(), sess, w, "failed to get a message count", err)
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
 			return
 		}
-		tmpl.ExecuteTemplate(w, "stats.tmpl", map[string]interface{}{
-			VIEW_DATA_KEY: map[string]int64{
-				"TotalUsers":    users,
-				"TotalMessages": messages,
+		username := sess.Values[SESS_USER_KEY]
+		err = store.DeleteMessage(r.Context(), id, username.(string))
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			send404(w)
+			return
+		}
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to delete message", err)
+			return
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "message revoked by the owner", slog.String("id", id), slog.String("username", username.(string)))
+		http.Redirect(w, r, "/messages", http.StatusSeeOther)
+	}
+}
+
+func resetPinPageHandler(sessions *sessions.CookieStore, store storage.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		msg, err := store.GetMessage(r.Context(), id)
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to get a message", err)
+			return
+		}
+		username := sess.Values[SESS_USER_KEY]
+		if msg == nil || msg.RowKey != username {
+			send404(w)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "message.pin.tmpl", map[string]interface{}{
+			VIEW_DATA_KEY: msg,
+			VIEW_SESS_KEY: sess.Values,
+		})
+	}
+}
+
+func resetPinHandler(sessions *sessions.CookieStore, store storage.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		if !parseLimitedForm(w, r, sess, MAX_FORM_SIZE, fmt.Sprintf("request is too large, it can be up to %d MB", MAX_FORM_SIZE>>20)) {
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		oldPin := r.PostForm.Get("pin")
+		payload := r.PostForm.Get("payload")
+		if oldPin == "" && payload == "" {
+			sendError(r.Context(), sess, w, "provide the old PIN or the original message", nil)
+			return
+		}
+		username := sess.Values[SESS_USER_KEY]
+		msg, err := store.ResetMessagePin(r.Context(), id, username.(string), oldPin, payload)
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			send404(w)
+			return
+		}
+		if errors.Is(err, storage.ErrInvalidPin) {
+			sendError(r.Context(), sess, w, "the old PIN is not valid", err)
+			return
+		}
+		if errors.Is(err, storage.ErrMessageChanged) {
+			sendError(r.Context(), sess, w, "the message was opened or changed in the meantime, check it before resetting the PIN again", err)
+			return
+		}
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to reset the PIN", err)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "message.created.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: msg,
+			"reset":       true,
+		})
+	}
+}
+
+func editMsgPageHandler(sessions *sessions.CookieStore, store storage.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		msg, err := store.GetMessage(r.Context(), id)
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to get a message", err)
+			return
+		}
+		username := sess.Values[SESS_USER_KEY]
+		if msg == nil || msg.RowKey != username || msg.IsTombstone() {
+			send404(w)
+			return
+		}
+		if !msg.CanEdit() {
+			sendError(r.Context(), sess, w, "the message can no longer be edited", nil)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "message.edit.tmpl", map[string]interface{}{
+			VIEW_DATA_KEY: msg,
+			VIEW_SESS_KEY: sess.Values,
+		})
+	}
+}
+
+func editMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore, quota storage.Quota) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		if !parseLimitedForm(w, r, sess, MAX_FORM_SIZE, fmt.Sprintf("request is too large, it can be up to %d MB", MAX_FORM_SIZE>>20)) {
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		payload := r.PostForm.Get("payload")
+		if payload == "" {
+			sendError(r.Context(), sess, w, "message is empty", nil)
+			return
+		}
+		format := storage.ContentFormat{Type: r.PostForm.Get("format")}
+		if format.Type == storage.FormatCode {
+			format.Language = strings.ToLower(strings.TrimSpace(r.PostForm.Get("language")))
+		}
+		username := sess.Values[SESS_USER_KEY]
+		// the store measures the re-encrypted message against the room left in the quota
+		u := r.Context().Value(userKey).(*storage.User)
+		usage, err := getUsage(r.Context(), store, u)
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to measure the usage", err)
+			return
+		}
+		room := u.GetQuota(quota).Room(usage)
+		msg, err := store.UpdateMessage(r.Context(), id, username.(string), payload, format, r.PostForm.Get("pin"), room)
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			send404(w)
+			return
+		}
+		if errors.Is(err, storage.ErrQuotaExceeded) {
+			slog.LogAttrs(r.Context(), slog.LevelInfo, "quota exceeded", slog.String("username", u.PartitionKey), slog.Any("error", err))
+			sendErrorStatus(r.Context(), sess, w, http.StatusForbidden, err.Error(), nil)
+			return
+		}
+		if errors.Is(err, storage.ErrInvalidPin) {
+			sendError(r.Context(), sess, w, "the PIN is not valid", err)
+			return
+		}
+		if errors.Is(err, storage.ErrMessageOpened) {
+			sendError(r.Context(), sess, w, "the message was read already and can no longer be edited", err)
+			return
+		}
+		if errors.Is(err, storage.ErrMessageChanged) {
+			sendError(r.Context(), sess, w, "the message was opened or changed in the meantime, check it before editing again", err)
+			return
+		}
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to edit the message", err)
+			return
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "message edited by the owner", slog.String("id", id), slog.String("username", username.(string)))
+		tmpl.ExecuteTemplate(w, "message.created.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: msg,
+			"edited":      true,
+		})
+	}
+}
+
+func labelMsgHandler(sessions *sessions.CookieStore, store storage.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		err := r.ParseForm()
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		labels, err := storage.ParseLabels(r.PostForm.Get("labels"))
+		if err != nil {
+			sendError(r.Context(), sess, w, err.Error(), nil)
+			return
+		}
+		username := sess.Values[SESS_USER_KEY]
+		_, err = store.SetMessageLabels(r.Context(), id, username.(string), r.PostForm.Get("title"), labels)
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			send404(w)
+			return
+		}
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to update the message", err)
+			return
+		}
+		http.Redirect(w, r, "/messages", http.StatusSeeOther)
+	}
+}
+
+func createRequestPageHandler(sessions *sessions.CookieStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		tmpl.ExecuteTemplate(w, "request.create.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: map[string]interface{}{
+				"ExpiryOptions":  messageExpiryOptions,
+				"DefaultExpiry":  defaultMessageExpiry,
+				"MaxDescription": storage.MAX_REQUEST_DESCRIPTION,
+			},
+		})
+	}
+}
+
+func createRequestHandler(sessions *sessions.CookieStore, store storage.RequestStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		err := r.ParseForm()
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		expiry := r.PostForm.Get("expiry")
+		if expiry == "" {
+			expiry = defaultMessageExpiry
+		}
+		expiresIn, ok := findMessageExpiry(expiry)
+		if !ok {
+			sendError(r.Context(), sess, w, "unsupported request expiry", nil)
+			return
+		}
+		username := sess.Values[SESS_USER_KEY]
+		req, err := store.AddRequest(r.Context(), username.(string), r.PostForm.Get("description"), expiresIn)
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to create the secret request", err)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "request.created.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: req,
+		})
+	}
+}
+
+// showRequestHandler is the page of the visitor who is asked for the secret
+func showRequestHandler(sessions *sessions.CookieStore, store storage.RequestStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		req, err := store.GetRequest(r.Context(), r.PathValue("id"))
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to get the secret request", err)
+			return
+		}
+		if req == nil {
+			send404(w)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "request.show.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: req,
+		})
+	}
+}
+
+func submitRequestHandler(sessions *sessions.CookieStore, store storage.RequestStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_FORM_SIZE)
+		err := r.ParseForm()
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		payload := r.PostForm.Get("payload")
+		if payload == "" {
+			sendError(r.Context(), sess, w, "payload is empty", nil)
+			return
+		}
+		err = store.SubmitSecret(r.Context(), id, payload)
+		if errors.Is(err, storage.ErrRequestNotFound) {
+			send404(w)
+			return
+		}
+		if errors.Is(err, storage.ErrRequestAnswered) {
+			sendError(r.Context(), sess, w, "the secret was sent already", err)
+			return
+		}
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to send the secret", err)
+			return
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "secret request answered", slog.String("id", id))
+		tmpl.ExecuteTemplate(w, "request.show.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			"sent":        true,
+		})
+	}
+}
+
+func openRequestHandler(sessions *sessions.CookieStore, store storage.RequestStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		err := r.ParseForm()
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		username := sess.Values[SESS_USER_KEY]
+		req, err := store.OpenSecret(r.Context(), id, username.(string), r.PostForm.Get("pin"))
+		if errors.Is(err, storage.ErrRequestNotFound) {
+			send404(w)
+			return
+		}
+		if errors.Is(err, storage.ErrInvalidPin) {
+			sendError(r.Context(), sess, w, "the PIN is not valid", err)
+			return
+		}
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to open the secret", err)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "request.open.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: req,
+		})
+	}
+}
+
+func deleteRequestHandler(sessions *sessions.CookieStore, store storage.RequestStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		err := r.ParseForm()
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		username := sess.Values[SESS_USER_KEY]
+		err = store.DeleteRequest(r.Context(), id, username.(string))
+		if errors.Is(err, storage.ErrRequestNotFound) {
+			send404(w)
+			return
+		}
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to delete the secret request", err)
+			return
+		}
+		http.Redirect(w, r, "/messages", http.StatusSeeOther)
+	}
+}
+
+func showGroupHandler(sessions *sessions.CookieStore, store storage.GroupStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		group, err := store.GetGroup(r.Context(), r.PathValue("id"))
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to get a share group", err)
+			return
+		}
+		if group == nil {
+			send404(w)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "group.show.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: group,
+		})
+	}
+}
+
+func combineGroupHandler(sessions *sessions.CookieStore, store storage.GroupStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		if err := r.ParseForm(); err != nil {
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		pin := r.PostForm.Get("pin")
+		if pin == "" {
+			sendError(r.Context(), sess, w, "group pin is empty", nil)
+			return
+		}
+		id := r.PathValue("id")
+		secret, err := store.CombineShares(r.Context(), id, pin)
+		if errors.Is(err, storage.ErrGroupNotFound) {
+			send404(w)
+			return
+		}
+		if errors.Is(err, storage.ErrNotEnoughShares) {
+			sendError(r.Context(), sess, w, "not enough shares were redeemed yet", nil)
+			return
+		}
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to recover the secret", err)
+			return
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "secret recovered from the shares", slog.String("id", id))
+		tmpl.ExecuteTemplate(w, "group.show.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			"secret":      secret,
+		})
+	}
+}
+
+// absoluteURL builds the link to be used outside of the application,
+// the configured public url takes precedence over the request host
+func absoluteURL(r *http.Request, publicURL string, path string) string {
+	if publicURL != "" {
+		return publicURL + path
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+func accountSettingsPageHandler(sessions *sessions.CookieStore, users storage.UserStore, mailEnabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		username := sess.Values[SESS_USER_KEY].(string)
+		usr, err := users.GetUser(r.Context(), username)
+		if err != nil || usr == nil {
+			sendError(r.Context(), sess, w, "failed to get account", err)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "account.settings.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: map[string]interface{}{
+				"User":        usr,
+				"MailEnabled": mailEnabled,
+			},
+		})
+	}
+}
+
+func accountSettingsHandler(sessions *sessions.CookieStore, users storage.UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		err := r.ParseForm()
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		email := strings.TrimSpace(r.PostForm.Get("email"))
+		if email != "" {
+			addr, err := netmail.ParseAddress(email)
+			if err != nil {
+				sendError(r.Context(), sess, w, "email address is not valid", err)
+				return
+			}
+			email = addr.Address
+		}
+		username := sess.Values[SESS_USER_KEY].(string)
+		err = users.SetUserEmail(r.Context(), username, email)
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to update account", err)
+			return
+		}
+		http.Redirect(w, r, "/accounts/settings", http.StatusSeeOther)
+	}
+}
+
+func listWebhooksHandler(sessions *sessions.CookieStore, store storage.WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		renderWebhooks(w, r, sess, store, nil)
+	}
+}
+
+// renderWebhooks shows the webhooks of the user with the latest deliveries,
+// the created webhook is passed only once to show its secret
+func renderWebhooks(w http.ResponseWriter, r *http.Request, sess *sessions.Session, store storage.WebhookStore, created *storage.Webhook) {
+	username := sess.Values[SESS_USER_KEY].(string)
+	hooks, err := store.ListWebhooks(r.Context(), username)
+	if err != nil {
+		sendError(r.Context(), sess, w, "failed to list webhooks", err)
+		return
+	}
+	deliveries, err := store.ListDeliveries(r.Context(), username)
+	if err != nil {
+		sendError(r.Context(), sess, w, "failed to list webhook deliveries", err)
+		return
+	}
+	tmpl.ExecuteTemplate(w, "webhooks.tmpl", map[string]interface{}{
+		VIEW_SESS_KEY: sess.Values,
+		VIEW_DATA_KEY: map[string]interface{}{
+			"Webhooks":   hooks,
+			"Deliveries": deliveries,
+			"Created":    created,
+			"Max":        storage.MAX_WEBHOOKS,
+		},
+	})
+}
+
+func createWebhookHandler(sessions *sessions.CookieStore, store storage.WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		err := r.ParseForm()
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		username := sess.Values[SESS_USER_KEY].(string)
+		hook, err := store.AddWebhook(r.Context(), username, r.PostForm.Get("url"))
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to add the webhook", err)
+			return
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "webhook added", slog.String("id", hook.ID()), slog.String("username", username))
+		renderWebhooks(w, r, sess, store, hook)
+	}
+}
+
+func deleteWebhookHandler(sessions *sessions.CookieStore, store storage.WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		err := r.ParseForm()
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		username := sess.Values[SESS_USER_KEY].(string)
+		err = store.DeleteWebhook(r.Context(), username, id)
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			send404(w)
+			return
+		}
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to delete the webhook", err)
+			return
+		}
+		http.Redirect(w, r, "/webhooks", http.StatusSeeOther)
+	}
+}
+
+func quotasPageHandler(sessions *sessions.CookieStore, users storage.UserStore, messages storage.MessageStore, defaultQuota storage.Quota) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		data := map[string]interface{}{
+			"Default": defaultQuota,
+		}
+		if username := strings.TrimSpace(r.URL.Query().Get("username")); username != "" {
+			usr, err := users.GetUser(r.Context(), username)
+			if err != nil {
+				sendError(r.Context(), sess, w, "failed to get a user", err)
+				return
+			}
+			if usr == nil {
+				sendErrorStatus(r.Context(), sess, w, http.StatusNotFound, fmt.Sprintf("user %s does not exist", username), nil)
+				return
+			}
+			usage, err := getUsage(r.Context(), messages, usr)
+			if err != nil {
+				sendError(r.Context(), sess, w, "failed to measure the usage", err)
+				return
+			}
+			data["User"] = usr
+			data["Usage"] = usage
+			data["Quota"] = usr.GetQuota(defaultQuota)
+		}
+		tmpl.ExecuteTemplate(w, "admin.quotas.tmpl", map[string]interface{}{
+			VIEW_SESS_KEY: sess.Values,
+			VIEW_DATA_KEY: data,
+		})
+	}
+}
+
+// setQuotaHandler overrides the quota of the user, the reset restores the default one
+func setQuotaHandler(sessions *sessions.CookieStore, users storage.UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		err := r.ParseForm()
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+			return
+		}
+		csrf := r.PostForm.Get("_csrf")
+		if csrf == "" || csrf != sess.Values[SESS_CSRF_KEY] {
+			sendError(r.Context(), sess, w, "invalid token", nil)
+			return
+		}
+		usr, err := users.GetUser(r.Context(), username)
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to get a user", err)
+			return
+		}
+		if usr == nil {
+			send404(w)
+			return
+		}
+		var quota *storage.Quota
+		if r.PostForm.Get("reset") == "" {
+			active, errActive := strconv.Atoi(r.PostForm.Get("active"))
+			bytes, errBytes := strconv.ParseInt(r.PostForm.Get("bytes"), 10, 64)
+			daily, errDaily := strconv.Atoi(r.PostForm.Get("daily"))
+			if errActive != nil || errBytes != nil || errDaily != nil {
+				sendError(r.Context(), sess, w, "quota limits must be whole numbers, zero for no limit", nil)
+				return
+			}
+			quota = &storage.Quota{ActiveMessages: active, StoredBytes: bytes, DailyMessages: daily}
+			if err := quota.Validate(); err != nil {
+				sendError(r.Context(), sess, w, err.Error(), nil)
+				return
+			}
+		}
+		if err := users.SetUserQuota(r.Context(), username, quota); err != nil {
+			sendError(r.Context(), sess, w, "failed to set the quota", err)
+			return
+		}
+		admin := sess.Values[SESS_USER_KEY]
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "quota changed", slog.String("username", username), slog.Any("admin", admin), slog.Bool("reset", quota == nil))
+		http.Redirect(w, r, "/admin/quotas?username="+url.QueryEscape(username), http.StatusSeeOther)
+	}
+}
+
+func statsHandler(sessions *sessions.CookieStore, userStore storage.UserStore, messageStore storage.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := sessions.Get(r, SESS_COOKIE)
+		users, err := userStore.CountUsers(r.Context())
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to get a user count", err)
+			return
+		}
+		messages, err := messageStore.CountMessages(r.Context())
+		if err != nil {
+			sendError(r.Context(), sess, w, "failed to get a message count", err)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "stats.tmpl", map[string]interface{}{
+			VIEW_DATA_KEY: map[string]int64{
+				"TotalUsers":    users,
+				"TotalMessages": messages,
 			},
 			VIEW_SESS_KEY: sess.Values,
 		})
@@ -425,6 +1871,15 @@ func hasAuth(h http.Handler) http.Handler {
 	})
 }
 
+// hasAuthOrAnonymous lets the visitors without an account through if allowed,
+// the handler finds out from the context if the user is set
+func hasAuthOrAnonymous(allowed bool, h http.Handler) http.Handler {
+	if !allowed {
+		return hasAuth(h)
+	}
+	return h
+}
+
 // This ought to be used after the authentication check (hasAuth)
 // Additional check for user here is to avoid unexpected usage
 func hasPermission(permission string, h http.Handler) http.Handler {
@@ -449,13 +1904,115 @@ func hasPermission(permission string, h http.Handler) http.Handler {
 	})
 }
 
+var userAgentBrowsers = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+}
+
+var userAgentPlatforms = []struct{ token, name string }{
+	{"Android", "Android"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"Windows", "Windows"},
+	{"Mac OS X", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// clientAddr is the address the request came from. The X-Forwarded-For header
+// is sent by the client as well, so it is only used behind a trusted proxy which
+// appends the address it got the request from, that is the last one in the list.
+func clientAddr(r *http.Request, trustedProxy bool) string {
+	addr := r.RemoteAddr
+	if forwarded := r.Header.Get("X-Forwarded-For"); trustedProxy && forwarded != "" {
+		addr = strings.TrimSpace(forwarded[strings.LastIndex(forwarded, ",")+1:])
+	}
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		addr = ap.Addr().String()
+	}
+	return addr
+}
+
+// rateLimitKey identifies the client by its address, see clientAddr.
+// IPv6 clients usually get the whole /64 network so they are counted by it.
+func rateLimitKey(r *http.Request, trustedProxy bool) string {
+	addr := clientAddr(r, trustedProxy)
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return addr
+	}
+	if ip.Unmap().Is4() {
+		return ip.Unmap().String()
+	}
+	if prefix, err := ip.Prefix(64); err == nil {
+		return prefix.String()
+	}
+	return addr
+}
+
+// clientFingerprint describes the client coarsely enough not to identify a person:
+// the browser and the platform families and the network the request came from.
+// The network is taken from clientAddr, so it is not forged by the client.
+func clientFingerprint(r *http.Request, trustedProxy bool) string {
+	ua := r.UserAgent()
+	browser, platform := "Unknown browser", "unknown platform"
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, p := range userAgentPlatforms {
+		if strings.Contains(ua, p.token) {
+			platform = p.name
+			break
+		}
+	}
+	fingerprint := browser + " on " + platform
+	if ip, err := netip.ParseAddr(clientAddr(r, trustedProxy)); err == nil {
+		bits := 48
+		if ip.Unmap().Is4() {
+			ip, bits = ip.Unmap(), 24
+		}
+		if prefix, err := ip.Prefix(bits); err == nil {
+			fingerprint += " from " + prefix.String()
+		}
+	}
+	return fingerprint
+}
+
 type ApiError struct {
 	Message string `json:"message"`
 	Error   string `json:"error"`
 }
 
+// parseLimitedForm reads the multipart form of at most limit bytes, the larger
+// body is refused with 413 instead of being spooled to disk. It sends the error
+// response and returns false if the form cannot be read.
+func parseLimitedForm(w http.ResponseWriter, r *http.Request, sess *sessions.Session, limit int64, tooLarge string) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	err := r.ParseMultipartForm(MAX_FORM_SIZE)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		sendErrorStatus(r.Context(), sess, w, http.StatusRequestEntityTooLarge, tooLarge, err)
+		return false
+	}
+	if err != nil {
+		sendError(r.Context(), sess, w, "failed to read request body parameters", err)
+		return false
+	}
+	return true
+}
+
 // sendError sends a json error response and logs the error message
 func sendError(ctx context.Context, sess *sessions.Session, w http.ResponseWriter, message string, err error) {
+	sendErrorStatus(ctx, sess, w, http.StatusBadRequest, message, err)
+}
+
+func sendErrorStatus(ctx context.Context, sess *sessions.Session, w http.ResponseWriter, status int, message string, err error) {
 	if err == nil {
 		err = errors.New(message)
 	}
@@ -463,7 +2020,7 @@ func sendError(ctx context.Context, sess *sessions.Session, w http.ResponseWrite
 	apiError := ApiError{
 		Message: message,
 	}
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(status)
 	tmpl.ExecuteTemplate(w, "400.tmpl", map[string]interface{}{
 		VIEW_SESS_KEY:  sess.Values,
 		VIEW_ERROR_KEY: apiError,
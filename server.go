@@ -7,17 +7,23 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/ivarprudnikov/secretshare/internal/configuration"
+	"github.com/ivarprudnikov/secretshare/internal/mailer"
 	"github.com/ivarprudnikov/secretshare/internal/storage"
 	"github.com/ivarprudnikov/secretshare/internal/storage/aztablestore"
 	"github.com/ivarprudnikov/secretshare/internal/storage/memstore"
+	"github.com/ivarprudnikov/secretshare/internal/webhooks"
 )
 
-func NewHttpHandler(sessions *sessions.CookieStore, messages storage.MessageStore, users storage.UserStore) http.Handler {
+// how often the expired messages get removed from the storage
+const SWEEP_INTERVAL = 5 * time.Minute
+
+func NewHttpHandler(config *configuration.ConfigReader, sessions *sessions.CookieStore, messages storage.MessageStore, users storage.UserStore, hooks storage.WebhookStore, requests storage.RequestStore, groups storage.GroupStore, mail mailer.Mailer) http.Handler {
 	mux := http.NewServeMux()
-	AddRoutes(mux, sessions, messages, users)
+	AddRoutes(mux, config, sessions, messages, users, hooks, requests, groups, mail)
 	return mux
 }
 
@@ -35,8 +41,23 @@ func main() {
 		log.Fatalf("Invalid config: %v", vars)
 	}
 	sessions := sessions.NewCookieStore([]byte(config.GetCookieAuth()), []byte(config.GetCookieEnc()))
-	messages, users := getStorageImplementation(config)
-	handler := NewHttpHandler(sessions, messages, users)
+	messages, users, hooks, requests, groups := getStorageImplementation(config)
+	// local development sends the webhooks to the local test servers
+	dispatcher := webhooks.NewDispatcher(hooks, webhooks.Options{AllowPrivate: !config.IsProd()})
+	messages.Subscribe(dispatcher)
+	go dispatcher.Run(context.Background())
+	// emails are optional and sent only when the smtp server is configured
+	var mail mailer.Mailer
+	if smtpConfig := config.GetSMTPConfig(); smtpConfig.Enabled() {
+		mail = mailer.NewSMTPMailer(smtpConfig)
+		notifier := mailer.NewOwnerNotifier(mail, users)
+		messages.Subscribe(notifier)
+		go notifier.Run(context.Background())
+	}
+	go storage.RunSweeper(context.Background(), messages, SWEEP_INTERVAL)
+	go storage.RunRequestSweeper(context.Background(), requests, SWEEP_INTERVAL)
+	go storage.RunGroupSweeper(context.Background(), groups, SWEEP_INTERVAL)
+	handler := NewHttpHandler(config, sessions, messages, users, hooks, requests, groups, mail)
 	port := getPort()
 	listenAddr := "127.0.0.1:" + port
 	log.Printf("About to listen on %s. Go to http://%s/", port, listenAddr)
@@ -54,29 +75,40 @@ func getPort() string {
 
 // Production environment needs to work with Azure Table Storage which is not
 // available locally. Locally an in-memory implementation of storage is used.
-func getStorageImplementation(config *configuration.ConfigReader) (storage.MessageStore, storage.UserStore) {
+func getStorageImplementation(config *configuration.ConfigReader) (storage.MessageStore, storage.UserStore, storage.WebhookStore, storage.RequestStore, storage.GroupStore) {
 	var messages storage.MessageStore
 	var users storage.UserStore
+	var hooks storage.WebhookStore
+	var requests storage.RequestStore
+	var groups storage.GroupStore
 
 	if config.IsProd() {
-		messages = aztablestore.NewAzMessageStore(config.GetStorageAccountName(), config.GetMessagesTableName(), config.GetSalt())
+		messages = aztablestore.NewAzMessageStore(config.GetStorageAccountName(), config.GetMessagesTableName(), config.GetSalt(), config.GetPinPolicy(), config.GetIDPolicy())
 		users = aztablestore.NewAzUserStore(config.GetStorageAccountName(), config.GetUsersTableName(), config.GetSalt())
+		hooks = aztablestore.NewAzWebhookStore(config.GetStorageAccountName(), config.GetWebhooksTableName(), config.GetSalt())
+		requests = aztablestore.NewAzRequestStore(config.GetStorageAccountName(), config.GetRequestsTableName(), config.GetSalt(), config.GetPinPolicy(), config.GetIDPolicy())
+		groups = aztablestore.NewAzGroupStore(config.GetStorageAccountName(), config.GetGroupsTableName(), config.GetSalt(), config.GetPinPolicy(), config.GetIDPolicy())
 	} else {
-		messages = memstore.NewMemMessageStore(config.GetSalt())
+		messages = memstore.NewMemMessageStore(config.GetSalt(), config.GetPinPolicy(), config.GetIDPolicy())
 		users = memstore.NewMemUserStore(config.GetSalt())
+		hooks = memstore.NewMemWebhookStore(config.GetSalt())
+		requests = memstore.NewMemRequestStore(config.GetSalt(), config.GetPinPolicy(), config.GetIDPolicy())
+		groups = memstore.NewMemGroupStore(config.GetSalt(), config.GetPinPolicy(), config.GetIDPolicy())
 		bootstrapTestData(messages, users)
 	}
-	return messages, users
+	return messages, users, hooks, requests, groups
 }
 
 func bootstrapTestData(messages storage.MessageStore, users storage.UserStore) {
 	// add test users
 	users.AddUser(context.Background(), "joe", "joe", []string{})
 	users.AddUser(context.Background(), "alice", "alice", []string{})
-	users.AddUser(context.Background(), "admin", "admin", []string{storage.PERMISSION_READ_STATS})
+	users.AddUser(context.Background(), "admin", "admin", []string{storage.PERMISSION_READ_STATS, storage.PERMISSION_MANAGE_QUOTAS})
 
 	// add a test message
-	msg, err := messages.AddMessage(context.Background(), "foobar", "joe")
+	msg, err := messages.AddMessage(context.Background(), "foobar", "joe", storage.MessageOptions{
+		ExpiresIn: 7 * 24 * time.Hour,
+	})
 	if err != nil {
 		panic("Unexpected error")
 	}